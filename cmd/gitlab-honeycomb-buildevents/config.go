@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/spf13/pflag"
+	"gopkg.in/yaml.v3"
+)
+
+// flagEnv matches the environment variable that configures a flag, which
+// every flag's usage starts with, e.g. [env.BUILDEVENT_DATASET].
+var flagEnv = regexp.MustCompile(`^\[env\.([A-Za-z0-9_]+)\]`)
+
+// loadConfigFile sets flags from a YAML or TOML file, whose keys are flag
+// names. Values in the file are only used for flags that weren't set on the
+// command line or by their environment variable.
+func loadConfigFile(flags *pflag.FlagSet, path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read config file: %w", err)
+	}
+
+	values := make(map[string]interface{})
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &values)
+	case ".toml":
+		err = toml.Unmarshal(data, &values)
+	default:
+		return fmt.Errorf("unknown config file format %q, expected .yaml, .yml or .toml", ext)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to parse config file %s: %w", path, err)
+	}
+
+	// Flags are set in order, so that errors are reported consistently.
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		flag := flags.Lookup(name)
+		if flag == nil || name == "config" {
+			return fmt.Errorf("unknown setting %q in config file %s", name, path)
+		}
+		if flag.Changed {
+			continue
+		}
+		if m := flagEnv.FindStringSubmatch(flag.Usage); m != nil {
+			if _, ok := os.LookupEnv(m[1]); ok {
+				continue
+			}
+		}
+
+		err := setFlag(flag, values[name])
+		if err != nil {
+			return fmt.Errorf("failed to configure `%s` from config file %s: %w", name, path, err)
+		}
+	}
+
+	return nil
+}
+
+// setFlag sets a flag to a value from a config file.
+func setFlag(flag *pflag.Flag, value interface{}) error {
+	switch v := value.(type) {
+	case []interface{}:
+		items := make([]string, 0, len(v))
+		for _, item := range v {
+			s, err := configScalar(item)
+			if err != nil {
+				return err
+			}
+			items = append(items, s)
+		}
+
+		if slice, ok := flag.Value.(pflag.SliceValue); ok {
+			return slice.Replace(items)
+		}
+		return flag.Value.Set(strings.Join(items, ","))
+	default:
+		s, err := configScalar(v)
+		if err != nil {
+			return err
+		}
+		return flag.Value.Set(s)
+	}
+}
+
+// configScalar returns a value from a config file as a flag value.
+func configScalar(value interface{}) (string, error) {
+	switch v := value.(type) {
+	case string:
+		return v, nil
+	case bool, int, int64, uint64, float64:
+		return fmt.Sprint(v), nil
+	default:
+		return "", fmt.Errorf("unsupported value %v", value)
+	}
+}
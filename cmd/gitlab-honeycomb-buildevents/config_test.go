@@ -0,0 +1,192 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/spf13/pflag"
+)
+
+// newTestFlags returns flags declared the way the commands declare them,
+// with each flag's environment variable applied, and then parses args.
+func newTestFlags(t *testing.T, args ...string) *pflag.FlagSet {
+	t.Helper()
+
+	flags := pflag.NewFlagSet("test", pflag.ContinueOnError)
+	flags.String("dataset", "buildevents", "[env.TEST_DATASET] the dataset")
+	flags.Int("workers", 4, "[env.TEST_WORKERS] the number of workers")
+	flags.StringSlice("variables-allow", nil, "[env.TEST_VARIABLES_ALLOW] the allowed variables")
+	flags.Bool("debug", false, "enable debug logging")
+	flags.VisitAll(func(flag *pflag.Flag) {
+		m := flagEnv.FindStringSubmatch(flag.Usage)
+		if m == nil {
+			return
+		}
+		if value, ok := os.LookupEnv(m[1]); ok {
+			err := flag.Value.Set(value)
+			if err != nil {
+				t.Fatalf("failed to configure `%s`: %s", flag.Name, err)
+			}
+		}
+	})
+
+	err := flags.Parse(args)
+	if err != nil {
+		t.Fatalf("failed to parse flags: %s", err)
+	}
+	return flags
+}
+
+func writeConfigFile(t *testing.T, name, data string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), name)
+	err := os.WriteFile(path, []byte(data), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func Test_loadConfigFile(t *testing.T) {
+	yamlConfig := "dataset: from-file\nworkers: 8\nvariables-allow: [DEPLOY_*, TEST_SUITE]\ndebug: true\n"
+	tomlConfig := "dataset = \"from-file\"\nworkers = 8\nvariables-allow = [\"DEPLOY_*\", \"TEST_SUITE\"]\ndebug = true\n"
+
+	tests := []struct {
+		name        string
+		file        string
+		config      string
+		args        []string
+		env         map[string]string
+		wantDataset string
+		wantWorkers string
+		wantAllow   []string
+	}{
+		{
+			name:        "defaults",
+			file:        "config.yaml",
+			config:      "debug: true\n",
+			wantDataset: "buildevents",
+			wantWorkers: "4",
+			wantAllow:   []string{},
+		},
+		{
+			name:        "file over defaults",
+			file:        "config.yaml",
+			config:      yamlConfig,
+			wantDataset: "from-file",
+			wantWorkers: "8",
+			wantAllow:   []string{"DEPLOY_*", "TEST_SUITE"},
+		},
+		{
+			name:        "toml file over defaults",
+			file:        "config.toml",
+			config:      tomlConfig,
+			wantDataset: "from-file",
+			wantWorkers: "8",
+			wantAllow:   []string{"DEPLOY_*", "TEST_SUITE"},
+		},
+		{
+			name:        "env over file",
+			file:        "config.yaml",
+			config:      yamlConfig,
+			env:         map[string]string{"TEST_DATASET": "from-env", "TEST_VARIABLES_ALLOW": "RELEASE_*"},
+			wantDataset: "from-env",
+			wantWorkers: "8",
+			wantAllow:   []string{"RELEASE_*"},
+		},
+		{
+			name:        "flag over env and file",
+			file:        "config.yaml",
+			config:      yamlConfig,
+			args:        []string{"--dataset", "from-flag", "--workers", "2"},
+			env:         map[string]string{"TEST_DATASET": "from-env"},
+			wantDataset: "from-flag",
+			wantWorkers: "2",
+			wantAllow:   []string{"DEPLOY_*", "TEST_SUITE"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			flags := newTestFlags(t, tt.args...)
+
+			err := loadConfigFile(flags, writeConfigFile(t, tt.file, tt.config))
+			if err != nil {
+				t.Fatalf("loadConfigFile() error = %s", err)
+			}
+
+			if got := flags.Lookup("dataset").Value.String(); got != tt.wantDataset {
+				t.Errorf("dataset = %q, want %q", got, tt.wantDataset)
+			}
+			if got := flags.Lookup("workers").Value.String(); got != tt.wantWorkers {
+				t.Errorf("workers = %q, want %q", got, tt.wantWorkers)
+			}
+			if got, _ := flags.GetStringSlice("variables-allow"); !reflect.DeepEqual(got, tt.wantAllow) {
+				t.Errorf("variables-allow = %q, want %q", got, tt.wantAllow)
+			}
+			if got, _ := flags.GetBool("debug"); !got {
+				t.Errorf("debug = false, want it set from the file")
+			}
+		})
+	}
+}
+
+func Test_loadConfigFileErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		file   string
+		config string
+	}{
+		{"unknown format", "config.json", "{}"},
+		{"invalid yaml", "config.yaml", "dataset: [\n"},
+		{"unknown setting", "config.yaml", "datsaet: typo\n"},
+		{"config file setting", "config.yaml", "config: other.yaml\n"},
+		{"invalid value", "config.yaml", "workers: many\n"},
+		{"unsupported value", "config.yaml", "dataset: {nested: map}\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			flags := newTestFlags(t)
+			flags.String("config", "", "the config file")
+
+			err := loadConfigFile(flags, writeConfigFile(t, tt.file, tt.config))
+			if err == nil {
+				t.Errorf("loadConfigFile() succeeded, want an error")
+			}
+		})
+	}
+
+	err := loadConfigFile(newTestFlags(t), filepath.Join(t.TempDir(), "missing.yaml"))
+	if err == nil {
+		t.Errorf("loadConfigFile() of a missing file succeeded, want an error")
+	}
+}
+
+func Test_flagEnv(t *testing.T) {
+	tests := []struct {
+		usage string
+		want  string
+	}{
+		{"[env.BUILDEVENT_DATASET] the dataset", "BUILDEVENT_DATASET"},
+		{"[env.HOOK_SECRET]", "HOOK_SECRET"},
+		{"[env.lower_case2] a variable", "lower_case2"},
+		{"the dataset [env.BUILDEVENT_DATASET]", ""},
+		{"[env.] the dataset", ""},
+		{"[env.BUILDEVENT-DATASET] the dataset", ""},
+		{"enable debug logging", ""},
+	}
+	for _, tt := range tests {
+		var got string
+		if m := flagEnv.FindStringSubmatch(tt.usage); m != nil {
+			got = m[1]
+		}
+		if got != tt.want {
+			t.Errorf("flagEnv in %q = %q, want %q", tt.usage, got, tt.want)
+		}
+	}
+}
@@ -1,20 +1,83 @@
 package main
 
 import (
+	"fmt"
 	"log"
 	"os"
-	"strconv"
+	"strings"
 
 	"github.com/honeycombio/libhoney-go"
 	"github.com/spf13/cobra"
 	"github.com/zoidyzoidzoid/gitlab-honeycomb-buildevents-webhooks-sink/internal/hook"
+	"github.com/zoidyzoidzoid/gitlab-honeycomb-buildevents-webhooks-sink/internal/spool"
 )
 
 // Version is the default value that should be overridden in the
 // build/release process.
 var Version = "dev"
 
-func commandRoot(cfg *libhoney.Config) (*cobra.Command, bool) {
+// sinkConfig selects where spans are sent.
+type sinkConfig struct {
+	Name        string
+	Path        string
+	OTLP        hook.OTLPSinkConfig
+	OTLPHeaders string
+}
+
+// newSink returns the sink selected by cfg, and a function to release it
+// after the listener has shut down. A nil sink means hook.New builds the
+// Honeycomb sink.
+func newSink(cfg sinkConfig) (hook.Sink, func() error, error) {
+	switch cfg.Name {
+	case "honeycomb":
+		return nil, func() error { return nil }, nil
+	case "jsonl":
+		if cfg.Path == "" || cfg.Path == "-" {
+			return hook.NewJSONLinesSink(os.Stdout), func() error { return nil }, nil
+		}
+
+		f, err := os.OpenFile(cfg.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o640)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to open JSON lines file: %w", err)
+		}
+		return hook.NewJSONLinesSink(f), f.Close, nil
+	case "otlp":
+		headers, err := parseHeaders(cfg.OTLPHeaders)
+		if err != nil {
+			return nil, nil, err
+		}
+		cfg.OTLP.Headers = headers
+		cfg.OTLP.Version = Version
+
+		sink, err := hook.NewOTLPSink(cfg.OTLP)
+		if err != nil {
+			return nil, nil, err
+		}
+		return sink, func() error { return nil }, nil
+	default:
+		return nil, nil, fmt.Errorf("unknown sink %q, expected honeycomb, jsonl or otlp", cfg.Name)
+	}
+}
+
+// parseHeaders parses headers in the OTEL_EXPORTER_OTLP_HEADERS format,
+// key1=value1,key2=value2.
+func parseHeaders(s string) (map[string]string, error) {
+	headers := make(map[string]string)
+	for _, pair := range strings.Split(s, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		k, v, ok := strings.Cut(pair, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid header %q, expected key=value", pair)
+		}
+		headers[strings.TrimSpace(k)] = strings.TrimSpace(v)
+	}
+	return headers, nil
+}
+
+func commandRoot(cfg *libhoney.Config, hookCfg *hook.Config, sinkCfg *sinkConfig) *cobra.Command {
+	var configPath string
 	root := &cobra.Command{
 		Version: Version,
 		Use:     "buildevents",
@@ -22,6 +85,20 @@ func commandRoot(cfg *libhoney.Config) (*cobra.Command, bool) {
 		Long: `
 The buildevents executable creates Honeycomb events and tracing information
 about your Continuous Integration builds.`,
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+			if configPath == "" {
+				return nil
+			}
+			return loadConfigFile(cmd.Flags(), configPath)
+		},
+	}
+
+	root.PersistentFlags().StringVar(&configPath, "config", "", "[env.CONFIG_FILE] a YAML or TOML file of flag values, which flags and environment variables override")
+	if config, ok := os.LookupEnv("CONFIG_FILE"); ok {
+		err := root.PersistentFlags().Lookup("config").Value.Set(config)
+		if err != nil {
+			log.Fatalf("failed to configure `config`: %s", err)
+		}
 	}
 
 	root.PersistentFlags().StringVarP(&cfg.APIKey, "apikey", "k", "", "[env.BUILDEVENT_APIKEY] the Honeycomb authentication token")
@@ -49,48 +126,351 @@ about your Continuous Integration builds.`,
 		}
 	}
 
-	debug := root.PersistentFlags().Bool("debug", false, "[env.DEBUG] set the debug logging to true")
-	if debugEnv, ok := os.LookupEnv("DEBUG"); ok {
-		debugEnvParsed, err := strconv.ParseBool(debugEnv)
+	root.PersistentFlags().StringVar(&sinkCfg.Name, "sink", "honeycomb", "[env.SINK] where to send spans: honeycomb, jsonl or otlp")
+	if sink, ok := os.LookupEnv("SINK"); ok {
+		err := root.PersistentFlags().Lookup("sink").Value.Set(sink)
 		if err != nil {
-			log.Fatalf("failed to configure `debug`: %s", err)
+			log.Fatalf("failed to configure `sink`: %s", err)
 		}
-		debug = &debugEnvParsed
 	}
 
-	return root, *debug
-}
+	root.PersistentFlags().StringVar(&sinkCfg.Path, "jsonl-path", "-", "[env.JSONL_PATH] the file the jsonl sink appends spans to, or - for stdout")
+	if jsonlPath, ok := os.LookupEnv("JSONL_PATH"); ok {
+		err := root.PersistentFlags().Lookup("jsonl-path").Value.Set(jsonlPath)
+		if err != nil {
+			log.Fatalf("failed to configure `jsonl-path`: %s", err)
+		}
+	}
 
-func main() {
-	defer libhoney.Close()
-	var config libhoney.Config
+	root.PersistentFlags().StringVar(&sinkCfg.OTLP.Endpoint, "otlp-endpoint", "", "[env.OTEL_EXPORTER_OTLP_ENDPOINT] the OTLP collector endpoint, defaults to localhost on the protocol's default port")
+	if otlpEndpoint, ok := os.LookupEnv("OTEL_EXPORTER_OTLP_ENDPOINT"); ok {
+		err := root.PersistentFlags().Lookup("otlp-endpoint").Value.Set(otlpEndpoint)
+		if err != nil {
+			log.Fatalf("failed to configure `otlp-endpoint`: %s", err)
+		}
+	}
 
-	root, debug := commandRoot(&config)
+	root.PersistentFlags().StringVar(&sinkCfg.OTLP.Protocol, "otlp-protocol", hook.OTLPProtocolHTTPProtobuf, "[env.OTEL_EXPORTER_OTLP_PROTOCOL] the OTLP protocol: grpc, http/protobuf or http/json")
+	if otlpProtocol, ok := os.LookupEnv("OTEL_EXPORTER_OTLP_PROTOCOL"); ok {
+		err := root.PersistentFlags().Lookup("otlp-protocol").Value.Set(otlpProtocol)
+		if err != nil {
+			log.Fatalf("failed to configure `otlp-protocol`: %s", err)
+		}
+	}
 
-	// Do the work
-	if err := root.Execute(); err != nil {
-		libhoney.Close()
-		os.Exit(1)
+	root.PersistentFlags().StringVar(&sinkCfg.OTLPHeaders, "otlp-headers", "", "[env.OTEL_EXPORTER_OTLP_HEADERS] headers sent to the OTLP collector, as key1=value1,key2=value2")
+	if otlpHeaders, ok := os.LookupEnv("OTEL_EXPORTER_OTLP_HEADERS"); ok {
+		err := root.PersistentFlags().Lookup("otlp-headers").Value.Set(otlpHeaders)
+		if err != nil {
+			log.Fatalf("failed to configure `otlp-headers`: %s", err)
+		}
+	}
+
+	root.PersistentFlags().BoolVar(&sinkCfg.OTLP.Insecure, "otlp-insecure", false, "[env.OTEL_EXPORTER_OTLP_INSECURE] disable TLS for the OTLP gRPC connection")
+	if otlpInsecure, ok := os.LookupEnv("OTEL_EXPORTER_OTLP_INSECURE"); ok {
+		err := root.PersistentFlags().Lookup("otlp-insecure").Value.Set(otlpInsecure)
+		if err != nil {
+			log.Fatalf("failed to configure `otlp-insecure`: %s", err)
+		}
+	}
+
+	root.PersistentFlags().IntVar(&hookCfg.QueueSize, "queue-size", hook.DefaultQueueSize, "[env.QUEUE_SIZE] the number of webhooks that can be waiting to be processed before GitLab is asked to retry")
+	if queueSize, ok := os.LookupEnv("QUEUE_SIZE"); ok {
+		err := root.PersistentFlags().Lookup("queue-size").Value.Set(queueSize)
+		if err != nil {
+			log.Fatalf("failed to configure `queue-size`: %s", err)
+		}
+	}
+
+	root.PersistentFlags().IntVar(&hookCfg.Workers, "workers", hook.DefaultWorkers, "[env.WORKERS] the number of workers processing queued webhooks")
+	if workers, ok := os.LookupEnv("WORKERS"); ok {
+		err := root.PersistentFlags().Lookup("workers").Value.Set(workers)
+		if err != nil {
+			log.Fatalf("failed to configure `workers`: %s", err)
+		}
+	}
+
+	root.PersistentFlags().StringVar(&hookCfg.Spool.Dir, "spool-dir", "", "[env.SPOOL_DIR] the directory in which accepted webhooks are kept until they've been sent, disabled if empty")
+	if spoolDir, ok := os.LookupEnv("SPOOL_DIR"); ok {
+		err := root.PersistentFlags().Lookup("spool-dir").Value.Set(spoolDir)
+		if err != nil {
+			log.Fatalf("failed to configure `spool-dir`: %s", err)
+		}
+	}
+
+	root.PersistentFlags().Int64Var(&hookCfg.Spool.MaxBytes, "spool-max-bytes", spool.DefaultMaxBytes, "[env.SPOOL_MAX_BYTES] the maximum size of the spool, after which the oldest webhooks are dropped")
+	if spoolMaxBytes, ok := os.LookupEnv("SPOOL_MAX_BYTES"); ok {
+		err := root.PersistentFlags().Lookup("spool-max-bytes").Value.Set(spoolMaxBytes)
+		if err != nil {
+			log.Fatalf("failed to configure `spool-max-bytes`: %s", err)
+		}
+	}
+
+	root.PersistentFlags().DurationVar(&hookCfg.Spool.MaxAge, "spool-max-age", spool.DefaultMaxAge, "[env.SPOOL_MAX_AGE] how long unsent webhooks are kept in the spool")
+	if spoolMaxAge, ok := os.LookupEnv("SPOOL_MAX_AGE"); ok {
+		err := root.PersistentFlags().Lookup("spool-max-age").Value.Set(spoolMaxAge)
+		if err != nil {
+			log.Fatalf("failed to configure `spool-max-age`: %s", err)
+		}
+	}
+
+	root.PersistentFlags().DurationVar(&hookCfg.DedupTTL, "dedup-ttl", hook.DefaultDedupTTL, "[env.DEDUP_TTL] how long delivered webhooks are remembered to ignore GitLab's retries of them")
+	if dedupTTL, ok := os.LookupEnv("DEDUP_TTL"); ok {
+		err := root.PersistentFlags().Lookup("dedup-ttl").Value.Set(dedupTTL)
+		if err != nil {
+			log.Fatalf("failed to configure `dedup-ttl`: %s", err)
+		}
+	}
+
+	root.PersistentFlags().IntVar(&hookCfg.DedupSize, "dedup-size", hook.DefaultDedupSize, "[env.DEDUP_SIZE] the maximum number of delivered webhooks remembered to ignore GitLab's retries of them")
+	if dedupSize, ok := os.LookupEnv("DEDUP_SIZE"); ok {
+		err := root.PersistentFlags().Lookup("dedup-size").Value.Set(dedupSize)
+		if err != nil {
+			log.Fatalf("failed to configure `dedup-size`: %s", err)
+		}
+	}
+
+	root.PersistentFlags().IntVar(&hookCfg.MaxRetries, "max-retries", hook.DefaultMaxRetries, "[env.MAX_RETRIES] the number of times an event is resent after Honeycomb rate limits it or fails")
+	if maxRetries, ok := os.LookupEnv("MAX_RETRIES"); ok {
+		err := root.PersistentFlags().Lookup("max-retries").Value.Set(maxRetries)
+		if err != nil {
+			log.Fatalf("failed to configure `max-retries`: %s", err)
+		}
+	}
+
+	root.PersistentFlags().StringVar(&hookCfg.DeadLetterPath, "dead-letter-file", "", "[env.DEAD_LETTER_FILE] the JSON lines file that events which couldn't be sent are written to")
+	if deadLetterPath, ok := os.LookupEnv("DEAD_LETTER_FILE"); ok {
+		err := root.PersistentFlags().Lookup("dead-letter-file").Value.Set(deadLetterPath)
+		if err != nil {
+			log.Fatalf("failed to configure `dead-letter-file`: %s", err)
+		}
+	}
+
+	root.PersistentFlags().BoolVar(&hookCfg.ReplayDeadLetters, "replay-dead-letters", false, "[env.REPLAY_DEAD_LETTERS] resend the events in the dead-letter file on startup")
+	if replayDeadLetters, ok := os.LookupEnv("REPLAY_DEAD_LETTERS"); ok {
+		err := root.PersistentFlags().Lookup("replay-dead-letters").Value.Set(replayDeadLetters)
+		if err != nil {
+			log.Fatalf("failed to configure `replay-dead-letters`: %s", err)
+		}
+	}
+
+	root.PersistentFlags().StringVar(&hookCfg.RecordPath, "record-file", "", "[env.RECORD_FILE] the JSON lines file that every received webhook is recorded to, for replaying, disabled if empty")
+	if recordPath, ok := os.LookupEnv("RECORD_FILE"); ok {
+		err := root.PersistentFlags().Lookup("record-file").Value.Set(recordPath)
+		if err != nil {
+			log.Fatalf("failed to configure `record-file`: %s", err)
+		}
+	}
+
+	root.PersistentFlags().Int64Var(&hookCfg.RecordMaxBytes, "record-max-bytes", hook.DefaultRecordMaxBytes, "[env.RECORD_MAX_BYTES] the size the recording grows to before it's rotated")
+	if recordMaxBytes, ok := os.LookupEnv("RECORD_MAX_BYTES"); ok {
+		err := root.PersistentFlags().Lookup("record-max-bytes").Value.Set(recordMaxBytes)
+		if err != nil {
+			log.Fatalf("failed to configure `record-max-bytes`: %s", err)
+		}
+	}
+
+	root.PersistentFlags().IntVar(&hookCfg.RecordMaxFiles, "record-max-files", hook.DefaultRecordMaxFiles, "[env.RECORD_MAX_FILES] the number of rotated recordings kept")
+	if recordMaxFiles, ok := os.LookupEnv("RECORD_MAX_FILES"); ok {
+		err := root.PersistentFlags().Lookup("record-max-files").Value.Set(recordMaxFiles)
+		if err != nil {
+			log.Fatalf("failed to configure `record-max-files`: %s", err)
+		}
+	}
+
+	root.PersistentFlags().BoolVar(&hookCfg.DeployMarkers, "deploy-markers", false, "[env.DEPLOY_MARKERS] create Honeycomb markers for successful deployments")
+	if deployMarkers, ok := os.LookupEnv("DEPLOY_MARKERS"); ok {
+		err := root.PersistentFlags().Lookup("deploy-markers").Value.Set(deployMarkers)
+		if err != nil {
+			log.Fatalf("failed to configure `deploy-markers`: %s", err)
+		}
+	}
+
+	root.PersistentFlags().StringSliceVar(&hookCfg.MarkerEnvironments, "marker-environments", hook.DefaultMarkerEnvironments, "[env.MARKER_ENVIRONMENTS] the environment names or tiers that deploy markers are created for")
+	if markerEnvironments, ok := os.LookupEnv("MARKER_ENVIRONMENTS"); ok {
+		err := root.PersistentFlags().Lookup("marker-environments").Value.Set(markerEnvironments)
+		if err != nil {
+			log.Fatalf("failed to configure `marker-environments`: %s", err)
+		}
+	}
+
+	root.PersistentFlags().BoolVar(&hookCfg.JobsFromPipeline, "jobs-from-pipeline", false, "[env.JOBS_FROM_PIPELINE] send job spans from pipeline webhooks, for jobs without a job webhook")
+	if jobsFromPipeline, ok := os.LookupEnv("JOBS_FROM_PIPELINE"); ok {
+		err := root.PersistentFlags().Lookup("jobs-from-pipeline").Value.Set(jobsFromPipeline)
+		if err != nil {
+			log.Fatalf("failed to configure `jobs-from-pipeline`: %s", err)
+		}
+	}
+
+	root.PersistentFlags().StringVar(&hookCfg.Downstream, "downstream", hook.DefaultDownstream, "[env.DOWNSTREAM] how child and multi-project pipelines join the triggering pipeline: parent (same trace) or link (span link)")
+	if downstream, ok := os.LookupEnv("DOWNSTREAM"); ok {
+		err := root.PersistentFlags().Lookup("downstream").Value.Set(downstream)
+		if err != nil {
+			log.Fatalf("failed to configure `downstream`: %s", err)
+		}
+	}
+
+	root.PersistentFlags().StringVar(&hookCfg.RedactEmails, "redact-emails", hook.DefaultRedactEmails, "[env.REDACT_EMAILS] how email addresses are sent: keep, hash or drop")
+	if redactEmails, ok := os.LookupEnv("REDACT_EMAILS"); ok {
+		err := root.PersistentFlags().Lookup("redact-emails").Value.Set(redactEmails)
+		if err != nil {
+			log.Fatalf("failed to configure `redact-emails`: %s", err)
+		}
+	}
+
+	root.PersistentFlags().StringVar(&hookCfg.RedactNames, "redact-names", hook.DefaultRedactNames, "[env.REDACT_NAMES] how names and usernames are sent: keep, hash or drop")
+	if redactNames, ok := os.LookupEnv("REDACT_NAMES"); ok {
+		err := root.PersistentFlags().Lookup("redact-names").Value.Set(redactNames)
+		if err != nil {
+			log.Fatalf("failed to configure `redact-names`: %s", err)
+		}
 	}
 
-	log.SetOutput(os.Stdout)
+	root.PersistentFlags().StringVar(&hookCfg.RedactKey, "redact-key", "", "[env.REDACT_KEY] the secret key that names and email addresses are hashed with, random on every start if empty")
+	if redactKey, ok := os.LookupEnv("REDACT_KEY"); ok {
+		err := root.PersistentFlags().Lookup("redact-key").Value.Set(redactKey)
+		if err != nil {
+			log.Fatalf("failed to configure `redact-key`: %s", err)
+		}
+	}
 
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "8080"
+	root.PersistentFlags().StringSliceVar(&hookCfg.VariablesAllow, "variables-allow", nil, "[env.VARIABLES_ALLOW] glob patterns of the pipeline variables sent as var.<KEY> fields")
+	if variablesAllow, ok := os.LookupEnv("VARIABLES_ALLOW"); ok {
+		err := root.PersistentFlags().Lookup("variables-allow").Value.Set(variablesAllow)
+		if err != nil {
+			log.Fatalf("failed to configure `variables-allow`: %s", err)
+		}
+	}
+
+	root.PersistentFlags().StringSliceVar(&hookCfg.VariablesDeny, "variables-deny", hook.DefaultVariablesDeny, "[env.VARIABLES_DENY] glob patterns of the pipeline variables that are never sent")
+	if variablesDeny, ok := os.LookupEnv("VARIABLES_DENY"); ok {
+		err := root.PersistentFlags().Lookup("variables-deny").Value.Set(variablesDeny)
+		if err != nil {
+			log.Fatalf("failed to configure `variables-deny`: %s", err)
+		}
+	}
+
+	// Regular expressions can contain commas, so they're given one per flag,
+	// or one per line in the environment variable.
+	root.PersistentFlags().StringArrayVar(&hookCfg.SecretPatterns, "secret-pattern", nil, "[env.SECRET_PATTERNS] a regular expression matching variable values that are redacted, as well as the built-in ones")
+	if secretPatterns, ok := os.LookupEnv("SECRET_PATTERNS"); ok {
+		for _, pattern := range strings.Split(secretPatterns, "\n") {
+			if strings.TrimSpace(pattern) == "" {
+				continue
+			}
+			err := root.PersistentFlags().Lookup("secret-pattern").Value.Set(pattern)
+			if err != nil {
+				log.Fatalf("failed to configure `secret-pattern`: %s", err)
+			}
+		}
+	}
+
+	root.PersistentFlags().StringVar(&hookCfg.GitLab.URL, "gitlab-url", "", "[env.GITLAB_URL] the GitLab instance whose API is used to enrich spans, e.g. https://gitlab.com, disabled if empty")
+	if gitlabURL, ok := os.LookupEnv("GITLAB_URL"); ok {
+		err := root.PersistentFlags().Lookup("gitlab-url").Value.Set(gitlabURL)
+		if err != nil {
+			log.Fatalf("failed to configure `gitlab-url`: %s", err)
+		}
 	}
 
-	l, err := hook.New(hook.Config{
-		Version:         Version,
-		ListenAddr:      ":" + port,
-		HookSecret:      "",
-		Debug:           debug,
-		HoneycombConfig: &config,
-	})
+	root.PersistentFlags().StringVar(&hookCfg.GitLab.Token, "gitlab-token", "", "[env.GITLAB_TOKEN] a GitLab token with the read_api scope")
+	if gitlabToken, ok := os.LookupEnv("GITLAB_TOKEN"); ok {
+		err := root.PersistentFlags().Lookup("gitlab-token").Value.Set(gitlabToken)
+		if err != nil {
+			log.Fatalf("failed to configure `gitlab-token`: %s", err)
+		}
+	}
+
+	root.PersistentFlags().IntVar(&hookCfg.GitLab.CacheSize, "gitlab-cache-size", hook.DefaultGitLabCacheSize, "[env.GITLAB_CACHE_SIZE] the number of GitLab API responses that are cached")
+	if gitlabCacheSize, ok := os.LookupEnv("GITLAB_CACHE_SIZE"); ok {
+		err := root.PersistentFlags().Lookup("gitlab-cache-size").Value.Set(gitlabCacheSize)
+		if err != nil {
+			log.Fatalf("failed to configure `gitlab-cache-size`: %s", err)
+		}
+	}
+
+	root.PersistentFlags().DurationVar(&hookCfg.GitLab.CacheTTL, "gitlab-cache-ttl", hook.DefaultGitLabCacheTTL, "[env.GITLAB_CACHE_TTL] how long GitLab API responses are cached for")
+	if gitlabCacheTTL, ok := os.LookupEnv("GITLAB_CACHE_TTL"); ok {
+		err := root.PersistentFlags().Lookup("gitlab-cache-ttl").Value.Set(gitlabCacheTTL)
+		if err != nil {
+			log.Fatalf("failed to configure `gitlab-cache-ttl`: %s", err)
+		}
+	}
+
+	root.PersistentFlags().DurationVar(&hookCfg.GitLab.Timeout, "gitlab-timeout", hook.DefaultGitLabTimeout, "[env.GITLAB_TIMEOUT] how long a GitLab API request can take")
+	if gitlabTimeout, ok := os.LookupEnv("GITLAB_TIMEOUT"); ok {
+		err := root.PersistentFlags().Lookup("gitlab-timeout").Value.Set(gitlabTimeout)
+		if err != nil {
+			log.Fatalf("failed to configure `gitlab-timeout`: %s", err)
+		}
+	}
+
+	root.PersistentFlags().BoolVar(&hookCfg.JobSections, "job-sections", false, "[env.JOB_SECTIONS] fetch finished jobs' logs from the GitLab API and send their sections as child spans")
+	if jobSections, ok := os.LookupEnv("JOB_SECTIONS"); ok {
+		err := root.PersistentFlags().Lookup("job-sections").Value.Set(jobSections)
+		if err != nil {
+			log.Fatalf("failed to configure `job-sections`: %s", err)
+		}
+	}
+
+	root.PersistentFlags().BoolVar(&hookCfg.TestReports, "test-reports", false, "[env.TEST_REPORTS] fetch finished pipelines' test reports from the GitLab API and send their suites and tests as spans")
+	if testReports, ok := os.LookupEnv("TEST_REPORTS"); ok {
+		err := root.PersistentFlags().Lookup("test-reports").Value.Set(testReports)
+		if err != nil {
+			log.Fatalf("failed to configure `test-reports`: %s", err)
+		}
+	}
+
+	root.PersistentFlags().BoolVar(&hookCfg.Debug, "debug", false, "[env.DEBUG] set the debug logging to true")
+	if debug, ok := os.LookupEnv("DEBUG"); ok {
+		err := root.PersistentFlags().Lookup("debug").Value.Set(debug)
+		if err != nil {
+			log.Fatalf("failed to configure `debug`: %s", err)
+		}
+	}
+
+	return root
+}
+
+// newListener returns a listener for hookConfig that sends spans to the sink
+// selected by sinkCfg, and a function to release the sink after the listener
+// has shut down.
+func newListener(config *libhoney.Config, hookConfig hook.Config, sinkCfg sinkConfig) (*hook.Listener, func() error, error) {
+	hookConfig.Version = Version
+	hookConfig.HoneycombConfig = config
+
+	closeSink := func() error { return nil }
+	if hookConfig.Sink == nil {
+		sinkCfg.OTLP.MaxRetries = hookConfig.MaxRetries
+		sinkCfg.OTLP.DeadLetterPath = hookConfig.DeadLetterPath
+		sink, closer, err := newSink(sinkCfg)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to setup sink: %w", err)
+		}
+		hookConfig.Sink = sink
+		closeSink = closer
+	}
+
+	l, err := hook.New(hookConfig)
 	if err != nil {
-		log.Fatalf("failed to setup hook listener: %s", err)
+		return nil, nil, fmt.Errorf("failed to setup hook listener: %w", err)
 	}
+	return l, closeSink, nil
+}
+
+func main() {
+	var config libhoney.Config
+	var hookConfig hook.Config
+	var sinkCfg sinkConfig
 
-	log.Printf("Starting server on http://%s\n", l.HTTPServer.Addr)
-	log.Fatal(l.ListenAndServe())
+	root := commandRoot(&config, &hookConfig, &sinkCfg)
+	root.AddCommand(
+		commandServe(&config, &hookConfig, &sinkCfg),
+		commandReplay(&config, &hookConfig, &sinkCfg),
+	)
+
+	// Do the work
+	if err := root.Execute(); err != nil {
+		os.Exit(1)
+	}
 }
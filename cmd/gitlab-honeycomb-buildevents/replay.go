@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/honeycombio/libhoney-go"
+	"github.com/spf13/cobra"
+	"github.com/zoidyzoidzoid/gitlab-honeycomb-buildevents-webhooks-sink/internal/hook"
+	"github.com/zoidyzoidzoid/gitlab-honeycomb-buildevents-webhooks-sink/internal/spool"
+)
+
+// replayConfig configures the replay subcommand.
+type replayConfig struct {
+	Rate       float64
+	ShiftToNow bool
+	DryRun     bool
+}
+
+func commandReplay(cfg *libhoney.Config, hookCfg *hook.Config, sinkCfg *sinkConfig) *cobra.Command {
+	var replayCfg replayConfig
+
+	cmd := &cobra.Command{
+		Use:   "replay FILE...",
+		Short: "replay recorded webhooks",
+		Long: `
+Replay sends recorded webhooks through the same parsing and handling as
+webhooks that are received, without running the server. Files can hold
+recordings as JSON lines, or webhook payloads such as pipeline.json.`,
+		Args: cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cmd.SilenceUsage = true
+			return replay(cmd.Context(), args, replayCfg, cfg, *hookCfg, *sinkCfg)
+		},
+	}
+
+	cmd.Flags().Float64Var(&replayCfg.Rate, "rate", 0, "the number of webhooks replayed per second, or 0 for as fast as possible")
+	cmd.Flags().BoolVar(&replayCfg.ShiftToNow, "shift-to-now", false, "move every timestamp so that the last webhook happened now")
+	cmd.Flags().BoolVar(&replayCfg.DryRun, "dry-run", false, "print the spans to stdout as JSON lines instead of sending them")
+
+	return cmd
+}
+
+// replay replays the webhooks in files, in order.
+func replay(ctx context.Context, files []string, replayCfg replayConfig, cfg *libhoney.Config, hookConfig hook.Config, sinkCfg sinkConfig) error {
+	var recordings []hook.Recording
+	for _, path := range files {
+		recs, err := hook.ReadRecordings(path)
+		if err != nil {
+			return err
+		}
+		recordings = append(recordings, recs...)
+	}
+
+	// Replays skip the queue, and aren't received, so they don't use the
+	// spool or the recording, which a running server may be using.
+	hookConfig.Spool = spool.Config{}
+	hookConfig.RecordPath = ""
+
+	if replayCfg.DryRun {
+		hookConfig.Sink = hook.NewJSONLinesSink(os.Stdout)
+		hookConfig.DeployMarkers = false
+	}
+
+	l, closeSink, err := newListener(cfg, hookConfig, sinkCfg)
+	if err != nil {
+		return err
+	}
+
+	var offset time.Duration
+	if replayCfg.ShiftToNow {
+		offset = time.Since(latestRecording(recordings))
+	}
+
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	var interval time.Duration
+	if replayCfg.Rate > 0 {
+		interval = time.Duration(float64(time.Second) / replayCfg.Rate)
+	}
+
+	failed := 0
+	for i, rec := range recordings {
+		if i > 0 && interval > 0 {
+			select {
+			case <-time.After(interval):
+			case <-ctx.Done():
+			}
+		}
+		if ctx.Err() != nil {
+			log.Printf("interrupted after replaying %d of %d webhooks", i, len(recordings))
+			break
+		}
+
+		if offset != 0 {
+			rec.Body, err = hook.ShiftTimestamps(rec.Body, offset)
+			if err != nil {
+				log.Printf("failed to shift webhook %d: %s", i+1, err)
+				failed++
+				continue
+			}
+		}
+
+		err := l.Replay(rec)
+		if err != nil {
+			log.Printf("failed to replay webhook %d: %s", i+1, err)
+			failed++
+		}
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := l.Shutdown(shutdownCtx); err != nil {
+		log.Printf("failed to shut down cleanly: %s", err)
+	}
+	if err := closeSink(); err != nil {
+		log.Printf("failed to close sink: %s", err)
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("failed to replay %d of %d webhooks", failed, len(recordings))
+	}
+	return nil
+}
+
+// latestRecording returns when the last of the recordings was received, or
+// the latest timestamp in their payloads when that wasn't recorded.
+func latestRecording(recordings []hook.Recording) time.Time {
+	var latest time.Time
+	for _, rec := range recordings {
+		t := rec.ReceivedAt
+		if t.IsZero() {
+			t = hook.LatestTimestamp(rec.Body)
+		}
+		if t.After(latest) {
+			latest = t
+		}
+	}
+	return latest
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/honeycombio/libhoney-go"
+	"github.com/spf13/cobra"
+	"github.com/zoidyzoidzoid/gitlab-honeycomb-buildevents-webhooks-sink/internal/hook"
+)
+
+// defaultShutdownTimeout is how long the server waits for queued webhooks to
+// be sent when it's stopped.
+const defaultShutdownTimeout = 30 * time.Second
+
+func commandServe(cfg *libhoney.Config, hookCfg *hook.Config, sinkCfg *sinkConfig) *cobra.Command {
+	var shutdownTimeout time.Duration
+
+	cmd := &cobra.Command{
+		Use:   "serve",
+		Short: "receive GitLab webhooks and send them as traces",
+		Long: `
+Serve runs an HTTP server that receives GitLab webhooks on /api/message and
+sends traces of the pipelines and jobs they describe.`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cmd.SilenceUsage = true
+
+			// PORT is what platforms like Heroku set, so it's used when the
+			// listen address isn't set by a flag or LISTEN_ADDR.
+			if port, ok := os.LookupEnv("PORT"); ok && !cmd.Flags().Changed("listen-addr") {
+				if _, ok := os.LookupEnv("LISTEN_ADDR"); !ok {
+					hookCfg.ListenAddr = ":" + port
+				}
+			}
+
+			return serve(cfg, *hookCfg, *sinkCfg, shutdownTimeout)
+		},
+	}
+
+	cmd.Flags().StringVar(&hookCfg.ListenAddr, "listen-addr", hook.DefaultListenAddr, "[env.LISTEN_ADDR] the address the server listens on, or :$PORT when PORT is set")
+	if listenAddr, ok := os.LookupEnv("LISTEN_ADDR"); ok {
+		err := cmd.Flags().Lookup("listen-addr").Value.Set(listenAddr)
+		if err != nil {
+			log.Fatalf("failed to configure `listen-addr`: %s", err)
+		}
+	}
+
+	cmd.Flags().StringVar(&hookCfg.HookSecret, "hook-secret", "", "[env.HOOK_SECRET] the secret token of the GitLab webhooks, which isn't checked if empty")
+	if hookSecret, ok := os.LookupEnv("HOOK_SECRET"); ok {
+		err := cmd.Flags().Lookup("hook-secret").Value.Set(hookSecret)
+		if err != nil {
+			log.Fatalf("failed to configure `hook-secret`: %s", err)
+		}
+	}
+
+	cmd.Flags().DurationVar(&hookCfg.ReadTimeout, "read-timeout", hook.DefaultReadTimeout, "[env.READ_TIMEOUT] how long reading a request can take")
+	if readTimeout, ok := os.LookupEnv("READ_TIMEOUT"); ok {
+		err := cmd.Flags().Lookup("read-timeout").Value.Set(readTimeout)
+		if err != nil {
+			log.Fatalf("failed to configure `read-timeout`: %s", err)
+		}
+	}
+
+	cmd.Flags().DurationVar(&hookCfg.WriteTimeout, "write-timeout", hook.DefaultWriteTimeout, "[env.WRITE_TIMEOUT] how long handling a request and writing its response can take")
+	if writeTimeout, ok := os.LookupEnv("WRITE_TIMEOUT"); ok {
+		err := cmd.Flags().Lookup("write-timeout").Value.Set(writeTimeout)
+		if err != nil {
+			log.Fatalf("failed to configure `write-timeout`: %s", err)
+		}
+	}
+
+	cmd.Flags().DurationVar(&hookCfg.IdleTimeout, "idle-timeout", hook.DefaultIdleTimeout, "[env.IDLE_TIMEOUT] how long an idle keep-alive connection is kept open for")
+	if idleTimeout, ok := os.LookupEnv("IDLE_TIMEOUT"); ok {
+		err := cmd.Flags().Lookup("idle-timeout").Value.Set(idleTimeout)
+		if err != nil {
+			log.Fatalf("failed to configure `idle-timeout`: %s", err)
+		}
+	}
+
+	cmd.Flags().DurationVar(&shutdownTimeout, "shutdown-timeout", defaultShutdownTimeout, "[env.SHUTDOWN_TIMEOUT] how long queued webhooks are given to be sent when the server is stopped")
+	if timeout, ok := os.LookupEnv("SHUTDOWN_TIMEOUT"); ok {
+		err := cmd.Flags().Lookup("shutdown-timeout").Value.Set(timeout)
+		if err != nil {
+			log.Fatalf("failed to configure `shutdown-timeout`: %s", err)
+		}
+	}
+
+	cmd.Flags().Int64Var(&hookCfg.MaxBodyBytes, "max-body-bytes", hook.DefaultMaxBodyBytes, "[env.MAX_BODY_BYTES] the largest webhook body that's accepted")
+	if maxBodyBytes, ok := os.LookupEnv("MAX_BODY_BYTES"); ok {
+		err := cmd.Flags().Lookup("max-body-bytes").Value.Set(maxBodyBytes)
+		if err != nil {
+			log.Fatalf("failed to configure `max-body-bytes`: %s", err)
+		}
+	}
+
+	return cmd
+}
+
+// serve runs the server until it's interrupted or terminated, and then waits
+// for queued webhooks to be sent.
+func serve(cfg *libhoney.Config, hookConfig hook.Config, sinkCfg sinkConfig, shutdownTimeout time.Duration) error {
+	log.SetOutput(os.Stdout)
+
+	l, closeSink, err := newListener(cfg, hookConfig, sinkCfg)
+	if err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	go func() {
+		log.Printf("Starting server on http://%s\n", l.HTTPServer.Addr)
+		err := l.ListenAndServe()
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatal(err)
+		}
+	}()
+
+	<-ctx.Done()
+	log.Println("Shutting down, draining queued webhooks")
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := l.Shutdown(shutdownCtx); err != nil {
+		log.Printf("failed to shut down cleanly: %s", err)
+	}
+	if err := closeSink(); err != nil {
+		log.Printf("failed to close sink: %s", err)
+	}
+	return nil
+}
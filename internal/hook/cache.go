@@ -0,0 +1,113 @@
+package hook
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// ttlCache is a size-bounded, least-recently-used cache whose entries expire
+// after a fixed TTL. It's safe for concurrent use.
+type ttlCache[V any] struct {
+	mu      sync.Mutex
+	size    int
+	ttl     time.Duration
+	entries map[string]*list.Element
+	order   *list.List
+	now     func() time.Time
+}
+
+type ttlEntry[V any] struct {
+	key     string
+	value   V
+	expires time.Time
+}
+
+func newTTLCache[V any](size int, ttl time.Duration) *ttlCache[V] {
+	return &ttlCache[V]{
+		size:    size,
+		ttl:     ttl,
+		entries: make(map[string]*list.Element),
+		order:   list.New(),
+		now:     time.Now,
+	}
+}
+
+// Get returns the value for key, if it's present and hasn't expired.
+func (c *ttlCache[V]) Get(key string) (V, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.getLocked(key)
+}
+
+func (c *ttlCache[V]) getLocked(key string) (V, bool) {
+	var zero V
+	el, ok := c.entries[key]
+	if !ok {
+		return zero, false
+	}
+
+	entry := el.Value.(*ttlEntry[V])
+	if c.now().After(entry.expires) {
+		c.removeElement(el)
+		return zero, false
+	}
+
+	c.order.MoveToFront(el)
+	return entry.value, true
+}
+
+// Set adds or replaces the value for key, evicting the least recently used
+// entry if the cache is full.
+func (c *ttlCache[V]) Set(key string, value V) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.setLocked(key, value)
+}
+
+func (c *ttlCache[V]) setLocked(key string, value V) {
+	expires := c.now().Add(c.ttl)
+	if el, ok := c.entries[key]; ok {
+		entry := el.Value.(*ttlEntry[V])
+		entry.value = value
+		entry.expires = expires
+		c.order.MoveToFront(el)
+		return
+	}
+
+	c.entries[key] = c.order.PushFront(&ttlEntry[V]{key: key, value: value, expires: expires})
+	for c.order.Len() > c.size {
+		c.removeElement(c.order.Back())
+	}
+}
+
+// Add sets the value for key only if it isn't already present, and reports
+// whether it was added.
+func (c *ttlCache[V]) Add(key string, value V) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.getLocked(key); ok {
+		return false
+	}
+
+	c.setLocked(key, value)
+	return true
+}
+
+// Delete removes key from the cache.
+func (c *ttlCache[V]) Delete(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.entries[key]; ok {
+		c.removeElement(el)
+	}
+}
+
+func (c *ttlCache[V]) removeElement(el *list.Element) {
+	c.order.Remove(el)
+	delete(c.entries, el.Value.(*ttlEntry[V]).key)
+}
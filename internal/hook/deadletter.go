@@ -0,0 +1,133 @@
+package hook
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// deadLetter is a line of the dead-letter file: an event that couldn't be
+// sent, with everything needed to resend it.
+type deadLetter struct {
+	FailedAt   time.Time              `json:"failed_at"`
+	Attempts   int                    `json:"attempts"`
+	StatusCode int                    `json:"status_code,omitempty"`
+	Error      string                 `json:"error"`
+	Timestamp  time.Time              `json:"timestamp"`
+	Fields     map[string]interface{} `json:"fields"`
+}
+
+// deadLetterFile appends dead letters to a JSON lines file.
+type deadLetterFile struct {
+	mu   sync.Mutex
+	path string
+}
+
+func (f *deadLetterFile) write(dl deadLetter) error {
+	line, err := json.Marshal(dl)
+	if err != nil {
+		return fmt.Errorf("failed to encode dead letter: %w", err)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o640)
+	if err != nil {
+		return fmt.Errorf("failed to open dead-letter file: %w", err)
+	}
+
+	_, err = file.Write(append(line, '\n'))
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("failed to write dead letter: %w", err)
+	}
+
+	return file.Close()
+}
+
+// deadLetter records an event that couldn't be sent, and marks it as done.
+func (s *HoneycombSink) deadLetter(meta *eventMetadata, statusCode int, reason string) {
+	if meta.done != nil {
+		defer meta.done()
+	}
+
+	dl := deadLetter{
+		FailedAt:   time.Now(),
+		Attempts:   meta.Attempt,
+		StatusCode: statusCode,
+		Error:      reason,
+		Timestamp:  meta.Timestamp,
+		Fields:     meta.Fields,
+	}
+
+	s.deadLetters.record(dl)
+}
+
+// record writes a dead letter, or logs it when there's no dead-letter file.
+func (f *deadLetterFile) record(dl deadLetter) {
+	if f == nil {
+		log.Printf("dropping event that couldn't be sent: %+v", dl)
+		return
+	}
+
+	err := f.write(dl)
+	if err != nil {
+		log.Printf("failed to dead-letter event %+v: %s", dl, err)
+	}
+}
+
+// ReplayDeadLetters resends every event in the dead-letter file. Events that
+// fail again are written to a new dead-letter file.
+func (s *HoneycombSink) ReplayDeadLetters() error {
+	if s.deadLetters == nil {
+		return errors.New("no dead-letter file is configured")
+	}
+
+	s.deadLetters.mu.Lock()
+	replaying := fmt.Sprintf("%s.replay-%d", s.deadLetters.path, time.Now().Unix())
+	err := os.Rename(s.deadLetters.path, replaying)
+	s.deadLetters.mu.Unlock()
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to move dead-letter file aside: %w", err)
+	}
+
+	f, err := os.Open(replaying)
+	if err != nil {
+		return fmt.Errorf("failed to open dead letters: %w", err)
+	}
+	defer f.Close()
+
+	var replayed int
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var dl deadLetter
+		err := json.Unmarshal(scanner.Bytes(), &dl)
+		if err != nil {
+			log.Printf("skipping unreadable dead letter: %s", err)
+			continue
+		}
+
+		// Replayed events get a fresh set of retries.
+		s.retry(&eventMetadata{
+			Fields:    dl.Fields,
+			Timestamp: dl.Timestamp,
+		})
+		replayed++
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read dead letters: %w", err)
+	}
+
+	log.Printf("replayed %d dead letters", replayed)
+	return os.Remove(replaying)
+}
@@ -0,0 +1,64 @@
+package hook
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/zoidyzoidzoid/gitlab-honeycomb-buildevents-webhooks-sink/internal/hook/types"
+)
+
+const (
+	// DefaultDedupTTL is how long a delivered webhook is remembered for.
+	DefaultDedupTTL = 24 * time.Hour
+	// DefaultDedupSize is the maximum number of delivered webhooks that are
+	// remembered.
+	DefaultDedupSize = 100000
+)
+
+// dedupKeys returns the keys identifying a webhook delivery: GitLab's event
+// UUID, which is kept across retries, and a key derived from the payload for
+// redeliveries that don't have the same UUID.
+func dedupKeys(r *http.Request, event interface{}) []string {
+	var keys []string
+
+	if uuid := r.Header.Get("X-Gitlab-Event-UUID"); uuid != "" {
+		keys = append(keys, "uuid:"+uuid)
+	} else if uuid := r.Header.Get("X-Gitlab-Webhook-UUID"); uuid != "" {
+		keys = append(keys, "uuid:"+uuid)
+	}
+
+	switch e := event.(type) {
+	case types.PipelineEventPayload:
+		keys = append(keys, fmt.Sprintf("%s:%d:%s:%d", e.ObjectKind, e.ObjectAttributes.ID, e.ObjectAttributes.Status, time.Time(e.ObjectAttributes.FinishedAt).Unix()))
+	case types.JobEventPayload:
+		keys = append(keys, fmt.Sprintf("%s:%d:%s:%d", e.ObjectKind, e.BuildID, e.BuildStatus, time.Time(e.BuildFinishedAt).Unix()))
+	case types.MergeRequestEventPayload:
+		keys = append(keys, fmt.Sprintf("%s:%d:%s:%d", e.ObjectKind, e.ObjectAttributes.ID, e.ObjectAttributes.Action, time.Time(e.ObjectAttributes.UpdatedAt).Unix()))
+	case types.DeploymentEventPayload:
+		keys = append(keys, fmt.Sprintf("%s:%d:%s:%d", e.ObjectKind, e.DeploymentID, e.Status, time.Time(e.StatusChangedAt).Unix()))
+	}
+
+	return keys
+}
+
+// markDelivered records the keys of a webhook delivery, and reports whether
+// any of them had already been seen.
+func (l *Listener) markDelivered(keys []string) bool {
+	duplicate := false
+	for _, key := range keys {
+		if !l.delivered.Add(key, struct{}{}) {
+			duplicate = true
+		}
+	}
+
+	return duplicate
+}
+
+// forgetDelivered removes the keys of a webhook delivery, so that GitLab's
+// retry of it is processed.
+func (l *Listener) forgetDelivered(keys []string) {
+	for _, key := range keys {
+		l.delivered.Delete(key)
+	}
+}
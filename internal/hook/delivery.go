@@ -0,0 +1,39 @@
+package hook
+
+import (
+	"sync/atomic"
+)
+
+// delivery tracks the events built for a webhook, and calls done once all of
+// them have either been sent or dead-lettered.
+type delivery struct {
+	// pending starts at one, which is released by the worker once the
+	// handler has returned, so that done isn't called before every event
+	// has been added.
+	pending atomic.Int64
+	done    func()
+}
+
+func newDelivery(done func()) *delivery {
+	d := &delivery{done: done}
+	d.pending.Store(1)
+	return d
+}
+
+// add records an event that is being sent.
+func (d *delivery) add() {
+	if d == nil {
+		return
+	}
+	d.pending.Add(1)
+}
+
+// finish records that an event has been sent or dead-lettered.
+func (d *delivery) finish() {
+	if d == nil {
+		return
+	}
+	if d.pending.Add(-1) == 0 {
+		d.done()
+	}
+}
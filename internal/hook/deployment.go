@@ -0,0 +1,112 @@
+package hook
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/zoidyzoidzoid/gitlab-honeycomb-buildevents-webhooks-sink/internal/hook/types"
+)
+
+const (
+	// deploymentsTracked is the maximum number of running deployments whose
+	// start time is remembered.
+	deploymentsTracked = 10000
+	// deploymentTTL is how long a running deployment is remembered for.
+	deploymentTTL = 24 * time.Hour
+)
+
+// DefaultMarkerEnvironments are the environment names or tiers whose
+// successful deployments create Honeycomb markers.
+var DefaultMarkerEnvironments = []string{"production"}
+
+func (l *Listener) handleDeployment(dep types.DeploymentEventPayload, d *delivery) error {
+	changedAt := time.Time(dep.StatusChangedAt)
+	if changedAt.IsZero() {
+		return errors.New("Deployment.StatusChangedAt is zero")
+	}
+
+	key := fmt.Sprint(dep.DeploymentID)
+	switch dep.Status {
+	case "created":
+		return nil
+	case "running":
+		l.deployments.Set(key, changedAt)
+		return nil
+	}
+
+	startedAt, ok := l.deployments.Get(key)
+	if !ok {
+		startedAt = changedAt
+	}
+	l.deployments.Delete(key)
+
+	fields := map[string]interface{}{
+		"ci_provider":              "GitLab-CI",
+		"repo":                     dep.Project.WebURL,
+		"branch":                   dep.Ref,
+		"status":                   dep.Status,
+		"deployment_id":            dep.DeploymentID,
+		"deployable_id":            dep.DeployableID,
+		"deployable_url":           dep.DeployableURL,
+		"environment":              dep.Environment,
+		"environment_tier":         dep.EnvironmentTier,
+		"environment_external_url": dep.EnvironmentExternalURL,
+		"short_sha":                dep.ShortSHA,
+		"commit_title":             dep.CommitTitle,
+		"commit_url":               dep.CommitURL,
+	}
+	l.addName(fields, "user.username", dep.User.UserName)
+
+	// Deployments are children of the job that ran them, when we've seen it,
+	// so they show up in the pipeline's trace.
+	traceID := fmt.Sprintf("deployment-%d", dep.DeploymentID)
+	parentID := ""
+	if job, ok := l.jobs.Get(fmt.Sprint(dep.DeployableID)); ok {
+		traceID = l.pipelineTraceID(job.PipelineID)
+		parentID = job.SpanID
+		fields["build_num"] = job.PipelineID
+	}
+
+	l.emit(Span{
+		ServiceName: "deployment",
+		TraceID:     traceID,
+		SpanID:      fmt.Sprintf("deployment-%d", dep.DeploymentID),
+		ParentID:    parentID,
+		Name:        "deploy " + dep.Environment,
+		Timestamp:   startedAt,
+		Duration:    changedAt.Sub(startedAt),
+		Fields:      fields,
+	}, d)
+
+	if dep.Status == "success" && l.markers != nil && l.wantsMarker(dep) {
+		// The deployment ID is in the message, so each deployment only gets
+		// one marker.
+		err := l.markers.createOnce(context.Background(), marker{
+			Message:   fmt.Sprintf("deploy %s to %s: %s (deployment %d)", dep.ShortSHA, dep.Environment, dep.CommitTitle, dep.DeploymentID),
+			Type:      "deploy",
+			URL:       dep.DeployableURL,
+			StartTime: startedAt.Unix(),
+		})
+		if err != nil {
+			log.Printf("failed to create marker for deployment %d: %s", dep.DeploymentID, err)
+		}
+	}
+
+	return nil
+}
+
+// wantsMarker reports whether a deployment's environment is one that
+// markers are created for.
+func (l *Listener) wantsMarker(dep types.DeploymentEventPayload) bool {
+	for _, env := range l.Config.MarkerEnvironments {
+		if strings.EqualFold(env, dep.Environment) || strings.EqualFold(env, dep.EnvironmentTier) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,130 @@
+package hook
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/honeycombio/libhoney-go"
+	"github.com/zoidyzoidzoid/gitlab-honeycomb-buildevents-webhooks-sink/internal/hook/types"
+)
+
+func Test_handleDeployment(t *testing.T) {
+	markers := make(chan marker, 2)
+	var mu sync.Mutex
+	var created []marker
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/1/markers/builds" || r.Header.Get("X-Honeycomb-Team") != "key" {
+			t.Errorf("marker request = %s %s, want /1/markers/builds with the API key", r.Method, r.URL)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if r.Method == http.MethodGet {
+			json.NewEncoder(w).Encode(created)
+			return
+		}
+
+		var m marker
+		if err := json.NewDecoder(r.Body).Decode(&m); err != nil {
+			t.Errorf("failed to decode marker: %s", err)
+		}
+		created = append(created, m)
+		markers <- m
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer api.Close()
+
+	sink := &MemorySink{}
+	l, err := New(Config{
+		Version:         "dev",
+		Sink:            sink,
+		DeployMarkers:   true,
+		HoneycombConfig: &libhoney.Config{APIHost: api.URL, APIKey: "key", Dataset: "builds"},
+	})
+	if err != nil {
+		t.Fatalf("failed to create listener: %s", err)
+	}
+
+	started := time.Date(2022, 10, 17, 14, 0, 0, 0, time.UTC)
+	err = l.handleJob(types.JobEventPayload{
+		BuildID:     42,
+		BuildName:   "deploy",
+		PipelineID:  7,
+		BuildStatus: "running",
+	}, nil)
+	if err != nil {
+		t.Fatalf("failed to handle job: %s", err)
+	}
+
+	dep := types.DeploymentEventPayload{
+		Status:          "running",
+		StatusChangedAt: types.GitLabTimestamp(started),
+		DeploymentID:    5,
+		DeployableID:    42,
+		Environment:     "production",
+		ShortSHA:        "abc123",
+	}
+	if err := l.handleDeployment(dep, nil); err != nil {
+		t.Fatalf("failed to handle running deployment: %s", err)
+	}
+	dep.Status = "success"
+	dep.StatusChangedAt = types.GitLabTimestamp(started.Add(90 * time.Second))
+	if err := l.handleDeployment(dep, nil); err != nil {
+		t.Fatalf("failed to handle successful deployment: %s", err)
+	}
+
+	spans := sink.Spans()
+	if len(spans) != 1 {
+		t.Fatalf("sent %d spans, want 1", len(spans))
+	}
+	span := spans[0]
+	if span.TraceID != "7" || span.ParentID != jobSpanID("deploy", 42) {
+		t.Errorf("deployment span trace/parent = %s/%s, want 7/%s", span.TraceID, span.ParentID, jobSpanID("deploy", 42))
+	}
+	if !span.Timestamp.Equal(started) || span.Duration != 90*time.Second {
+		t.Errorf("deployment span = %s for %s, want %s for 1m30s", span.Timestamp, span.Duration, started)
+	}
+
+	select {
+	case m := <-markers:
+		if m.Type != "deploy" || m.StartTime != started.Unix() {
+			t.Errorf("marker = %+v, want a deploy marker at %d", m, started.Unix())
+		}
+	default:
+		t.Errorf("no marker was created")
+	}
+
+	// Replaying the webhook after a restart doesn't create another marker.
+	l, err = New(Config{
+		Version:         "dev",
+		Sink:            sink,
+		DeployMarkers:   true,
+		HoneycombConfig: &libhoney.Config{APIHost: api.URL, APIKey: "key", Dataset: "builds"},
+	})
+	if err != nil {
+		t.Fatalf("failed to create listener: %s", err)
+	}
+	if err := l.handleDeployment(dep, nil); err != nil {
+		t.Fatalf("failed to handle replayed deployment: %s", err)
+	}
+	select {
+	case m := <-markers:
+		t.Errorf("marker = %+v, want none for a replayed deployment", m)
+	default:
+	}
+
+	// Deployments to other environments don't get markers.
+	dep.DeploymentID = 6
+	dep.Environment = "staging"
+	if err := l.handleDeployment(dep, nil); err != nil {
+		t.Fatalf("failed to handle staging deployment: %s", err)
+	}
+	select {
+	case m := <-markers:
+		t.Errorf("marker = %+v, want none for staging", m)
+	default:
+	}
+}
@@ -0,0 +1,83 @@
+package hook
+
+import (
+	"fmt"
+
+	"github.com/zoidyzoidzoid/gitlab-honeycomb-buildevents-webhooks-sink/internal/hook/types"
+)
+
+const (
+	// DownstreamParent puts child and multi-project pipelines in the trace
+	// of the pipeline that triggered them, under the triggering job.
+	DownstreamParent = "parent"
+	// DownstreamLink keeps child and multi-project pipelines in their own
+	// trace, with a span link to the triggering job.
+	DownstreamLink = "link"
+
+	// DefaultDownstream is how downstream pipelines are linked by default.
+	DefaultDownstream = DownstreamParent
+)
+
+// pipelineTraceID returns the trace ID of a pipeline, which is its own ID
+// unless it's been put in the trace of its upstream pipeline.
+func (l *Listener) pipelineTraceID(pipelineID int64) string {
+	if traceID, ok := l.pipelineTraces.Get(fmt.Sprint(pipelineID)); ok {
+		return traceID
+	}
+	return fmt.Sprint(pipelineID)
+}
+
+// upstreamSpan returns the trace and span that a downstream pipeline hangs
+// off: the triggering job when its span is known, otherwise the upstream
+// pipeline's root span. Bridge jobs don't send Job Hooks, so the job is only
+// known when it's a regular job that triggered the pipeline through the API.
+func (l *Listener) upstreamSpan(src *types.SourcePipeline) (string, string) {
+	traceID := l.pipelineTraceID(src.PipelineID)
+	if job, ok := l.jobs.Get(fmt.Sprint(src.JobID)); ok {
+		return traceID, job.SpanID
+	}
+	return traceID, fmt.Sprint(src.PipelineID)
+}
+
+// trackDownstreamPipeline records which trace a downstream pipeline belongs
+// to, so that its stages and jobs end up in the same trace. It's called for
+// every status of the pipeline, as its jobs can finish before it does.
+//
+// Job Hooks don't say which pipeline triggered theirs, so a downstream
+// pipeline's jobs are only put in the upstream trace once one of its own
+// Pipeline Hooks has been handled. GitLab sends one when the pipeline is
+// created, before any of its jobs run, but the queue's workers handle
+// webhooks concurrently, and the traces are only kept in memory. A job that
+// finishes right after its pipeline is created, or before the pipeline's
+// next webhook after a restart, is sent in the downstream pipeline's own
+// trace.
+func (l *Listener) trackDownstreamPipeline(p types.PipelineEventPayload) {
+	if p.SourcePipeline == nil || p.SourcePipeline.PipelineID == 0 || l.Config.Downstream != DownstreamParent {
+		return
+	}
+
+	traceID, _ := l.upstreamSpan(p.SourcePipeline)
+	l.pipelineTraces.Set(fmt.Sprint(p.ObjectAttributes.ID), traceID)
+}
+
+// linkUpstream parents or links a downstream pipeline's root span to the job
+// that triggered it.
+func (l *Listener) linkUpstream(p types.PipelineEventPayload, span *Span) {
+	src := p.SourcePipeline
+	if src == nil || src.PipelineID == 0 {
+		return
+	}
+
+	span.Fields["upstream.pipeline_id"] = src.PipelineID
+	span.Fields["upstream.job_id"] = src.JobID
+	span.Fields["upstream.project"] = src.Project.PathWithNamespace
+
+	traceID, spanID := l.upstreamSpan(src)
+	switch l.Config.Downstream {
+	case DownstreamParent:
+		span.TraceID = traceID
+		span.ParentID = spanID
+	case DownstreamLink:
+		span.Links = append(span.Links, SpanLink{TraceID: traceID, SpanID: spanID})
+	}
+}
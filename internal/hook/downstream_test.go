@@ -0,0 +1,144 @@
+package hook
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/zoidyzoidzoid/gitlab-honeycomb-buildevents-webhooks-sink/internal/hook/types"
+)
+
+func Test_downstreamPipelines(t *testing.T) {
+	start := time.Date(2022, 10, 17, 14, 0, 0, 0, time.UTC)
+	child := types.PipelineEventPayload{
+		ObjectAttributes: types.PipelineObjectAttributes{
+			ID:        200,
+			Status:    "running",
+			CreatedAt: types.GitLabTimestamp(start),
+		},
+		SourcePipeline: &types.SourcePipeline{
+			Project:    types.SourcePipelineProject{ID: 1, PathWithNamespace: "group/monorepo"},
+			PipelineID: 100,
+			JobID:      99,
+		},
+	}
+	childJob := types.JobEventPayload{
+		BuildID:         201,
+		BuildName:       "test",
+		BuildStage:      "test",
+		BuildStatus:     "success",
+		BuildStartedAt:  types.GitLabTimestamp(start),
+		BuildFinishedAt: types.GitLabTimestamp(start.Add(time.Minute)),
+		BuildDuration:   60,
+		PipelineID:      200,
+	}
+
+	t.Run("parent", func(t *testing.T) {
+		sink := &MemorySink{}
+		l, err := New(Config{Version: "dev", Sink: sink, Downstream: DownstreamParent})
+		if err != nil {
+			t.Fatalf("failed to create listener: %s", err)
+		}
+
+		// The upstream pipeline triggered the child from one of its jobs.
+		err = l.handleJob(types.JobEventPayload{BuildID: 99, BuildName: "trigger", BuildStatus: "running", PipelineID: 100}, nil)
+		if err != nil {
+			t.Fatalf("failed to handle trigger job: %s", err)
+		}
+
+		running := child
+		err = l.handlePipeline(running, nil)
+		if err != nil {
+			t.Fatalf("failed to handle running pipeline: %s", err)
+		}
+		err = l.handleJob(childJob, nil)
+		if err != nil {
+			t.Fatalf("failed to handle child job: %s", err)
+		}
+		finished := child
+		finished.ObjectAttributes.Status = "success"
+		finished.ObjectAttributes.Duration = 60
+		err = l.handlePipeline(finished, nil)
+		if err != nil {
+			t.Fatalf("failed to handle finished pipeline: %s", err)
+		}
+
+		for _, span := range sink.Spans() {
+			if span.TraceID != "100" {
+				t.Errorf("%s span %q is in trace %q, want the upstream trace 100", span.ServiceName, span.Name, span.TraceID)
+			}
+			if span.ServiceName == "pipeline" {
+				if span.ParentID != jobSpanID("trigger", 99) {
+					t.Errorf("child pipeline parent = %q, want the trigger job", span.ParentID)
+				}
+				if span.Fields["upstream.pipeline_id"] != int64(100) {
+					t.Errorf("upstream.pipeline_id = %v, want 100", span.Fields["upstream.pipeline_id"])
+				}
+			}
+		}
+	})
+
+	t.Run("job before its pipeline", func(t *testing.T) {
+		sink := &MemorySink{}
+		l, err := New(Config{Version: "dev", Sink: sink, Downstream: DownstreamParent})
+		if err != nil {
+			t.Fatalf("failed to create listener: %s", err)
+		}
+
+		// Job Hooks don't say which pipeline triggered theirs, so a job
+		// handled before any of its pipeline's webhooks is in the child's
+		// own trace.
+		early := childJob
+		err = l.handleJob(early, nil)
+		if err != nil {
+			t.Fatalf("failed to handle child job: %s", err)
+		}
+		err = l.handlePipeline(child, nil)
+		if err != nil {
+			t.Fatalf("failed to handle running pipeline: %s", err)
+		}
+		late := childJob
+		late.BuildID, late.BuildName = 202, "lint"
+		err = l.handleJob(late, nil)
+		if err != nil {
+			t.Fatalf("failed to handle child job: %s", err)
+		}
+
+		traces := make(map[string]string)
+		for _, span := range sink.Spans() {
+			traces[span.Name] = span.TraceID
+		}
+		if traces["test"] != "200" || traces["lint"] != "100" {
+			t.Errorf("job traces = %v, want test in its own trace and lint in the upstream trace", traces)
+		}
+	})
+
+	t.Run("link", func(t *testing.T) {
+		sink := &MemorySink{}
+		l, err := New(Config{Version: "dev", Sink: sink, Downstream: DownstreamLink})
+		if err != nil {
+			t.Fatalf("failed to create listener: %s", err)
+		}
+
+		finished := child
+		finished.ObjectAttributes.Status = "success"
+		finished.ObjectAttributes.Duration = 60
+		err = l.handlePipeline(finished, nil)
+		if err != nil {
+			t.Fatalf("failed to handle finished pipeline: %s", err)
+		}
+
+		spans := sink.Spans()
+		if len(spans) != 1 {
+			t.Fatalf("sent %d spans, want 1", len(spans))
+		}
+		root := spans[0]
+		if root.TraceID != "200" || root.ParentID != "" {
+			t.Errorf("child pipeline trace/parent = %q/%q, want its own trace", root.TraceID, root.ParentID)
+		}
+		// The bridge job wasn't seen, so the link is to the upstream pipeline.
+		if want := []SpanLink{{TraceID: "100", SpanID: "100"}}; !reflect.DeepEqual(root.Links, want) {
+			t.Errorf("child pipeline links = %v, want %v", root.Links, want)
+		}
+	})
+}
@@ -0,0 +1,182 @@
+package hook
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/zoidyzoidzoid/gitlab-honeycomb-buildevents-webhooks-sink/internal/hook/types"
+)
+
+// Failure categories, which group GitLab's job failure reasons by who needs
+// to act on them.
+const (
+	// FailureInfra is a failure of GitLab, the runner or the environment.
+	FailureInfra = "infra"
+	// FailureUser is a failure of the job's own script or configuration.
+	FailureUser = "user"
+	// FailureTimeout is a job that ran, or waited, for too long.
+	FailureTimeout = "timeout"
+	// FailureUnknown is a failure reason that isn't known.
+	FailureUnknown = "unknown"
+)
+
+// failureCategories maps GitLab's job failure reasons to their category.
+var failureCategories = map[string]string{
+	"script_failure":                         FailureUser,
+	"missing_dependency_failure":             FailureUser,
+	"archived_failure":                       FailureUser,
+	"forward_deployment_failure":             FailureUser,
+	"failed_outdated_deployment_job":         FailureUser,
+	"protected_environment_failure":          FailureUser,
+	"deployment_rejected":                    FailureUser,
+	"user_blocked":                           FailureUser,
+	"ci_quota_exceeded":                      FailureUser,
+	"builds_disabled":                        FailureUser,
+	"trace_size_exceeded":                    FailureUser,
+	"project_deleted":                        FailureUser,
+	"secrets_provider_not_found":             FailureUser,
+	"insufficient_bridge_permissions":        FailureUser,
+	"downstream_bridge_project_not_found":    FailureUser,
+	"upstream_bridge_project_not_found":      FailureUser,
+	"invalid_bridge_trigger":                 FailureUser,
+	"bridge_pipeline_is_child_pipeline":      FailureUser,
+	"downstream_pipeline_creation_failed":    FailureUser,
+	"reached_max_descendant_pipelines_depth": FailureUser,
+	"reached_max_pipeline_hierarchy_size":    FailureUser,
+	"runner_system_failure":                  FailureInfra,
+	"api_failure":                            FailureInfra,
+	"scheduler_failure":                      FailureInfra,
+	"runner_unsupported":                     FailureInfra,
+	"stale_schedule":                         FailureInfra,
+	"unmet_prerequisites":                    FailureInfra,
+	"data_integrity_failure":                 FailureInfra,
+	"no_matching_runner":                     FailureInfra,
+	"environment_creation_failure":           FailureInfra,
+	"stuck_or_timeout_failure":               FailureTimeout,
+	"job_execution_timeout":                  FailureTimeout,
+	"job_execution_server_timeout":           FailureTimeout,
+}
+
+// failureCategory returns the category of a GitLab job failure reason.
+func failureCategory(reason string) string {
+	if category, ok := failureCategories[reason]; ok {
+		return category
+	}
+	return FailureUnknown
+}
+
+// addFailure adds the failure fields to a job's span. Failures that are
+// allowed aren't errors.
+func addFailure(j types.JobEventPayload, fields map[string]interface{}) {
+	fields["allow_failure"] = j.BuildAllowFailure
+	fields["error"] = j.BuildStatus == "failed" && !j.BuildAllowFailure
+	if j.BuildStatus != "failed" {
+		return
+	}
+
+	fields["failure_reason"] = j.BuildFailureReason
+	fields["error.category"] = failureCategory(j.BuildFailureReason)
+}
+
+// jobFailure is a failed job of a pipeline.
+type jobFailure struct {
+	BuildID    int64
+	Name       string
+	Stage      string
+	Reason     string
+	FinishedAt time.Time
+}
+
+// failureTracker remembers the jobs that failed in recent pipelines, to roll
+// the first one up onto the pipeline's span.
+type failureTracker struct {
+	mu       sync.Mutex
+	failures *ttlCache[map[int64]jobFailure]
+}
+
+func newFailureTracker() *failureTracker {
+	return &failureTracker{
+		failures: newTTLCache[map[int64]jobFailure](pipelinesTracked, pipelineTTL),
+	}
+}
+
+// add records a job of a pipeline, if it failed and wasn't allowed to.
+func (t *failureTracker) add(j types.JobEventPayload) {
+	if j.BuildStatus != "failed" || j.BuildAllowFailure {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	key := fmt.Sprint(j.PipelineID)
+	failures, ok := t.failures.Get(key)
+	if !ok {
+		failures = make(map[int64]jobFailure)
+	}
+	failures[j.BuildID] = jobFailure{
+		BuildID:    j.BuildID,
+		Name:       j.BuildName,
+		Stage:      j.BuildStage,
+		Reason:     j.BuildFailureReason,
+		FinishedAt: time.Time(j.BuildFinishedAt),
+	}
+	t.failures.Set(key, failures)
+}
+
+// failedBefore reports whether failure a happened before b. Failures without
+// a finish time come after those with one, and ties go to the lower build ID.
+func failedBefore(a, b jobFailure) bool {
+	switch {
+	case a.FinishedAt.IsZero() != b.FinishedAt.IsZero():
+		return !a.FinishedAt.IsZero()
+	case !a.FinishedAt.Equal(b.FinishedAt):
+		return a.FinishedAt.Before(b.FinishedAt)
+	default:
+		return a.BuildID < b.BuildID
+	}
+}
+
+// first returns the first job to fail in a pipeline, ignoring the failures
+// that have been retried.
+func (t *failureTracker) first(pipelineID int64, retried func(jobFailure) bool) (jobFailure, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	failures, _ := t.failures.Get(fmt.Sprint(pipelineID))
+	var first jobFailure
+	found := false
+	for _, f := range failures {
+		if retried(f) {
+			continue
+		}
+		if !found || failedBefore(f, first) {
+			first, found = f, true
+		}
+	}
+	return first, found
+}
+
+// addPipelineFailure rolls the first failed job of a pipeline up onto its
+// span. Jobs that were retried are left out, as their retry decided whether
+// the pipeline failed.
+func (l *Listener) addPipelineFailure(p types.PipelineEventPayload, fields map[string]interface{}) {
+	fields["error"] = p.ObjectAttributes.Status == "failed"
+	if p.ObjectAttributes.Status != "failed" {
+		return
+	}
+
+	f, ok := l.failures.first(p.ObjectAttributes.ID, func(f jobFailure) bool {
+		builds := l.attempts.get(p.ObjectAttributes.ID, f.Name)
+		return len(builds) > 0 && builds[len(builds)-1] > f.BuildID
+	})
+	if !ok {
+		return
+	}
+	fields["first_failure.build_id"] = f.BuildID
+	fields["first_failure.job_name"] = f.Name
+	fields["first_failure.stage"] = f.Stage
+	fields["first_failure.reason"] = f.Reason
+	fields["error.category"] = failureCategory(f.Reason)
+}
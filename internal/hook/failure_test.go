@@ -0,0 +1,118 @@
+package hook
+
+import (
+	"testing"
+	"time"
+
+	"github.com/zoidyzoidzoid/gitlab-honeycomb-buildevents-webhooks-sink/internal/hook/types"
+)
+
+func Test_failureCategory(t *testing.T) {
+	tests := map[string]string{
+		"script_failure":           FailureUser,
+		"runner_system_failure":    FailureInfra,
+		"api_failure":              FailureInfra,
+		"scheduler_failure":        FailureInfra,
+		"stuck_or_timeout_failure": FailureTimeout,
+		"unknown_failure":          FailureUnknown,
+		"":                         FailureUnknown,
+	}
+	for reason, want := range tests {
+		if got := failureCategory(reason); got != want {
+			t.Errorf("failureCategory(%q) = %s, want %s", reason, got, want)
+		}
+	}
+}
+
+func Test_pipelineFailure(t *testing.T) {
+	sink := &MemorySink{}
+	l, err := New(Config{Version: "dev", Sink: sink})
+	if err != nil {
+		t.Fatalf("failed to create listener: %s", err)
+	}
+
+	start := time.Date(2022, 10, 17, 14, 0, 0, 0, time.UTC)
+	for _, j := range []types.JobEventPayload{
+		{BuildID: 1, BuildName: "lint", BuildFailureReason: "script_failure", BuildAllowFailure: true, BuildFinishedAt: types.GitLabTimestamp(start)},
+		{BuildID: 2, BuildName: "unit", BuildFailureReason: "script_failure", BuildFinishedAt: types.GitLabTimestamp(start.Add(2 * time.Minute))},
+		{BuildID: 3, BuildName: "e2e", BuildFailureReason: "runner_system_failure", BuildFinishedAt: types.GitLabTimestamp(start.Add(time.Minute))},
+	} {
+		j.BuildStatus, j.BuildStage, j.PipelineID = "failed", "test", 42
+		j.BuildStartedAt, j.BuildDuration = types.GitLabTimestamp(start), 10
+		err = l.handleJob(j, nil)
+		if err != nil {
+			t.Fatalf("failed to handle job %d: %s", j.BuildID, err)
+		}
+	}
+
+	err = l.handlePipeline(types.PipelineEventPayload{
+		ObjectAttributes: types.PipelineObjectAttributes{
+			ID:        42,
+			Status:    "failed",
+			CreatedAt: types.GitLabTimestamp(start),
+			Duration:  180,
+		},
+	}, nil)
+	if err != nil {
+		t.Fatalf("failed to handle pipeline: %s", err)
+	}
+
+	for _, span := range sink.Spans() {
+		switch span.Name {
+		case "lint":
+			if span.Fields["error"] != false || span.Fields["allow_failure"] != true || span.Fields["error.category"] != FailureUser {
+				t.Errorf("allowed failure fields = %v, want an allowed user failure", span.Fields)
+			}
+		case "e2e":
+			if span.Fields["error"] != true || span.Fields["failure_reason"] != "runner_system_failure" || span.Fields["error.category"] != FailureInfra {
+				t.Errorf("runner failure fields = %v, want an infra error", span.Fields)
+			}
+		case "build 42":
+			if span.Fields["error"] != true || span.Fields["first_failure.job_name"] != "e2e" || span.Fields["error.category"] != FailureInfra {
+				t.Errorf("pipeline fields = %v, want e2e as the first failure", span.Fields)
+			}
+		}
+	}
+}
+
+func Test_pipelineFailureRetried(t *testing.T) {
+	sink := &MemorySink{}
+	l, err := New(Config{Version: "dev", Sink: sink})
+	if err != nil {
+		t.Fatalf("failed to create listener: %s", err)
+	}
+
+	// unit failed first, but passed when it was retried, so e2e failed the
+	// pipeline.
+	start := time.Date(2022, 10, 17, 14, 0, 0, 0, time.UTC)
+	for _, j := range []types.JobEventPayload{
+		{BuildID: 2, BuildName: "unit", BuildStatus: "failed", BuildFailureReason: "script_failure", BuildFinishedAt: types.GitLabTimestamp(start.Add(time.Minute))},
+		{BuildID: 3, BuildName: "e2e", BuildStatus: "failed", BuildFailureReason: "runner_system_failure", BuildFinishedAt: types.GitLabTimestamp(start.Add(2 * time.Minute))},
+		{BuildID: 4, BuildName: "unit", BuildStatus: "success", BuildFinishedAt: types.GitLabTimestamp(start.Add(3 * time.Minute))},
+	} {
+		j.BuildStage, j.PipelineID = "test", 42
+		j.BuildStartedAt, j.BuildDuration = types.GitLabTimestamp(start), 10
+		err = l.handleJob(j, nil)
+		if err != nil {
+			t.Fatalf("failed to handle job %d: %s", j.BuildID, err)
+		}
+	}
+
+	err = l.handlePipeline(types.PipelineEventPayload{
+		ObjectAttributes: types.PipelineObjectAttributes{
+			ID:        42,
+			Status:    "failed",
+			CreatedAt: types.GitLabTimestamp(start),
+			Duration:  180,
+		},
+	}, nil)
+	if err != nil {
+		t.Fatalf("failed to handle pipeline: %s", err)
+	}
+
+	for _, span := range sink.Spans() {
+		if span.Name == "build 42" && span.Fields["first_failure.job_name"] != "e2e" {
+			t.Errorf("pipeline fields = %v, want e2e as the first failure", span.Fields)
+		}
+	}
+}
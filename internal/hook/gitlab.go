@@ -0,0 +1,448 @@
+package hook
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zoidyzoidzoid/gitlab-honeycomb-buildevents-webhooks-sink/internal/hook/types"
+)
+
+const (
+	// DefaultGitLabCacheSize is the maximum number of GitLab API responses
+	// that are cached.
+	DefaultGitLabCacheSize = 10000
+	// DefaultGitLabCacheTTL is how long GitLab API responses are cached for.
+	DefaultGitLabCacheTTL = 10 * time.Minute
+	// DefaultGitLabTimeout is how long a GitLab API request can take.
+	DefaultGitLabTimeout = 5 * time.Second
+
+	// gitLabMaxResponse is the largest GitLab API response that's read.
+	gitLabMaxResponse = 16 << 20
+	// gitLabRateLimitBackoff is how long requests are held back for after
+	// being rate limited without being told when to retry.
+	gitLabRateLimitBackoff = time.Minute
+	// gitLabBreakerFailures is the number of requests in a row that can fail
+	// before requests are held back.
+	gitLabBreakerFailures = 5
+	// gitLabBreakerBackoff is how long requests are held back for after too
+	// many have failed in a row.
+	gitLabBreakerBackoff = 30 * time.Second
+)
+
+var (
+	// errGitLabRateLimited is returned instead of making requests while
+	// GitLab is rate limiting them.
+	errGitLabRateLimited = errors.New("rate limited by GitLab")
+	// errGitLabUnavailable is returned instead of making requests after too
+	// many have failed in a row, so that a slow or broken GitLab doesn't hold
+	// up the spans.
+	errGitLabUnavailable = errors.New("GitLab API is unavailable")
+)
+
+// GitLabConfig configures the GitLab API client used to enrich spans.
+type GitLabConfig struct {
+	// URL is the base URL of the GitLab instance, e.g. https://gitlab.com.
+	URL string
+	// Token is a token with the read_api scope.
+	Token string
+	// CacheSize is the maximum number of responses that are cached.
+	// Defaults to DefaultGitLabCacheSize.
+	CacheSize int
+	// CacheTTL is how long responses are cached for. Defaults to
+	// DefaultGitLabCacheTTL.
+	CacheTTL time.Duration
+	// Timeout is how long a request can take. Defaults to
+	// DefaultGitLabTimeout.
+	Timeout time.Duration
+}
+
+// Enabled reports whether a GitLab instance and token have been configured.
+func (c GitLabConfig) Enabled() bool {
+	return c.URL != "" && c.Token != ""
+}
+
+// gitLabClient is a client for the GitLab REST API. Responses are cached, and
+// requests aren't made while GitLab is rate limiting them, or for a while
+// after too many have failed in a row.
+type gitLabClient struct {
+	cfg    GitLabConfig
+	client *http.Client
+	cache  *ttlCache[[]byte]
+
+	mu           sync.Mutex
+	limitedUntil time.Time
+	failures     int
+	brokenUntil  time.Time
+	now          func() time.Time
+}
+
+func newGitLabClient(cfg GitLabConfig) *gitLabClient {
+	if cfg.CacheSize <= 0 {
+		cfg.CacheSize = DefaultGitLabCacheSize
+	}
+	if cfg.CacheTTL <= 0 {
+		cfg.CacheTTL = DefaultGitLabCacheTTL
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = DefaultGitLabTimeout
+	}
+	cfg.URL = strings.TrimSuffix(cfg.URL, "/")
+
+	return &gitLabClient{
+		cfg:    cfg,
+		client: &http.Client{Timeout: cfg.Timeout},
+		cache:  newTTLCache[[]byte](cfg.CacheSize, cfg.CacheTTL),
+		now:    time.Now,
+	}
+}
+
+// get fetches path from the API, relative to /api/v4, returning a cached
+// response if there is one.
+func (c *gitLabClient) get(ctx context.Context, path string) ([]byte, error) {
+	if body, ok := c.cache.Get(path); ok {
+		return body, nil
+	}
+
+	body, err := c.fetch(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	c.cache.Set(path, body)
+	return body, nil
+}
+
+// getJSON fetches path from the API and decodes it into v.
+func (c *gitLabClient) getJSON(ctx context.Context, path string, v interface{}) error {
+	body, err := c.get(ctx, path)
+	if err != nil {
+		return err
+	}
+
+	err = json.Unmarshal(body, v)
+	if err != nil {
+		return fmt.Errorf("failed to decode %s: %w", path, err)
+	}
+	return nil
+}
+
+// fetch fetches path from the API, without the cache.
+func (c *gitLabClient) fetch(ctx context.Context, path string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.cfg.URL+"/api/v4"+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	return c.do(req, path)
+}
+
+// query runs a GraphQL query, returning a cached response if there is one,
+// and decodes its data into v.
+func (c *gitLabClient) query(ctx context.Context, query string, variables map[string]interface{}, v interface{}) error {
+	reqBody, err := json.Marshal(map[string]interface{}{"query": query, "variables": variables})
+	if err != nil {
+		return fmt.Errorf("failed to encode GraphQL query: %w", err)
+	}
+
+	key := "graphql " + string(reqBody)
+	body, cached := c.cache.Get(key)
+	if !cached {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.cfg.URL+"/api/graphql", bytes.NewReader(reqBody))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		body, err = c.do(req, "/api/graphql")
+		if err != nil {
+			return err
+		}
+	}
+
+	var resp struct {
+		Data   json.RawMessage `json:"data"`
+		Errors []struct {
+			Message string `json:"message"`
+		} `json:"errors"`
+	}
+	err = json.Unmarshal(body, &resp)
+	if err != nil {
+		return fmt.Errorf("failed to decode GraphQL response: %w", err)
+	}
+	if len(resp.Errors) > 0 {
+		return fmt.Errorf("failed to query GitLab: %s", resp.Errors[0].Message)
+	}
+	err = json.Unmarshal(resp.Data, v)
+	if err != nil {
+		return fmt.Errorf("failed to decode GraphQL data: %w", err)
+	}
+
+	if !cached {
+		c.cache.Set(key, body)
+	}
+	return nil
+}
+
+// do makes a request to the API, unless GitLab is rate limiting requests or
+// too many have failed in a row, and returns its body. name is what the
+// request is called in errors.
+func (c *gitLabClient) do(req *http.Request, name string) ([]byte, error) {
+	c.mu.Lock()
+	limited := c.now().Before(c.limitedUntil)
+	broken := c.now().Before(c.brokenUntil)
+	c.mu.Unlock()
+	if limited {
+		return nil, errGitLabRateLimited
+	}
+	if broken {
+		return nil, errGitLabUnavailable
+	}
+
+	req.Header.Set("PRIVATE-TOKEN", c.cfg.Token)
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := c.client.Do(req)
+	c.trackFailures(err == nil && resp.StatusCode < http.StatusInternalServerError)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch %s: %w", name, err)
+	}
+	defer resp.Body.Close()
+
+	c.trackRateLimit(resp)
+	if resp.StatusCode == http.StatusTooManyRequests {
+		return nil, errGitLabRateLimited
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("failed to fetch %s: %d %s", name, resp.StatusCode, http.StatusText(resp.StatusCode))
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, gitLabMaxResponse))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", name, err)
+	}
+	return body, nil
+}
+
+// trackFailures holds back requests once too many in a row have failed
+// because GitLab didn't answer, or had an error.
+func (c *gitLabClient) trackFailures(ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if ok {
+		c.failures = 0
+		return
+	}
+	c.failures++
+	if c.failures >= gitLabBreakerFailures {
+		c.failures = 0
+		c.brokenUntil = c.now().Add(gitLabBreakerBackoff)
+		log.Printf("%d GitLab API requests failed in a row, not making any for %s", gitLabBreakerFailures, gitLabBreakerBackoff)
+	}
+}
+
+// trackRateLimit holds back requests when GitLab has rate limited a request,
+// or said that there are none left, until it says they can be made again.
+func (c *gitLabClient) trackRateLimit(resp *http.Response) {
+	limited := resp.StatusCode == http.StatusTooManyRequests || resp.Header.Get("RateLimit-Remaining") == "0"
+	if !limited {
+		return
+	}
+
+	now := c.now()
+	until := now.Add(gitLabRateLimitBackoff)
+	if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+		until = now.Add(time.Duration(seconds) * time.Second)
+	} else if reset, err := strconv.ParseInt(resp.Header.Get("RateLimit-Reset"), 10, 64); err == nil {
+		until = time.Unix(reset, 0)
+	}
+
+	c.mu.Lock()
+	if until.After(c.limitedUntil) {
+		c.limitedUntil = until
+	}
+	c.mu.Unlock()
+}
+
+// gitLabJob is the part of the API's job that spans are enriched with.
+type gitLabJob struct {
+	Coverage  *float64 `json:"coverage"`
+	TagList   []string `json:"tag_list"`
+	WebURL    string   `json:"web_url"`
+	Artifacts []struct {
+		FileType string `json:"file_type"`
+		Size     int64  `json:"size"`
+	} `json:"artifacts"`
+	ArtifactsExpireAt string `json:"artifacts_expire_at"`
+	Environment       *struct {
+		Name string `json:"name"`
+	} `json:"environment"`
+}
+
+// gitLabProject is the part of the API's project that's needed to query
+// GraphQL.
+type gitLabProject struct {
+	PathWithNamespace string `json:"path_with_namespace"`
+}
+
+// gitLabJobNeedsQuery fetches the jobs that a job needs, which the REST API
+// doesn't have.
+const gitLabJobNeedsQuery = `query($project: ID!, $job: JobID!) {
+  project(fullPath: $project) {
+    job(id: $job) {
+      needs { nodes { name } }
+    }
+  }
+}`
+
+// gitLabJobNeeds is the response to gitLabJobNeedsQuery.
+type gitLabJobNeeds struct {
+	Project *struct {
+		Job *struct {
+			Needs struct {
+				Nodes []struct {
+					Name string `json:"name"`
+				} `json:"nodes"`
+			} `json:"needs"`
+		} `json:"job"`
+	} `json:"project"`
+}
+
+// gitLabPipeline is the part of the API's pipeline that spans are enriched
+// with.
+type gitLabPipeline struct {
+	Coverage       string  `json:"coverage"`
+	Name           string  `json:"name"`
+	WebURL         string  `json:"web_url"`
+	QueuedDuration float64 `json:"queued_duration"`
+}
+
+// gitLabContext returns a context for a request to the GitLab API.
+func (l *Listener) gitLabContext() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), l.gitlab.cfg.Timeout)
+}
+
+// enrichJob adds fields from the GitLab API to a job's span. Failures are
+// logged, and the span is sent without them.
+func (l *Listener) enrichJob(j types.JobEventPayload, fields map[string]interface{}) {
+	if l.gitlab == nil || j.ProjectID == 0 {
+		return
+	}
+
+	ctx, cancel := l.gitLabContext()
+	defer cancel()
+
+	// A job changes until it has finished, e.g. a manual job is played, so
+	// only finished jobs are cached.
+	path := fmt.Sprintf("/projects/%d/jobs/%d", j.ProjectID, j.BuildID)
+	var body []byte
+	var err error
+	if finishedStatuses[j.BuildStatus] {
+		body, err = l.gitlab.get(ctx, path)
+	} else {
+		body, err = l.gitlab.fetch(ctx, path)
+	}
+	var job gitLabJob
+	if err == nil {
+		err = json.Unmarshal(body, &job)
+	}
+	if err != nil {
+		log.Printf("failed to enrich job %d: %s", j.BuildID, err)
+		return
+	}
+
+	if job.Coverage != nil {
+		fields["coverage"] = *job.Coverage
+	}
+	if len(job.TagList) > 0 {
+		fields["job_tags"] = strings.Join(job.TagList, ",")
+	}
+	if job.WebURL != "" {
+		fields["build_url"] = job.WebURL
+	}
+	if job.Environment != nil && job.Environment.Name != "" {
+		fields["environment"] = job.Environment.Name
+	}
+	if len(job.Artifacts) > 0 {
+		var size int64
+		fileTypes := make([]string, 0, len(job.Artifacts))
+		for _, a := range job.Artifacts {
+			size += a.Size
+			fileTypes = append(fileTypes, a.FileType)
+		}
+		fields["artifacts_count"] = len(job.Artifacts)
+		fields["artifacts_size_bytes"] = size
+		fields["artifacts_types"] = strings.Join(fileTypes, ",")
+	}
+
+	needs, err := l.jobNeeds(ctx, j)
+	if err != nil {
+		log.Printf("failed to fetch needs of job %d: %s", j.BuildID, err)
+		return
+	}
+	if len(needs) > 0 {
+		fields["job_needs"] = strings.Join(needs, ",")
+	}
+}
+
+// jobNeeds returns the names of the jobs that a job needs, from GraphQL.
+func (l *Listener) jobNeeds(ctx context.Context, j types.JobEventPayload) ([]string, error) {
+	var project gitLabProject
+	err := l.gitlab.getJSON(ctx, fmt.Sprintf("/projects/%d", j.ProjectID), &project)
+	if err != nil {
+		return nil, err
+	}
+
+	var resp gitLabJobNeeds
+	err = l.gitlab.query(ctx, gitLabJobNeedsQuery, map[string]interface{}{
+		"project": project.PathWithNamespace,
+		"job":     fmt.Sprintf("gid://gitlab/Ci::Build/%d", j.BuildID),
+	}, &resp)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Project == nil || resp.Project.Job == nil {
+		return nil, nil
+	}
+
+	needs := make([]string, 0, len(resp.Project.Job.Needs.Nodes))
+	for _, n := range resp.Project.Job.Needs.Nodes {
+		needs = append(needs, n.Name)
+	}
+	return needs, nil
+}
+
+// enrichPipeline adds fields from the GitLab API to a pipeline's span.
+// Failures are logged, and the span is sent without them.
+func (l *Listener) enrichPipeline(p types.PipelineEventPayload, fields map[string]interface{}) {
+	if l.gitlab == nil || p.Project.ID == 0 {
+		return
+	}
+
+	ctx, cancel := l.gitLabContext()
+	defer cancel()
+
+	var pipeline gitLabPipeline
+	err := l.gitlab.getJSON(ctx, fmt.Sprintf("/projects/%d/pipelines/%d", p.Project.ID, p.ObjectAttributes.ID), &pipeline)
+	if err != nil {
+		log.Printf("failed to enrich pipeline %d: %s", p.ObjectAttributes.ID, err)
+		return
+	}
+
+	if coverage, err := strconv.ParseFloat(pipeline.Coverage, 64); err == nil {
+		fields["coverage"] = coverage
+	}
+	if pipeline.Name != "" {
+		fields["pipeline_name"] = pipeline.Name
+	}
+	if pipeline.QueuedDuration > 0 {
+		fields["queued_duration_ms"] = pipeline.QueuedDuration * 1000
+	}
+}
@@ -0,0 +1,219 @@
+package hook
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/zoidyzoidzoid/gitlab-honeycomb-buildevents-webhooks-sink/internal/hook/types"
+)
+
+// fakeGitLab is an httptest stand-in for the GitLab API.
+type fakeGitLab struct {
+	*httptest.Server
+
+	mu        sync.Mutex
+	responses map[string]string
+	requests  map[string]int
+	// rateLimited makes every request answer 429 Too Many Requests.
+	rateLimited bool
+}
+
+func newFakeGitLab(t *testing.T, responses map[string]string) *fakeGitLab {
+	g := &fakeGitLab{responses: responses, requests: make(map[string]int)}
+	g.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("PRIVATE-TOKEN") != "token" {
+			t.Errorf("request to %s had token %q, want token", r.URL.Path, r.Header.Get("PRIVATE-TOKEN"))
+		}
+
+		g.mu.Lock()
+		defer g.mu.Unlock()
+		g.requests[r.URL.Path]++
+		if g.rateLimited {
+			w.Header().Set("Retry-After", "60")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		body, ok := g.responses[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(body))
+	}))
+	t.Cleanup(g.Close)
+	return g
+}
+
+func (g *fakeGitLab) count(path string) int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.requests[path]
+}
+
+func (g *fakeGitLab) config() GitLabConfig {
+	return GitLabConfig{URL: g.URL, Token: "token"}
+}
+
+func Test_gitLabClient(t *testing.T) {
+	gitlab := newFakeGitLab(t, map[string]string{
+		"/api/v4/projects/3/jobs/10": `{"id": 10}`,
+	})
+	c := newGitLabClient(gitlab.config())
+
+	for i := 0; i < 2; i++ {
+		body, err := c.get(context.Background(), "/projects/3/jobs/10")
+		if err != nil || string(body) != `{"id": 10}` {
+			t.Fatalf("get() = %s, %v, want the job", body, err)
+		}
+	}
+	if got := gitlab.count("/api/v4/projects/3/jobs/10"); got != 1 {
+		t.Errorf("job was fetched %d times, want once and then cached", got)
+	}
+
+	gitlab.mu.Lock()
+	gitlab.rateLimited = true
+	gitlab.mu.Unlock()
+	for i := 0; i < 2; i++ {
+		_, err := c.get(context.Background(), "/projects/3/jobs/11")
+		if !errors.Is(err, errGitLabRateLimited) {
+			t.Errorf("get() error = %v, want rate limited", err)
+		}
+	}
+	if got := gitlab.count("/api/v4/projects/3/jobs/11"); got != 1 {
+		t.Errorf("rate limited job was fetched %d times, want requests held back after the first", got)
+	}
+
+	c.now = func() time.Time { return time.Now().Add(2 * time.Minute) }
+	gitlab.mu.Lock()
+	gitlab.rateLimited = false
+	gitlab.mu.Unlock()
+	if _, err := c.get(context.Background(), "/projects/3/jobs/10"); err != nil {
+		t.Errorf("get() after the rate limit error = %v", err)
+	}
+}
+
+func Test_gitLabClientBreaker(t *testing.T) {
+	var requests int
+	var mu sync.Mutex
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests++
+		mu.Unlock()
+		http.Error(w, "unavailable", http.StatusInternalServerError)
+	}))
+	defer server.Close()
+	c := newGitLabClient(GitLabConfig{URL: server.URL, Token: "token"})
+
+	for i := 0; i < gitLabBreakerFailures+2; i++ {
+		_, err := c.fetch(context.Background(), "/projects/3/jobs/10")
+		if err == nil {
+			t.Fatalf("fetch() succeeded, want an error")
+		}
+		if i >= gitLabBreakerFailures && !errors.Is(err, errGitLabUnavailable) {
+			t.Errorf("fetch() error = %v, want requests held back", err)
+		}
+	}
+	mu.Lock()
+	if requests != gitLabBreakerFailures {
+		t.Errorf("made %d requests, want %d and then requests held back", requests, gitLabBreakerFailures)
+	}
+	mu.Unlock()
+
+	c.now = func() time.Time { return time.Now().Add(gitLabBreakerBackoff) }
+	_, err := c.fetch(context.Background(), "/projects/3/jobs/10")
+	if errors.Is(err, errGitLabUnavailable) {
+		t.Errorf("fetch() after the backoff error = %v, want a request", err)
+	}
+}
+
+func Test_enrichJob(t *testing.T) {
+	gitlab := newFakeGitLab(t, map[string]string{
+		"/api/v4/projects/3/jobs/10": `{
+			"id": 10,
+			"coverage": 87.5,
+			"tag_list": ["docker", "linux"],
+			"web_url": "https://gitlab.com/group/project/-/jobs/10",
+			"artifacts": [{"file_type": "archive", "size": 1000}, {"file_type": "junit", "size": 24}]
+		}`,
+		"/api/v4/projects/3": `{"id": 3, "path_with_namespace": "group/project"}`,
+		"/api/graphql":       `{"data": {"project": {"job": {"needs": {"nodes": [{"name": "build"}, {"name": "lint"}]}}}}}`,
+	})
+
+	job := types.JobEventPayload{
+		BuildID:        10,
+		BuildName:      "unit",
+		BuildStatus:    "success",
+		BuildStartedAt: types.GitLabTimestamp(time.Date(2022, 10, 17, 14, 0, 0, 0, time.UTC)),
+		BuildDuration:  60,
+		PipelineID:     42,
+		ProjectID:      3,
+	}
+
+	sink := &MemorySink{}
+	l, err := New(Config{Version: "dev", Sink: sink, GitLab: gitlab.config()})
+	if err != nil {
+		t.Fatalf("failed to create listener: %s", err)
+	}
+	err = l.handleJob(job, nil)
+	if err != nil {
+		t.Fatalf("failed to handle job: %s", err)
+	}
+
+	fields := sink.Spans()[0].Fields
+	if fields["coverage"] != 87.5 || fields["job_tags"] != "docker,linux" || fields["build_url"] != "https://gitlab.com/group/project/-/jobs/10" {
+		t.Errorf("fields = %v, want the job's coverage, tags and URL", fields)
+	}
+	if fields["artifacts_count"] != 2 || fields["artifacts_size_bytes"] != int64(1024) || fields["artifacts_types"] != "archive,junit" {
+		t.Errorf("fields = %v, want the job's artifacts", fields)
+	}
+	if fields["job_needs"] != "build,lint" {
+		t.Errorf("fields = %v, want the job's needs", fields)
+	}
+
+	// Spans are still sent when the API is unavailable.
+	gitlab.Close()
+	job.BuildID = 11
+	err = l.handleJob(job, nil)
+	if err != nil {
+		t.Fatalf("failed to handle job: %s", err)
+	}
+	if spans := sink.Spans(); len(spans) != 2 || spans[1].Fields["build_id"] != int64(11) {
+		t.Errorf("spans = %v, want the second job sent without enrichment", spans)
+	}
+}
+
+func Test_enrichJobManual(t *testing.T) {
+	gitlab := newFakeGitLab(t, map[string]string{
+		"/api/v4/projects/3/jobs/10": `{"id": 10}`,
+	})
+
+	sink := &MemorySink{}
+	l, err := New(Config{Version: "dev", Sink: sink, GitLab: gitlab.config()})
+	if err != nil {
+		t.Fatalf("failed to create listener: %s", err)
+	}
+
+	// The manual job isn't cached, so it's fetched again once it has been
+	// played and has finished, and then cached.
+	created := time.Date(2022, 10, 17, 14, 0, 0, 0, time.UTC)
+	job := types.JobEventPayload{BuildID: 10, BuildName: "deploy", BuildCreatedAt: types.GitLabTimestamp(created), PipelineID: 42, ProjectID: 3}
+	for _, status := range []string{"manual", "success", "success"} {
+		job.BuildStatus = status
+		if status == "success" {
+			job.BuildStartedAt = types.GitLabTimestamp(created.Add(time.Minute))
+			job.BuildDuration = 60
+		}
+		err = l.handleJob(job, nil)
+		if err != nil {
+			t.Fatalf("failed to handle %s job: %s", status, err)
+		}
+	}
+	if got := gitlab.count("/api/v4/projects/3/jobs/10"); got != 2 {
+		t.Errorf("job was fetched %d times, want once while manual and once finished", got)
+	}
+}
@@ -0,0 +1,301 @@
+package hook
+
+import (
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/honeycombio/libhoney-go"
+	"github.com/honeycombio/libhoney-go/transmission"
+)
+
+const (
+	// DefaultMaxRetries is the number of times an event is resent after a
+	// transient failure before it's dead-lettered.
+	DefaultMaxRetries = 5
+
+	retryBaseDelay = time.Second
+	retryMaxDelay  = time.Minute
+)
+
+// HoneycombSinkConfig configures a HoneycombSink.
+type HoneycombSinkConfig struct {
+	Version         string
+	Debug           bool
+	HoneycombConfig *libhoney.Config
+
+	// MaxRetries is the number of times an event is resent after a transient
+	// failure. Defaults to DefaultMaxRetries.
+	MaxRetries int
+	// DeadLetterPath is the JSON lines file that events which couldn't be
+	// sent are written to. They're only logged when it's empty.
+	DeadLetterPath string
+	// ReplayDeadLetters resends the events in DeadLetterPath on startup.
+	ReplayDeadLetters bool
+}
+
+// HoneycombSink sends spans to Honeycomb as buildevents-compatible events.
+// Responses from Honeycomb are checked, transient failures are retried with
+// backoff, and permanent failures are dead-lettered.
+type HoneycombSink struct {
+	cfg         HoneycombSinkConfig
+	deadLetters *deadLetterFile
+	stopped     atomic.Bool
+}
+
+// eventMetadata is attached to every libhoney event, so that it can be
+// retried or dead-lettered when its response is read.
+type eventMetadata struct {
+	Fields    map[string]interface{}
+	Timestamp time.Time
+	Attempt   int
+
+	done func()
+}
+
+// NewHoneycombSink initialises libhoney and starts reading its responses.
+func NewHoneycombSink(cfg HoneycombSinkConfig) (*HoneycombSink, error) {
+	if cfg.MaxRetries <= 0 {
+		cfg.MaxRetries = DefaultMaxRetries
+	}
+
+	// Every event's response must be read for its webhook to be acknowledged,
+	// so responses are never dropped when consumeResponses falls behind.
+	cfg.HoneycombConfig.BlockOnResponse = true
+	if cfg.HoneycombConfig.APIKey == "" && cfg.HoneycombConfig.Transmission == nil {
+		// Without an API key, write events to stdout rather than failing to
+		// send them.
+		cfg.HoneycombConfig.Transmission = &transmission.WriterSender{BlockOnResponses: true}
+	}
+
+	setUserAgentAddition(cfg.Version)
+	err := libhoney.Init(*cfg.HoneycombConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialise libhoney: %w", err)
+	}
+
+	s := &HoneycombSink{
+		cfg: cfg,
+	}
+	if cfg.DeadLetterPath != "" {
+		s.deadLetters = &deadLetterFile{path: cfg.DeadLetterPath}
+	}
+
+	go s.consumeResponses(libhoney.TxResponses())
+
+	if cfg.ReplayDeadLetters {
+		err := s.ReplayDeadLetters()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return s, nil
+}
+
+func setUserAgentAddition(version string) {
+	libhoney.UserAgentAddition = fmt.Sprintf("buildevents/%s", version)
+	libhoney.UserAgentAddition += fmt.Sprintf(" (%s)", "GitLab-CI")
+}
+
+// Send sends span to Honeycomb as an event.
+func (s *HoneycombSink) Send(span Span, done func()) {
+	if len(span.Links) > 0 {
+		done = s.sendLinks(span, done)
+	}
+
+	ev, err := s.createEvent()
+	if err != nil {
+		log.Printf("failed to create event: %s", err)
+		done()
+		return
+	}
+
+	err = ev.Add(span.Fields)
+	if err != nil {
+		log.Printf("failed to add fields to event: %s", err)
+		done()
+		return
+	}
+	err = ev.Add(map[string]interface{}{
+		"service_name":   span.ServiceName,
+		"trace.span_id":  span.SpanID,
+		"trace.trace_id": span.TraceID,
+		"name":           span.Name,
+		"duration_ms":    float64(span.Duration) / float64(time.Millisecond),
+	})
+	if err != nil {
+		log.Printf("failed to add trace fields to event: %s", err)
+		done()
+		return
+	}
+	if span.ParentID != "" {
+		ev.AddField("trace.parent_id", span.ParentID)
+	}
+	ev.Timestamp = span.Timestamp
+
+	s.send(ev, &eventMetadata{
+		Fields:    ev.Fields(),
+		Timestamp: ev.Timestamp,
+		Attempt:   1,
+		done:      done,
+	})
+}
+
+// sendLinks sends span's links as Honeycomb link events, and returns a
+// function to call when span has been sent, which calls done once the links
+// have been sent too.
+func (s *HoneycombSink) sendLinks(span Span, done func()) func() {
+	var pending atomic.Int32
+	pending.Store(int32(len(span.Links)) + 1)
+	finish := func() {
+		if pending.Add(-1) == 0 {
+			done()
+		}
+	}
+
+	for _, link := range span.Links {
+		ev, err := s.createEvent()
+		if err != nil {
+			log.Printf("failed to create link event: %s", err)
+			finish()
+			continue
+		}
+		ev.Add(map[string]interface{}{
+			"service_name":         span.ServiceName,
+			"name":                 span.Name,
+			"trace.trace_id":       span.TraceID,
+			"trace.parent_id":      span.SpanID,
+			"trace.link.trace_id":  link.TraceID,
+			"trace.link.span_id":   link.SpanID,
+			"meta.annotation_type": "link",
+		})
+		ev.Timestamp = span.Timestamp
+
+		s.send(ev, &eventMetadata{
+			Fields:    ev.Fields(),
+			Timestamp: ev.Timestamp,
+			Attempt:   1,
+			done:      finish,
+		})
+	}
+
+	return finish
+}
+
+// Flush sends any buffered events.
+func (s *HoneycombSink) Flush() error {
+	libhoney.Flush()
+	return nil
+}
+
+// Close flushes libhoney and stops retrying events.
+func (s *HoneycombSink) Close() error {
+	s.stopped.Store(true)
+	libhoney.Close()
+	return nil
+}
+
+func (s *HoneycombSink) createEvent() (*libhoney.Event, error) {
+	setUserAgentAddition(s.cfg.Version)
+
+	ev := libhoney.NewEvent()
+	ev.AddField("ci_provider", "GitLab-CI")
+	ev.AddField("meta.version", s.cfg.Version)
+
+	return ev, nil
+}
+
+func (s *HoneycombSink) send(ev *libhoney.Event, meta *eventMetadata) {
+	ev.Metadata = meta
+	err := ev.Send()
+	if err != nil {
+		log.Printf("failed to send event: %s", err)
+		s.deadLetter(meta, 0, err.Error())
+	}
+}
+
+// consumeResponses reads libhoney's responses until the channel is closed,
+// retrying transient failures and dead-lettering permanent ones.
+func (s *HoneycombSink) consumeResponses(responses chan transmission.Response) {
+	for resp := range responses {
+		meta, ok := resp.Metadata.(*eventMetadata)
+		if !ok {
+			continue
+		}
+
+		switch {
+		case responseSucceeded(resp):
+			if meta.done != nil {
+				meta.done()
+			}
+		case responseRetryable(resp) && meta.Attempt <= s.cfg.MaxRetries:
+			delay := retryDelay(meta.Attempt)
+			if s.cfg.Debug {
+				log.Printf("retrying event in %s after attempt %d failed: %s", delay, meta.Attempt, responseError(resp))
+			}
+			time.AfterFunc(delay, func() {
+				s.retry(meta)
+			})
+		default:
+			log.Printf("failed to send event after %d attempts: %s", meta.Attempt, responseError(resp))
+			s.deadLetter(meta, resp.StatusCode, responseError(resp))
+		}
+	}
+}
+
+// retry resends the event described by meta.
+func (s *HoneycombSink) retry(meta *eventMetadata) {
+	if s.stopped.Load() {
+		// libhoney is closed, so the event is dead-lettered rather than
+		// being resent, and its webhook is acknowledged.
+		s.deadLetter(meta, 0, "sink closed before the event could be resent")
+		return
+	}
+
+	ev, err := s.createEvent()
+	if err != nil {
+		s.deadLetter(meta, 0, err.Error())
+		return
+	}
+
+	err = ev.Add(meta.Fields)
+	if err != nil {
+		s.deadLetter(meta, 0, err.Error())
+		return
+	}
+	ev.Timestamp = meta.Timestamp
+
+	meta.Attempt++
+	s.send(ev, meta)
+}
+
+func responseSucceeded(resp transmission.Response) bool {
+	// The WriterSender used without an API key doesn't set a status code.
+	return resp.Err == nil && (resp.StatusCode == 0 || (resp.StatusCode >= 200 && resp.StatusCode < 300))
+}
+
+func responseRetryable(resp transmission.Response) bool {
+	return resp.Err != nil || resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+}
+
+func responseError(resp transmission.Response) string {
+	if resp.Err != nil {
+		return resp.Err.Error()
+	}
+	return fmt.Sprintf("%d %s: %s", resp.StatusCode, http.StatusText(resp.StatusCode), resp.Body)
+}
+
+// retryDelay returns the exponential backoff, with jitter, before the retry
+// following attempt.
+func retryDelay(attempt int) time.Duration {
+	delay := retryBaseDelay << (attempt - 1)
+	if delay > retryMaxDelay || delay <= 0 {
+		delay = retryMaxDelay
+	}
+
+	return delay/2 + rand.N(delay/2)
+}
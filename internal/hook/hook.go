@@ -1,23 +1,62 @@
 package hook
 
 import (
-	"crypto/md5"
-	"encoding/hex"
 	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/honeycombio/libhoney-go"
-	"github.com/honeycombio/libhoney-go/transmission"
 	"github.com/zoidyzoidzoid/gitlab-honeycomb-buildevents-webhooks-sink/internal/hook/types"
+	"github.com/zoidyzoidzoid/gitlab-honeycomb-buildevents-webhooks-sink/internal/spool"
+)
+
+const (
+	// DefaultListenAddr is the address the HTTP server listens on.
+	DefaultListenAddr = ":8080"
+	// DefaultReadTimeout is how long reading a request can take.
+	DefaultReadTimeout = 5 * time.Second
+	// DefaultWriteTimeout is how long handling a request and writing its
+	// response can take.
+	DefaultWriteTimeout = 10 * time.Second
+	// DefaultIdleTimeout is how long an idle keep-alive connection is kept
+	// open for.
+	DefaultIdleTimeout = 2 * time.Minute
 )
 
 type Listener struct {
 	Config     Config
 	HTTPServer *http.Server
+
+	spool       *spool.Spool
+	delivered   *ttlCache[struct{}]
+	queue       chan queuedHook
+	queueMu     sync.RWMutex
+	queueClosed bool
+	startOnce   sync.Once
+	replaying   sync.WaitGroup
+	workers     sync.WaitGroup
+	inflight    sync.WaitGroup
+	sink        Sink
+
+	mergeRequests *mergeRequestTracker
+	jobs          *ttlCache[jobRef]
+	deployments   *ttlCache[time.Time]
+	stages        *stageTracker
+	jobSpans      *ttlCache[struct{}]
+	// pipelineTraces are the trace IDs of downstream pipelines that are in
+	// their upstream pipeline's trace.
+	pipelineTraces *ttlCache[string]
+	attempts       *attemptTracker
+	failures       *failureTracker
+	variables      *variableFilter
+	gitlab         *gitLabClient
+	recorder       *recorder
+	markers        *markerClient
 }
 
 type Config struct {
@@ -26,6 +65,99 @@ type Config struct {
 	HookSecret      string
 	Debug           bool
 	HoneycombConfig *libhoney.Config
+
+	// ReadTimeout is how long reading a request can take. Defaults to
+	// DefaultReadTimeout.
+	ReadTimeout time.Duration
+	// WriteTimeout is how long handling a request and writing its response
+	// can take. Defaults to DefaultWriteTimeout.
+	WriteTimeout time.Duration
+	// IdleTimeout is how long an idle keep-alive connection is kept open
+	// for. Defaults to DefaultIdleTimeout.
+	IdleTimeout time.Duration
+	// MaxBodyBytes is the largest webhook body that's accepted. Defaults to
+	// DefaultMaxBodyBytes.
+	MaxBodyBytes int64
+
+	// QueueSize is the number of accepted webhooks that can be waiting to be
+	// processed. Defaults to DefaultQueueSize.
+	QueueSize int
+	// Workers is the number of goroutines processing queued webhooks.
+	// Defaults to DefaultWorkers.
+	Workers int
+	// Spool configures the on-disk spool of accepted webhooks. It's disabled
+	// unless Spool.Dir is set.
+	Spool spool.Config
+	// DedupTTL is how long a delivered webhook is remembered, so that GitLab
+	// retrying it doesn't create duplicate events. Defaults to
+	// DefaultDedupTTL.
+	DedupTTL time.Duration
+	// DedupSize is the maximum number of delivered webhooks remembered.
+	// Defaults to DefaultDedupSize.
+	DedupSize int
+	// Sink is where spans are sent. Defaults to a HoneycombSink configured
+	// by HoneycombConfig, MaxRetries, DeadLetterPath and ReplayDeadLetters.
+	Sink Sink
+	// MaxRetries is the number of times an event is resent after a transient
+	// failure. Defaults to DefaultMaxRetries.
+	MaxRetries int
+	// DeadLetterPath is the JSON lines file that events which couldn't be
+	// sent are written to. They're only logged when it's empty.
+	DeadLetterPath string
+	// ReplayDeadLetters resends the events in DeadLetterPath on startup.
+	ReplayDeadLetters bool
+	// DeployMarkers creates a Honeycomb marker, in the HoneycombConfig
+	// dataset, for every successful deployment to MarkerEnvironments.
+	DeployMarkers bool
+	// MarkerEnvironments are the environment names or tiers that markers
+	// are created for. Defaults to DefaultMarkerEnvironments.
+	MarkerEnvironments []string
+	// JobsFromPipeline sends job spans built from a finished pipeline's
+	// builds, for jobs that no Job Hook has been received for.
+	JobsFromPipeline bool
+	// Downstream is how child and multi-project pipelines are linked to the
+	// pipeline that triggered them: DownstreamParent or DownstreamLink.
+	// Defaults to DefaultDownstream.
+	Downstream string
+	// RedactEmails is how email addresses are sent: RedactKeep, RedactHash
+	// or RedactDrop. Defaults to DefaultRedactEmails.
+	RedactEmails string
+	// RedactNames is how names and usernames are sent: RedactKeep,
+	// RedactHash or RedactDrop. Defaults to DefaultRedactNames.
+	RedactNames string
+	// RedactKey is the key that values are hashed with. A random key is used
+	// when it's empty, so hashes only match until the sink is restarted.
+	RedactKey string
+	// VariablesAllow are the glob patterns of the pipeline variable keys
+	// that are sent as var.<KEY> fields. None are sent when it's empty.
+	VariablesAllow []string
+	// VariablesDeny are the glob patterns of pipeline variable keys that
+	// are never sent. Defaults to DefaultVariablesDeny.
+	VariablesDeny []string
+	// SecretPatterns are regular expressions matching variable values that
+	// are redacted, as well as the built-in ones for common tokens and keys.
+	SecretPatterns []string
+	// GitLab configures the GitLab API client used to enrich spans. Spans
+	// aren't enriched when it's not enabled.
+	GitLab GitLabConfig
+	// JobSections fetches the log of every finished job from the GitLab API
+	// and sends its sections as child spans of the job. It needs GitLab to
+	// be enabled.
+	JobSections bool
+	// TestReports fetches the test report of every finished pipeline from
+	// the GitLab API and sends its suites and tests as spans under the jobs
+	// that ran them. It needs GitLab to be enabled.
+	TestReports bool
+	// RecordPath is the JSON lines file that every received webhook is
+	// recorded to, in the format that Replay reads. Webhooks aren't recorded
+	// when it's empty.
+	RecordPath string
+	// RecordMaxBytes is the size the recording grows to before it's rotated.
+	// Defaults to DefaultRecordMaxBytes.
+	RecordMaxBytes int64
+	// RecordMaxFiles is the number of rotated recordings kept. Defaults to
+	// DefaultRecordMaxFiles.
+	RecordMaxFiles int
 }
 
 type Honeycomb struct {
@@ -33,13 +165,134 @@ type Honeycomb struct {
 }
 
 func New(cfg Config) (*Listener, error) {
-	err := libhoney.Init(*cfg.HoneycombConfig)
+	if cfg.ListenAddr == "" {
+		cfg.ListenAddr = DefaultListenAddr
+	}
+	if cfg.ReadTimeout <= 0 {
+		cfg.ReadTimeout = DefaultReadTimeout
+	}
+	if cfg.WriteTimeout <= 0 {
+		cfg.WriteTimeout = DefaultWriteTimeout
+	}
+	if cfg.IdleTimeout <= 0 {
+		cfg.IdleTimeout = DefaultIdleTimeout
+	}
+	if cfg.MaxBodyBytes <= 0 {
+		cfg.MaxBodyBytes = DefaultMaxBodyBytes
+	}
+	if cfg.QueueSize <= 0 {
+		cfg.QueueSize = DefaultQueueSize
+	}
+	if cfg.Workers <= 0 {
+		cfg.Workers = DefaultWorkers
+	}
+	if cfg.DedupTTL <= 0 {
+		cfg.DedupTTL = DefaultDedupTTL
+	}
+	if cfg.DedupSize <= 0 {
+		cfg.DedupSize = DefaultDedupSize
+	}
+	if cfg.RedactEmails == "" {
+		cfg.RedactEmails = DefaultRedactEmails
+	}
+	if cfg.RedactNames == "" {
+		cfg.RedactNames = DefaultRedactNames
+	}
+	if err := validRedactPolicy("email", cfg.RedactEmails); err != nil {
+		return nil, err
+	}
+	if err := validRedactPolicy("name", cfg.RedactNames); err != nil {
+		return nil, err
+	}
+	if cfg.RedactKey == "" && (cfg.RedactEmails == RedactHash || cfg.RedactNames == RedactHash) {
+		key, err := randomRedactKey()
+		if err != nil {
+			return nil, err
+		}
+		cfg.RedactKey = key
+		log.Printf("no redaction key is set, so hashed names and emails will change when restarted")
+	}
+	if cfg.VariablesDeny == nil {
+		cfg.VariablesDeny = DefaultVariablesDeny
+	}
+	variables, err := newVariableFilter(cfg.VariablesAllow, cfg.VariablesDeny, cfg.SecretPatterns)
 	if err != nil {
-		return nil, fmt.Errorf("failed to initialise libhoney: %w", err)
+		return nil, err
+	}
+	switch cfg.Downstream {
+	case "":
+		cfg.Downstream = DefaultDownstream
+	case DownstreamParent, DownstreamLink:
+	default:
+		return nil, fmt.Errorf("unknown downstream mode %q, expected %s or %s", cfg.Downstream, DownstreamParent, DownstreamLink)
 	}
 
 	l := Listener{
-		Config: cfg,
+		Config:    cfg,
+		queue:     make(chan queuedHook, cfg.QueueSize),
+		delivered: newTTLCache[struct{}](cfg.DedupSize, cfg.DedupTTL),
+		sink:      cfg.Sink,
+
+		mergeRequests:  newMergeRequestTracker(),
+		jobs:           newTTLCache[jobRef](jobsTracked, jobTTL),
+		deployments:    newTTLCache[time.Time](deploymentsTracked, deploymentTTL),
+		stages:         newStageTracker(),
+		jobSpans:       newTTLCache[struct{}](jobsTracked, jobTTL),
+		pipelineTraces: newTTLCache[string](pipelinesTracked, pipelineTTL),
+		attempts:       newAttemptTracker(),
+		failures:       newFailureTracker(),
+		variables:      variables,
+	}
+
+	if l.sink == nil {
+		var err error
+		l.sink, err = NewHoneycombSink(HoneycombSinkConfig{
+			Version:           cfg.Version,
+			Debug:             cfg.Debug,
+			HoneycombConfig:   cfg.HoneycombConfig,
+			MaxRetries:        cfg.MaxRetries,
+			DeadLetterPath:    cfg.DeadLetterPath,
+			ReplayDeadLetters: cfg.ReplayDeadLetters,
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if cfg.DeployMarkers {
+		if cfg.HoneycombConfig == nil || cfg.HoneycombConfig.APIKey == "" {
+			return nil, errors.New("deploy markers need a Honeycomb API key")
+		}
+		if len(l.Config.MarkerEnvironments) == 0 {
+			l.Config.MarkerEnvironments = DefaultMarkerEnvironments
+		}
+		l.markers = newMarkerClient(cfg.HoneycombConfig.APIHost, cfg.HoneycombConfig.APIKey, cfg.HoneycombConfig.Dataset)
+	}
+
+	if cfg.GitLab.Enabled() {
+		l.gitlab = newGitLabClient(cfg.GitLab)
+	} else if cfg.JobSections {
+		return nil, errors.New("job sections need a GitLab URL and token")
+	} else if cfg.TestReports {
+		return nil, errors.New("test reports need a GitLab URL and token")
+	}
+
+	if cfg.RecordPath != "" {
+		if cfg.RecordMaxBytes <= 0 {
+			cfg.RecordMaxBytes = DefaultRecordMaxBytes
+		}
+		if cfg.RecordMaxFiles <= 0 {
+			cfg.RecordMaxFiles = DefaultRecordMaxFiles
+		}
+		l.recorder = &recorder{path: cfg.RecordPath, maxBytes: cfg.RecordMaxBytes, maxFiles: cfg.RecordMaxFiles}
+	}
+
+	if cfg.Spool.Enabled() {
+		var err error
+		l.spool, err = spool.Open(cfg.Spool)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open spool: %w", err)
+		}
 	}
 
 	mux := http.NewServeMux()
@@ -50,8 +303,9 @@ func New(cfg Config) (*Listener, error) {
 	srv := &http.Server{
 		Addr:         cfg.ListenAddr,
 		Handler:      mux,
-		ReadTimeout:  5 * time.Second,
-		WriteTimeout: 10 * time.Second,
+		ReadTimeout:  cfg.ReadTimeout,
+		WriteTimeout: cfg.WriteTimeout,
+		IdleTimeout:  cfg.IdleTimeout,
 	}
 
 	l.HTTPServer = srv
@@ -83,178 +337,287 @@ func (l *Listener) Healthz(w http.ResponseWriter, r *http.Request) {
 }
 
 func (l *Listener) HandleRequest(w http.ResponseWriter, r *http.Request) {
+	if l.recorder != nil {
+		var recorded func()
+		w, recorded = l.recordRequest(w, r)
+		defer recorded()
+	}
+
 	eventType := r.Header.Get("X-Gitlab-Event")
 
 	if len(eventType) == 0 {
 		log.Println("failed to find X-Gitlab-Event header")
 		w.WriteHeader(http.StatusBadRequest)
+		return
 	}
 
-	event, err := l.ParseHook(r, eventType)
+	payload, err := l.ReadHook(r)
 	if err != nil {
+		if errors.Is(err, ErrPayloadTooLarge) {
+			log.Printf("rejecting %s: %s", eventType, err)
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			return
+		}
+
 		var parseErr ErrPayloadParse
 		if errors.As(err, &parseErr) {
 			log.Printf("failed to parse payload, dumping received payload: %+v", parseErr.Payload)
 			w.WriteHeader(http.StatusInternalServerError)
+			return
 		}
 
+		log.Printf("death: %s", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	// Parse the payload up front so that GitLab is told about payloads we'll
+	// never be able to process, rather than them failing in a worker.
+	event, err := l.ParsePayload(payload, eventType)
+	if err != nil {
 		log.Printf("death: %s: %+v", err, event)
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
 
-	switch e := event.(type) {
-	case types.PipelineEventPayload:
-		err := l.handlePipeline(e)
-		if err != nil {
-			log.Printf("failed to handle pipeline event: %s", err)
-			w.WriteHeader(http.StatusInternalServerError)
-			return
+	keys := dedupKeys(r, event)
+	if l.markDelivered(keys) {
+		log.Printf("ignoring duplicate %s", eventType)
+		_, respErr := fmt.Fprint(w, "Already received, thanks!\n")
+		if respErr != nil {
+			log.Printf("failed to write duplicate response: %s", respErr)
 		}
-	case types.JobEventPayload:
-		err := l.handleJob(e)
-		if err != nil {
-			log.Printf("failed to handle pipeline event: %s", err)
-			w.WriteHeader(http.StatusInternalServerError)
-			return
-		}
-	default:
-		http.Error(w, fmt.Sprintf("Invalid event type: %T", e), http.StatusBadRequest)
 		return
 	}
 
+	err = l.accept(queuedHook{
+		Event:      eventType,
+		Payload:    payload,
+		ReceivedAt: time.Now(),
+		DedupKeys:  keys,
+	})
+	if err != nil {
+		l.forgetDelivered(keys)
+		log.Printf("failed to enqueue %s: %s", eventType, err)
+		w.Header().Set("Retry-After", queueRetryAfter)
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
 	_, respErr := fmt.Fprint(w, "Thanks!\n")
 	if respErr != nil {
 		log.Printf("failed to write success response: %s", respErr)
 	}
 }
 
-func SendEvent(e *libhoney.Event) {
-	err := e.Send()
-	if err != nil {
-		fmt.Printf("failed to send event: %s", err)
-	}
-}
+func (l *Listener) handlePipeline(p types.PipelineEventPayload, d *delivery) error {
+	l.trackDownstreamPipeline(p)
+	l.trackMergeRequestPipeline(p, d)
 
-func (l *Listener) handlePipeline(p types.PipelineEventPayload) error {
-	if p.ObjectAttributes.Duration == 0 || p.ObjectAttributes.Status == "running" {
+	if !finishedStatuses[p.ObjectAttributes.Status] {
 		return nil
 	}
 
-	traceID := strconv.Itoa(int(p.ObjectAttributes.ID))
-	ev, err := l.createEvent()
-	if err != nil {
-		return err
+	if time.Time(p.ObjectAttributes.CreatedAt).IsZero() {
+		return errors.New("Pipeline.ObjectAttributes.CreatedAt is zero")
 	}
 
-	defer SendEvent(ev)
+	for _, b := range p.Builds {
+		l.attempts.add(p.ObjectAttributes.ID, b.Name, b.ID)
+		l.failures.add(jobEventFromBuild(p, b))
+	}
+
+	duration, started := pipelineTiming(p.ObjectAttributes)
+	traceID := strconv.Itoa(int(p.ObjectAttributes.ID))
 	buildURL := fmt.Sprintf("%s/-/pipelines/%d", p.Project.WebURL, p.ObjectAttributes.ID)
-	err = ev.Add(map[string]interface{}{
+	span := Span{
 		// Basic trace information
-		"service_name":   "pipeline",
-		"trace.span_id":  traceID,
-		"trace.trace_id": traceID,
-		"name":           "build " + traceID,
-
-		// CI information
-		"ci_provider": "GitLab-CI",
-		"branch":      p.ObjectAttributes.Ref,
-		"build_num":   p.ObjectAttributes.ID,
-		"build_url":   buildURL,
-		"pr_number":   p.MergeRequest.IID,
-		"pr_branch":   p.MergeRequest.SourceBranch,
-		// TODO: Replace project Id with SOURCE_PROJECT_PATH
-		"pr_repo": p.MergeRequest.SourceProjectID,
-		"repo":    p.Project.WebURL,
-		// TODO: Something with pipeline status
-		"status": p.ObjectAttributes.Status,
-		"source": p.ObjectAttributes.Source,
-
-		"duration_ms": p.ObjectAttributes.Duration * 1000,
-	})
-	if err != nil {
-		return fmt.Errorf("failed to add fields to event: %w", err)
+		ServiceName: "pipeline",
+		SpanID:      traceID,
+		TraceID:     traceID,
+		Name:        "build " + traceID,
+		Timestamp:   time.Time(p.ObjectAttributes.CreatedAt),
+		Duration:    duration,
+
+		Fields: map[string]interface{}{
+			// CI information
+			"ci_provider": "GitLab-CI",
+			"branch":      p.ObjectAttributes.Ref,
+			"build_num":   p.ObjectAttributes.ID,
+			"build_url":   buildURL,
+			"pr_number":   p.MergeRequest.IID,
+			"pr_branch":   p.MergeRequest.SourceBranch,
+			"pr_repo":     mergeRequestSourcePath(p),
+			"repo":        p.Project.WebURL,
+			// TODO: Something with pipeline status
+			"status":  p.ObjectAttributes.Status,
+			"outcome": outcome(p.ObjectAttributes.Status, started),
+			"source":  p.ObjectAttributes.Source,
+		},
 	}
 
-	if time.Time(p.ObjectAttributes.CreatedAt).IsZero() {
-		return errors.New("Pipeline.ObjectAttributes.CreatedAt is zero")
+	commitTitle := p.Commit.Title
+	if commitTitle == "" {
+		commitTitle = p.Commit.Message
 	}
-	ev.Timestamp = time.Time(p.ObjectAttributes.CreatedAt)
-	log.Printf("%+v\n", ev)
+	sha := p.ObjectAttributes.SHA
+	if sha == "" {
+		sha = p.Commit.ID
+	}
+	l.addCommit(span.Fields, sha, commitTitle, p.Commit.URL, p.Commit.Author.Name, p.Commit.Author.Email, p.Commit.Timestamp)
+	l.addUser(span.Fields, p.User)
+	addMergeRequestContext(p, span.Fields)
+	l.variables.addVariables(p.ObjectAttributes.Variables, span.Fields)
+	l.enrichPipeline(p, span.Fields)
+	l.addPipelineFailure(p, span.Fields)
+	l.linkUpstream(p, &span)
+
+	if l.Config.Debug {
+		log.Printf("pipeline span: %+v", span)
+	}
+	l.emit(span, d)
+	if l.Config.JobsFromPipeline {
+		l.emitBuilds(p, d)
+	}
+	l.emitStages(p, d)
+	l.emitRunnerTags(p, d)
+	l.emitTestReport(p, d)
 	return nil
 }
 
-func (l *Listener) handleJob(j types.JobEventPayload) error {
-	// if j.BuildStatus == "created" || j.BuildStatus == "running" || j.BuildStatus == "pending" {
-	// 	return nil
-	// }
-	if j.BuildDuration == 0 || j.BuildStatus == "running" {
-		return nil
+func (l *Listener) handleJob(j types.JobEventPayload, d *delivery) error {
+	l.rememberJob(j.PipelineID, j.BuildName, j.BuildID)
+
+	// Manual jobs wait to be played, so they're sent as they are, and again
+	// once they've been played and finished.
+	if j.BuildStatus == "manual" {
+		return l.emitJob(j, d)
 	}
-	parentTraceID := fmt.Sprint(j.PipelineID)
-	buildNameWithId := fmt.Sprintf("%s%d", j.BuildName, j.BuildID)
-	md5HashInBytes := md5.Sum([]byte(buildNameWithId))
-	md5HashInString := hex.EncodeToString(md5HashInBytes[:])
-	spanID := md5HashInString
-	ev, err := l.createEvent()
-	if err != nil {
-		return err
+	if !finishedStatuses[j.BuildStatus] {
+		return nil
 	}
 
-	defer SendEvent(ev)
-	err = ev.Add(map[string]interface{}{
-		// Basic trace information
-		"service_name":    "job",
-		"trace.span_id":   spanID,
-		"trace.trace_id":  parentTraceID,
-		"trace.parent_id": parentTraceID,
-		"name":            j.BuildName,
-
-		// CI information
-		"ci_provider": "GitLab-CI",
-		"branch":      j.Ref,
-		"build_num":   j.PipelineID,
-		"build_id":    j.BuildID,
-		"repo":        j.Repository.Homepage,
-		// TODO: Something with job status
-		"status":              j.BuildStatus,
-		"queued_duration_ms":  j.BuildQueuedDuration * 1000,
-		"queued_duration_min": j.BuildQueuedDuration / 60,
-
-		// Runner information
-		"ci_runner":    j.Runner.Description,
-		"ci_runner_id": j.Runner.ID,
-		// "ci_runner_tags": strings.Join(j.Runner.Tags, ","),
-
-		"duration_ms": j.BuildDuration * 1000,
-	})
+	err := l.emitJob(j, d)
 	if err != nil {
-		return fmt.Errorf("failed to add fields to event: %w", err)
-	}
-
-	if time.Time(j.BuildStartedAt).IsZero() {
-		return errors.New("BuildStartedAt time is not set")
+		return err
 	}
-
-	ev.Timestamp = time.Time(j.BuildStartedAt)
+	l.emitSections(j, d)
 	return nil
 }
 
-func (l *Listener) createEvent() (*libhoney.Event, error) {
-	libhoney.UserAgentAddition = fmt.Sprintf("buildevents/%s", l.Config.Version)
-	libhoney.UserAgentAddition += fmt.Sprintf(" (%s)", "GitLab-CI")
+// emitJob sends the spans of a finished job, unless they've already been sent
+// for another webhook about it.
+func (l *Listener) emitJob(j types.JobEventPayload, d *delivery) error {
+	start, duration, started := jobTiming(j)
+	if start.IsZero() {
+		return errors.New("job has no created, started or finished time")
+	}
+
+	l.stages.addJob(j.PipelineID, j.BuildStage, j.BuildID, jobWindowOf(j))
+	l.failures.add(j)
 
-	if l.Config.HoneycombConfig.APIKey == "" {
-		l.Config.HoneycombConfig.Transmission = &transmission.WriterSender{}
+	// A manual job that was never played gets a span of its own, so that the
+	// job's real span is still sent if it's played later.
+	spanID := jobSpanID(j.BuildName, j.BuildID)
+	dedupKey := fmt.Sprint(j.BuildID)
+	if j.BuildStatus == "manual" {
+		spanID += "-manual"
+		dedupKey = "manual:" + dedupKey
+	}
+	if !l.jobSpans.Add(dedupKey, struct{}{}) {
+		return nil
 	}
 
-	ev := libhoney.NewEvent()
-	ev.AddField("ci_provider", "GitLab-CI")
-	ev.AddField("meta.version", l.Config.Version)
+	parentTraceID := l.pipelineTraceID(j.PipelineID)
+	span := Span{
+		// Basic trace information
+		ServiceName: "job",
+		SpanID:      spanID,
+		TraceID:     parentTraceID,
+		ParentID:    jobParentID(j.PipelineID, j.BuildStage),
+		Name:        j.BuildName,
+		Timestamp:   start,
+		Duration:    duration,
+
+		Fields: map[string]interface{}{
+			// CI information
+			"ci_provider": "GitLab-CI",
+			"branch":      j.Ref,
+			"build_num":   j.PipelineID,
+			"build_id":    j.BuildID,
+			"stage":       j.BuildStage,
+			"repo":        j.Repository.Homepage,
+			// TODO: Something with job status
+			"status":              j.BuildStatus,
+			"outcome":             outcome(j.BuildStatus, started),
+			"queued_duration_ms":  j.BuildQueuedDuration * 1000,
+			"queued_duration_min": j.BuildQueuedDuration / 60,
+
+			// Runner information
+			"ci_runner":        j.Runner.Description,
+			"ci_runner_id":     j.Runner.ID,
+			"ci_runner_tags":   strings.Join(j.Runner.Tags, ","),
+			"ci_runner_type":   runnerType(j.Runner),
+			"ci_runner_shared": j.Runner.IsShared,
+			"ci_runner_active": j.Runner.Active,
+		},
+	}
+	sha := j.SHA
+	if sha == "" {
+		sha = j.Commit.SHA
+	}
+	l.addCommit(span.Fields, sha, j.Commit.Message, "", j.Commit.AuthorName, j.Commit.AuthorEmail, time.Time{})
+	l.addUser(span.Fields, j.User)
+	addFailure(j, span.Fields)
+	l.enrichJob(j, span.Fields)
+	l.addAttempt(j, &span)
+
+	l.emit(span, d)
+
+	// Waiting for a runner gets a span of its own, from when the job was
+	// created until it started, so runner starvation shows in the waterfall.
+	// It's a sibling before the job's span, as a child can't start before
+	// its parent.
+	if started && j.BuildQueuedDuration > 0 {
+		queued := time.Duration(j.BuildQueuedDuration * float64(time.Second))
+		l.emit(Span{
+			ServiceName: "job",
+			SpanID:      spanID + "-queued",
+			TraceID:     parentTraceID,
+			ParentID:    span.ParentID,
+			Name:        "queued",
+			Timestamp:   span.Timestamp.Add(-queued),
+			Duration:    queued,
+
+			Fields: map[string]interface{}{
+				"ci_provider":        "GitLab-CI",
+				"branch":             j.Ref,
+				"build_num":          j.PipelineID,
+				"build_id":           j.BuildID,
+				"job_name":           j.BuildName,
+				"stage":              j.BuildStage,
+				"repo":               j.Repository.Homepage,
+				"queued_duration_ms": j.BuildQueuedDuration * 1000,
+
+				// Runner information
+				"ci_runner":        j.Runner.Description,
+				"ci_runner_id":     j.Runner.ID,
+				"ci_runner_tags":   strings.Join(j.Runner.Tags, ","),
+				"ci_runner_type":   runnerType(j.Runner),
+				"ci_runner_shared": j.Runner.IsShared,
+			},
+		}, d)
+	}
 
-	return ev, nil
+	return nil
 }
 
+// ListenAndServe starts the worker pool and the HTTP server.
 func (l *Listener) ListenAndServe() error {
+	err := l.Start()
+	if err != nil {
+		return err
+	}
 	return l.HTTPServer.ListenAndServe()
 }
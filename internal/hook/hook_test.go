@@ -1,9 +1,22 @@
 package hook
 
 import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/honeycombio/libhoney-go"
+	"github.com/honeycombio/libhoney-go/transmission"
+	"github.com/zoidyzoidzoid/gitlab-honeycomb-buildevents-webhooks-sink/internal/hook/types"
+	"github.com/zoidyzoidzoid/gitlab-honeycomb-buildevents-webhooks-sink/internal/spool"
 )
 
 func Test_createEvent(t *testing.T) {
@@ -23,7 +36,7 @@ func Test_createEvent(t *testing.T) {
 		if err != nil {
 			t.Errorf("failed to create config: %s", err)
 		}
-		got, err := l.createEvent()
+		got, err := l.sink.(*HoneycombSink).createEvent()
 		if err != nil {
 			t.Errorf("failed to create event: %s", err)
 		}
@@ -39,47 +52,637 @@ func Test_createEvent(t *testing.T) {
 	})
 }
 
-// func Test_HandlePipeline(t *testing.T) {
-//	defer libhoney.Close()
-//	var config libhoney.Config
-//	tests := []struct {
-//		name     string
-//		pipeline gitlab.PipelineEventPayload
-//		want     *libhoney.Event
-//		wantErr  bool
-//	}{
-//		// TODO: Add test cases.
-//		{
-//			name: "created pipeline doesn't create an event",
-//			pipeline: Pipeline{
-//				ObjectAttributes: PipelineObjectAttributes{
-//					Status: "created",
-//				},
-//			},
-//			want:    nil,
-//			wantErr: false,
-//		},
-//		{
-//			name: "running pipeline doesn't create an event",
-//			pipeline: Pipeline{
-//				ObjectAttributes: PipelineObjectAttributes{
-//					Status: "running",
-//				},
-//			},
-//			want:    nil,
-//			wantErr: false,
-//		},
-//	}
-//	for _, tt := range tests {
-//		t.Run(tt.name, func(t *testing.T) {
-//			got, err := createTraceFromPipeline(&config, tt.pipeline)
-//			if (err != nil) != tt.wantErr {
-//				t.Errorf("createTraceFromPipeline() error = %v, wantErr %v", err, tt.wantErr)
-//				return
-//			}
-//			if !reflect.DeepEqual(got, tt.want) {
-//				t.Errorf("createTraceFromPipeline() = %v, want %v", got, tt.want)
-//			}
-//		})
-//	}
-//}
+func sendJobHook(l *Listener, payload string, uuid string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/api/message", strings.NewReader(payload))
+	req.Header.Set("X-Gitlab-Event", JobEvents)
+	if uuid != "" {
+		req.Header.Set("X-Gitlab-Event-UUID", uuid)
+	}
+	w := httptest.NewRecorder()
+	l.HandleRequest(w, req)
+	return w
+}
+
+func Test_HandleRequestQueue(t *testing.T) {
+	defer libhoney.Close()
+	var config libhoney.Config
+	l, err := New(Config{
+		Version:         "dev",
+		ListenAddr:      ":8080",
+		HoneycombConfig: &config,
+		QueueSize:       1,
+	})
+	if err != nil {
+		t.Fatalf("failed to create listener: %s", err)
+	}
+
+	// Workers aren't started, so the first webhook fills the queue.
+	if got := sendJobHook(l, `{"object_kind": "build", "build_id": 1}`, ""); got.Code != http.StatusAccepted {
+		t.Errorf("first request status = %d, want %d", got.Code, http.StatusAccepted)
+	}
+	got := sendJobHook(l, `{"object_kind": "build", "build_id": 2}`, "")
+	if got.Code != http.StatusServiceUnavailable {
+		t.Errorf("second request status = %d, want %d", got.Code, http.StatusServiceUnavailable)
+	}
+	if got.Header().Get("Retry-After") == "" {
+		t.Errorf("second request is missing Retry-After header")
+	}
+}
+
+func Test_replaySpool(t *testing.T) {
+	cfg := Config{Version: "dev", Sink: &MemorySink{}, Spool: spool.Config{Dir: t.TempDir()}}
+	l, err := New(cfg)
+	if err != nil {
+		t.Fatalf("failed to create listener: %s", err)
+	}
+	// Workers aren't started, so the webhooks are left in the spool.
+	for i := 1; i <= 3; i++ {
+		payload := fmt.Sprintf(`{"object_kind": "build", "build_id": %d, "build_name": "unit", "build_status": "success", "build_started_at": "2022-10-17 14:44:20 UTC", "build_duration": 60}`, i)
+		if got := sendJobHook(l, payload, ""); got.Code != http.StatusAccepted {
+			t.Fatalf("status = %d, want %d", got.Code, http.StatusAccepted)
+		}
+	}
+	l.spool.Close()
+
+	// Shutting down while the spool is replayed into a full queue stops the
+	// replay, and leaves the rest in the spool.
+	sink := &MemorySink{}
+	cfg.Sink, cfg.QueueSize, cfg.Workers = sink, 1, 1
+	l, err = New(cfg)
+	if err != nil {
+		t.Fatalf("failed to create listener: %s", err)
+	}
+	l.Start()
+	err = l.Shutdown(context.Background())
+	if err != nil {
+		t.Fatalf("Shutdown() error = %s", err)
+	}
+
+	// The next start replays the rest.
+	l, err = New(Config{Version: "dev", Sink: sink, Spool: cfg.Spool})
+	if err != nil {
+		t.Fatalf("failed to create listener: %s", err)
+	}
+	l.Start()
+	l.replaying.Wait()
+	err = l.Shutdown(context.Background())
+	if err != nil {
+		t.Fatalf("Shutdown() error = %s", err)
+	}
+	if got := len(sink.Spans()); got != 3 {
+		t.Errorf("sent %d spans, want each spooled webhook's span once", got)
+	}
+}
+
+func Test_HandleRequestDedup(t *testing.T) {
+	defer libhoney.Close()
+	var config libhoney.Config
+	l, err := New(Config{
+		Version:         "dev",
+		ListenAddr:      ":8080",
+		HoneycombConfig: &config,
+	})
+	if err != nil {
+		t.Fatalf("failed to create listener: %s", err)
+	}
+
+	tests := []struct {
+		name     string
+		payload  string
+		uuid     string
+		wantCode int
+	}{
+		{"first delivery", `{"object_kind": "build", "build_id": 1, "build_status": "success"}`, "a", http.StatusAccepted},
+		{"retry with same uuid", `{"object_kind": "build", "build_id": 1, "build_status": "success"}`, "a", http.StatusOK},
+		{"redelivery with new uuid", `{"object_kind": "build", "build_id": 1, "build_status": "success"}`, "b", http.StatusOK},
+		{"new status", `{"object_kind": "build", "build_id": 1, "build_status": "failed"}`, "c", http.StatusAccepted},
+		{"no uuid", `{"object_kind": "build", "build_id": 2, "build_status": "success"}`, "", http.StatusAccepted},
+		{"no uuid redelivery", `{"object_kind": "build", "build_id": 2, "build_status": "success"}`, "", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := sendJobHook(l, tt.payload, tt.uuid); got.Code != tt.wantCode {
+				t.Errorf("status = %d, want %d", got.Code, tt.wantCode)
+			}
+		})
+	}
+}
+
+func Test_HandleRequestDedupFailed(t *testing.T) {
+	l, err := New(Config{Version: "dev", Sink: &MemorySink{}})
+	if err != nil {
+		t.Fatalf("failed to create listener: %s", err)
+	}
+	l.Start()
+
+	// A job without any times can't be processed, so it's forgotten, and
+	// GitLab's retry of it isn't ignored.
+	payload := `{"object_kind": "build", "build_id": 1, "build_status": "success"}`
+	if got := sendJobHook(l, payload, "a"); got.Code != http.StatusAccepted {
+		t.Fatalf("status = %d, want %d", got.Code, http.StatusAccepted)
+	}
+	err = l.Shutdown(context.Background())
+	if err != nil {
+		t.Fatalf("Shutdown() error = %s", err)
+	}
+
+	for _, key := range []string{"uuid:a", "build:1:success:" + fmt.Sprint(time.Time{}.Unix())} {
+		if _, ok := l.delivered.Get(key); ok {
+			t.Errorf("delivery key %s is remembered, want it forgotten after failing", key)
+		}
+	}
+}
+
+func Test_HandleRequestTooLarge(t *testing.T) {
+	l, err := New(Config{Version: "dev", Sink: &MemorySink{}, MaxBodyBytes: 64})
+	if err != nil {
+		t.Fatalf("failed to create listener: %s", err)
+	}
+
+	small := `{"object_kind": "build", "build_id": 1}`
+	if got := sendJobHook(l, small, ""); got.Code != http.StatusAccepted {
+		t.Errorf("status = %d, want %d", got.Code, http.StatusAccepted)
+	}
+	large := `{"object_kind": "build", "build_id": 2, "build_name": "` + strings.Repeat("x", 64) + `"}`
+	if got := sendJobHook(l, large, ""); got.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("status = %d, want %d", got.Code, http.StatusRequestEntityTooLarge)
+	}
+}
+
+func Test_consumeResponses(t *testing.T) {
+	defer libhoney.Close()
+	var config libhoney.Config
+	deadLetterPath := filepath.Join(t.TempDir(), "dead-letters.jsonl")
+	s, err := NewHoneycombSink(HoneycombSinkConfig{
+		Version:         "dev",
+		HoneycombConfig: &config,
+		DeadLetterPath:  deadLetterPath,
+	})
+	if err != nil {
+		t.Fatalf("failed to create sink: %s", err)
+	}
+
+	var done int
+	d := newDelivery(func() { done++ })
+	ok := &eventMetadata{Fields: map[string]interface{}{"name": "ok"}, Attempt: 1, done: d.finish}
+	rejected := &eventMetadata{Fields: map[string]interface{}{"name": "rejected"}, Attempt: 1, done: d.finish}
+	d.add()
+	d.add()
+
+	responses := make(chan transmission.Response, 2)
+	responses <- transmission.Response{StatusCode: http.StatusAccepted, Metadata: ok}
+	responses <- transmission.Response{StatusCode: http.StatusBadRequest, Body: []byte("bad"), Metadata: rejected}
+	close(responses)
+	s.consumeResponses(responses)
+	d.finish()
+
+	if done != 1 {
+		t.Errorf("delivery done called %d times, want 1", done)
+	}
+
+	contents, err := os.ReadFile(deadLetterPath)
+	if err != nil {
+		t.Fatalf("failed to read dead letters: %s", err)
+	}
+	var dl deadLetter
+	err = json.Unmarshal(contents, &dl)
+	if err != nil {
+		t.Fatalf("failed to parse dead letter: %s", err)
+	}
+	if dl.Fields["name"] != "rejected" || dl.StatusCode != http.StatusBadRequest {
+		t.Errorf("dead letter = %+v, want the rejected event", dl)
+	}
+}
+
+func Test_retryAfterClose(t *testing.T) {
+	deadLetterPath := filepath.Join(t.TempDir(), "dead-letters.jsonl")
+	s := &HoneycombSink{deadLetters: &deadLetterFile{path: deadLetterPath}}
+	s.stopped.Store(true)
+
+	// A retry that comes due once the sink is closed is dead-lettered, and
+	// its webhook acknowledged.
+	var done int
+	s.retry(&eventMetadata{Fields: map[string]interface{}{"name": "retried"}, Attempt: 2, done: func() { done++ }})
+	if done != 1 {
+		t.Errorf("done called %d times, want 1", done)
+	}
+
+	contents, err := os.ReadFile(deadLetterPath)
+	if err != nil {
+		t.Fatalf("failed to read dead letters: %s", err)
+	}
+	var dl deadLetter
+	err = json.Unmarshal(contents, &dl)
+	if err != nil {
+		t.Fatalf("failed to parse dead letter: %s", err)
+	}
+	if dl.Fields["name"] != "retried" || dl.Attempts != 2 {
+		t.Errorf("dead letter = %+v, want the retried event", dl)
+	}
+}
+
+func Test_handlePipeline(t *testing.T) {
+	tests := []struct {
+		name     string
+		pipeline types.PipelineEventPayload
+		want     []Span
+		wantErr  bool
+	}{
+		{
+			name: "created pipeline doesn't create an event",
+			pipeline: types.PipelineEventPayload{
+				ObjectAttributes: types.PipelineObjectAttributes{
+					Status: "created",
+				},
+			},
+			want: nil,
+		},
+		{
+			name: "running pipeline doesn't create an event",
+			pipeline: types.PipelineEventPayload{
+				ObjectAttributes: types.PipelineObjectAttributes{
+					Status:   "running",
+					Duration: 10,
+				},
+			},
+			want: nil,
+		},
+		{
+			name: "finished pipeline creates a root span",
+			pipeline: types.PipelineEventPayload{
+				Project: types.Project{WebURL: "https://gitlab.com/group/project"},
+				ObjectAttributes: types.PipelineObjectAttributes{
+					ID:        42,
+					Ref:       "main",
+					Status:    "success",
+					Source:    "push",
+					CreatedAt: types.GitLabTimestamp(time.Date(2022, 10, 17, 14, 44, 20, 0, time.UTC)),
+					Duration:  82,
+				},
+			},
+			want: []Span{{
+				TraceID:     "42",
+				SpanID:      "42",
+				Name:        "build 42",
+				ServiceName: "pipeline",
+				Timestamp:   time.Date(2022, 10, 17, 14, 44, 20, 0, time.UTC),
+				Duration:    82 * time.Second,
+				Fields: map[string]interface{}{
+					"ci_provider": "GitLab-CI",
+					"branch":      "main",
+					"build_num":   int64(42),
+					"build_url":   "https://gitlab.com/group/project/-/pipelines/42",
+					"pr_number":   int64(0),
+					"pr_branch":   "",
+					"pr_repo":     "",
+					"repo":        "https://gitlab.com/group/project",
+					"status":      "success",
+					"outcome":     "success",
+					"source":      "push",
+					"error":       false,
+
+					"pipeline_type": "branch",
+					"merge_train":   false,
+				},
+			}},
+		},
+		{
+			name: "pipeline canceled before it started creates a zero-length span",
+			pipeline: types.PipelineEventPayload{
+				ObjectAttributes: types.PipelineObjectAttributes{
+					ID:        43,
+					Status:    "canceled",
+					CreatedAt: types.GitLabTimestamp(time.Date(2022, 10, 17, 14, 44, 20, 0, time.UTC)),
+				},
+			},
+			want: []Span{{
+				TraceID:     "43",
+				SpanID:      "43",
+				Name:        "build 43",
+				ServiceName: "pipeline",
+				Timestamp:   time.Date(2022, 10, 17, 14, 44, 20, 0, time.UTC),
+				Fields: map[string]interface{}{
+					"ci_provider": "GitLab-CI",
+					"branch":      "",
+					"build_num":   int64(43),
+					"build_url":   "/-/pipelines/43",
+					"pr_number":   int64(0),
+					"pr_branch":   "",
+					"pr_repo":     "",
+					"repo":        "",
+					"status":      "canceled",
+					"outcome":     "canceled_before_start",
+					"source":      "",
+					"error":       false,
+
+					"pipeline_type": "branch",
+					"merge_train":   false,
+				},
+			}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sink := &MemorySink{}
+			l, err := New(Config{Version: "dev", Sink: sink})
+			if err != nil {
+				t.Fatalf("failed to create listener: %s", err)
+			}
+			err = l.handlePipeline(tt.pipeline, nil)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("handlePipeline() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if got := sink.Spans(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("handlePipeline() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_handleJobQueued(t *testing.T) {
+	sink := &MemorySink{}
+	l, err := New(Config{Version: "dev", Sink: sink})
+	if err != nil {
+		t.Fatalf("failed to create listener: %s", err)
+	}
+
+	started := time.Date(2022, 10, 17, 14, 44, 20, 0, time.UTC)
+	err = l.handleJob(types.JobEventPayload{
+		BuildID:             1501730157,
+		BuildName:           "compile",
+		BuildStage:          "build",
+		BuildStatus:         "success",
+		BuildStartedAt:      types.GitLabTimestamp(started),
+		BuildDuration:       39,
+		BuildQueuedDuration: 12.5,
+		PipelineID:          42,
+		Runner:              types.Runner{ID: 7, Description: "shared-runner", IsShared: true},
+	}, nil)
+	if err != nil {
+		t.Fatalf("failed to handle job: %s", err)
+	}
+
+	spans := sink.Spans()
+	if len(spans) != 2 {
+		t.Fatalf("sent %d spans, want the job and its queued span", len(spans))
+	}
+	job, queued := spans[0], spans[1]
+	if queued.ParentID != job.ParentID || queued.TraceID != "42" || queued.Name != "queued" {
+		t.Errorf("queued span = %+v, want a sibling of the job span %s", queued, job.SpanID)
+	}
+	if want := started.Add(-12500 * time.Millisecond); !queued.Timestamp.Equal(want) || queued.Duration != 12500*time.Millisecond {
+		t.Errorf("queued span = %s for %s, want %s for 12.5s", queued.Timestamp, queued.Duration, want)
+	}
+	if queued.Fields["ci_runner"] != "shared-runner" || queued.Fields["ci_runner_shared"] != true {
+		t.Errorf("queued span fields = %v, want the runner", queued.Fields)
+	}
+}
+
+func Test_emitBuilds(t *testing.T) {
+	sink := &MemorySink{}
+	l, err := New(Config{Version: "dev", Sink: sink, JobsFromPipeline: true})
+	if err != nil {
+		t.Fatalf("failed to create listener: %s", err)
+	}
+
+	created := time.Date(2022, 10, 17, 14, 0, 0, 0, time.UTC)
+	at := func(d time.Duration) types.GitLabTimestamp { return types.GitLabTimestamp(created.Add(d)) }
+
+	err = l.handleJob(types.JobEventPayload{
+		BuildID:         2,
+		BuildName:       "unit",
+		BuildStage:      "test",
+		BuildStatus:     "success",
+		BuildStartedAt:  at(time.Minute),
+		BuildFinishedAt: at(3 * time.Minute),
+		BuildDuration:   120,
+		PipelineID:      42,
+	}, nil)
+	if err != nil {
+		t.Fatalf("failed to handle job: %s", err)
+	}
+
+	err = l.handlePipeline(types.PipelineEventPayload{
+		Project: types.Project{WebURL: "https://gitlab.com/group/project"},
+		ObjectAttributes: types.PipelineObjectAttributes{
+			ID:        42,
+			Status:    "success",
+			Stages:    []string{"build", "test"},
+			CreatedAt: types.GitLabTimestamp(created),
+			Duration:  180,
+		},
+		Builds: []types.Build{
+			// Builds are created with their pipeline, so GitLab's durations
+			// are used rather than the time since then.
+			{ID: 1, Stage: "build", Name: "compile", Status: "success", CreatedAt: at(0), StartedAt: at(10 * time.Second), FinishedAt: at(time.Minute), Duration: 45, QueuedDuration: 2},
+			{ID: 2, Stage: "test", Name: "unit", Status: "success", CreatedAt: at(0), StartedAt: at(time.Minute), FinishedAt: at(3 * time.Minute)},
+			{ID: 3, Stage: "deploy", Name: "release", Status: "manual", CreatedAt: at(0)},
+		},
+	}, nil)
+	if err != nil {
+		t.Fatalf("failed to handle pipeline: %s", err)
+	}
+
+	jobs := make(map[string]int)
+	for _, span := range sink.Spans() {
+		if span.SpanID == jobSpanID("compile", 1)+"-queued" && span.Duration != 2*time.Second {
+			t.Errorf("compile queued span = %+v, want 2s", span)
+		}
+		if span.ServiceName != "job" || span.Name == "queued" {
+			continue
+		}
+		jobs[span.SpanID]++
+		if span.SpanID == jobSpanID("compile", 1) {
+			if span.ParentID != stageSpanID(42, "build") || span.Duration != 45*time.Second {
+				t.Errorf("compile span = %+v, want 45s under the build stage", span)
+			}
+			if span.Fields["queued_duration_ms"] != 2000.0 {
+				t.Errorf("compile queued_duration_ms = %v, want 2000", span.Fields["queued_duration_ms"])
+			}
+			if span.Fields["repo"] != "https://gitlab.com/group/project" {
+				t.Errorf("compile span repo = %v, want the project", span.Fields["repo"])
+			}
+		}
+	}
+
+	want := map[string]int{jobSpanID("compile", 1): 1, jobSpanID("unit", 2): 1, jobSpanID("release", 3) + "-manual": 1}
+	if !reflect.DeepEqual(jobs, want) {
+		t.Errorf("job spans = %v, want %v", jobs, want)
+	}
+}
+
+func Test_handleJobAttempts(t *testing.T) {
+	sink := &MemorySink{}
+	l, err := New(Config{Version: "dev", Sink: sink})
+	if err != nil {
+		t.Fatalf("failed to create listener: %s", err)
+	}
+
+	started := time.Date(2022, 10, 17, 14, 0, 0, 0, time.UTC)
+	job := types.JobEventPayload{
+		BuildName:      "flaky",
+		BuildStartedAt: types.GitLabTimestamp(started),
+		PipelineID:     42,
+	}
+	for _, attempt := range []struct {
+		id       int64
+		status   string
+		duration float64
+		retries  int
+	}{{10, "failed", 30, 0}, {11, "pending", 0, 1}, {11, "success", 30, 1}} {
+		job.BuildID, job.BuildStatus, job.BuildDuration, job.RetriesCount = attempt.id, attempt.status, attempt.duration, attempt.retries
+		err = l.handleJob(job, nil)
+		if err != nil {
+			t.Fatalf("failed to handle job %d: %s", attempt.id, err)
+		}
+	}
+
+	spans := sink.Spans()
+	if len(spans) != 2 {
+		t.Fatalf("sent %d spans, want both attempts", len(spans))
+	}
+	first, retry := spans[0], spans[1]
+	if retry.Fields["status"] != "success" {
+		t.Fatalf("second span status = %v, want the successful retry", retry.Fields["status"])
+	}
+	if first.Fields["attempt"] != 1 || first.Fields["retried"] != false {
+		t.Errorf("first attempt fields = %v, want attempt 1", first.Fields)
+	}
+	if retry.Fields["attempt"] != 2 || retry.Fields["retried"] != true || retry.Fields["previous_build_id"] != int64(10) {
+		t.Errorf("retry fields = %v, want attempt 2 retrying build 10", retry.Fields)
+	}
+	if want := []SpanLink{{TraceID: "42", SpanID: first.SpanID}}; !reflect.DeepEqual(retry.Links, want) {
+		t.Errorf("retry links = %v, want %v", retry.Links, want)
+	}
+
+	// After a restart, the earlier attempts haven't been seen, but the Job
+	// Hook still says how many there were.
+	sink = &MemorySink{}
+	l, err = New(Config{Version: "dev", Sink: sink})
+	if err != nil {
+		t.Fatalf("failed to create listener: %s", err)
+	}
+	job.BuildID, job.BuildStatus, job.RetriesCount = 12, "success", 2
+	err = l.handleJob(job, nil)
+	if err != nil {
+		t.Fatalf("failed to handle job: %s", err)
+	}
+	if spans := sink.Spans(); len(spans) != 1 || spans[0].Fields["attempt"] != 3 || spans[0].Fields["retried"] != true {
+		t.Errorf("spans after restart = %+v, want attempt 3", spans)
+	}
+}
+
+func Test_handleJobOutcomes(t *testing.T) {
+	created := time.Date(2022, 10, 17, 14, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name         string
+		job          types.JobEventPayload
+		wantOutcome  string
+		wantStart    time.Time
+		wantDuration time.Duration
+	}{
+		{
+			name: "runner failure before the job started",
+			job: types.JobEventPayload{
+				BuildStatus:     "failed",
+				BuildCreatedAt:  types.GitLabTimestamp(created),
+				BuildFinishedAt: types.GitLabTimestamp(created.Add(time.Minute)),
+			},
+			wantOutcome:  "failed_before_start",
+			wantStart:    created,
+			wantDuration: time.Minute,
+		},
+		{
+			name: "canceled while pending",
+			job: types.JobEventPayload{
+				BuildStatus:    "canceled",
+				BuildCreatedAt: types.GitLabTimestamp(created),
+			},
+			wantOutcome: "canceled_before_start",
+			wantStart:   created,
+		},
+		{
+			name: "skipped",
+			job: types.JobEventPayload{
+				BuildStatus:    "skipped",
+				BuildCreatedAt: types.GitLabTimestamp(created),
+			},
+			wantOutcome: "skipped",
+			wantStart:   created,
+		},
+		{
+			name: "manual",
+			job: types.JobEventPayload{
+				BuildStatus:    "manual",
+				BuildCreatedAt: types.GitLabTimestamp(created),
+			},
+			wantOutcome: "manual",
+			wantStart:   created,
+		},
+		{
+			name: "zero-length success",
+			job: types.JobEventPayload{
+				BuildStatus:    "success",
+				BuildStartedAt: types.GitLabTimestamp(created),
+			},
+			wantOutcome: "success",
+			wantStart:   created,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sink := &MemorySink{}
+			l, err := New(Config{Version: "dev", Sink: sink})
+			if err != nil {
+				t.Fatalf("failed to create listener: %s", err)
+			}
+
+			tt.job.BuildID, tt.job.BuildName, tt.job.PipelineID = 1, "job", 42
+			err = l.handleJob(tt.job, nil)
+			if err != nil {
+				t.Fatalf("failed to handle job: %s", err)
+			}
+
+			spans := sink.Spans()
+			if len(spans) != 1 {
+				t.Fatalf("sent %d spans, want 1", len(spans))
+			}
+			got := spans[0]
+			if got.Fields["outcome"] != tt.wantOutcome {
+				t.Errorf("outcome = %v, want %s", got.Fields["outcome"], tt.wantOutcome)
+			}
+			if !got.Timestamp.Equal(tt.wantStart) || got.Duration != tt.wantDuration {
+				t.Errorf("span = %s for %s, want %s for %s", got.Timestamp, got.Duration, tt.wantStart, tt.wantDuration)
+			}
+		})
+	}
+}
+
+func Test_ReadHookToken(t *testing.T) {
+	tests := []struct {
+		secret  string
+		token   string
+		wantErr error
+	}{
+		{"", "", nil},
+		// Without a secret, tokens aren't checked.
+		{"", "anything", nil},
+		{"secret", "secret", nil},
+		{"secret", "wrong", ErrGitLabTokenVerificationFailed},
+		{"secret", "", ErrGitLabTokenVerificationFailed},
+	}
+	for _, tt := range tests {
+		l, err := New(Config{Version: "dev", Sink: &MemorySink{}, HookSecret: tt.secret})
+		if err != nil {
+			t.Fatalf("failed to create listener: %s", err)
+		}
+
+		req := httptest.NewRequest(http.MethodPost, "/api/message", strings.NewReader("{}"))
+		req.Header.Set("X-Gitlab-Token", tt.token)
+		_, err = l.ReadHook(req)
+		if err != tt.wantErr {
+			t.Errorf("ReadHook() with secret %q and token %q error = %v, want %v", tt.secret, tt.token, err, tt.wantErr)
+		}
+	}
+}
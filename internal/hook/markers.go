@@ -0,0 +1,116 @@
+package hook
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// marker is a Honeycomb marker, as accepted by the Markers API.
+type marker struct {
+	Message   string `json:"message"`
+	Type      string `json:"type"`
+	URL       string `json:"url,omitempty"`
+	StartTime int64  `json:"start_time"`
+}
+
+// markerClient creates markers with Honeycomb's Markers API.
+type markerClient struct {
+	apiHost string
+	apiKey  string
+	dataset string
+	client  *http.Client
+}
+
+func newMarkerClient(apiHost, apiKey, dataset string) *markerClient {
+	return &markerClient{
+		apiHost: strings.TrimSuffix(apiHost, "/"),
+		apiKey:  apiKey,
+		dataset: dataset,
+		client:  &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// url returns the Markers API URL of the client's dataset.
+func (c *markerClient) url() string {
+	return fmt.Sprintf("%s/1/markers/%s", c.apiHost, url.PathEscape(c.dataset))
+}
+
+// create adds m to the client's dataset.
+func (c *markerClient) create(ctx context.Context, m marker) error {
+	body, err := json.Marshal(m)
+	if err != nil {
+		return fmt.Errorf("failed to encode marker: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Honeycomb-Team", c.apiKey)
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to create marker: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return fmt.Errorf("failed to create marker: %d %s: %s", resp.StatusCode, http.StatusText(resp.StatusCode), respBody)
+	}
+
+	return nil
+}
+
+// list returns the markers in the client's dataset.
+func (c *markerClient) list(ctx context.Context) ([]marker, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.url(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Honeycomb-Team", c.apiKey)
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list markers: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return nil, fmt.Errorf("failed to list markers: %d %s: %s", resp.StatusCode, http.StatusText(resp.StatusCode), respBody)
+	}
+
+	var markers []marker
+	err = json.NewDecoder(resp.Body).Decode(&markers)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode markers: %w", err)
+	}
+	return markers, nil
+}
+
+// createOnce adds m to the client's dataset, unless there's already a marker
+// with its message. Messages identify what a marker is for, so replaying a
+// webhook, which isn't known to be a duplicate after a restart, doesn't
+// create another marker.
+func (c *markerClient) createOnce(ctx context.Context, m marker) error {
+	markers, err := c.list(ctx)
+	if err != nil {
+		return err
+	}
+	for _, existing := range markers {
+		if existing.Message == m.Message {
+			return nil
+		}
+	}
+
+	return c.create(ctx, m)
+}
@@ -0,0 +1,303 @@
+package hook
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zoidyzoidzoid/gitlab-honeycomb-buildevents-webhooks-sink/internal/hook/types"
+)
+
+const (
+	// mergeRequestsTracked is the maximum number of open merge requests
+	// whose pipelines are remembered.
+	mergeRequestsTracked = 10000
+	// mergeRequestTTL is how long an inactive merge request is remembered.
+	mergeRequestTTL = 30 * 24 * time.Hour
+)
+
+// mergeRequestState is what's remembered about an open merge request, to
+// summarise its pipelines when it's merged or closed.
+type mergeRequestState struct {
+	FirstPipelineAt time.Time
+	Pipelines       map[int64]struct{}
+	// Reopened is the number of times the merge request was reopened after
+	// being closed.
+	Reopened int
+}
+
+// mergeRequestTracker remembers the pipelines run for open merge requests.
+type mergeRequestTracker struct {
+	mu     sync.Mutex
+	states *ttlCache[*mergeRequestState]
+}
+
+func newMergeRequestTracker() *mergeRequestTracker {
+	return &mergeRequestTracker{
+		states: newTTLCache[*mergeRequestState](mergeRequestsTracked, mergeRequestTTL),
+	}
+}
+
+// update changes what's remembered about a merge request.
+func (t *mergeRequestTracker) update(key string, fn func(state *mergeRequestState)) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	state, ok := t.states.Get(key)
+	if !ok {
+		state = &mergeRequestState{Pipelines: make(map[int64]struct{})}
+	}
+	fn(state)
+	t.states.Set(key, state)
+}
+
+// addPipeline records a pipeline run for a merge request.
+func (t *mergeRequestTracker) addPipeline(key string, pipelineID int64, createdAt time.Time) {
+	t.update(key, func(state *mergeRequestState) {
+		if state.FirstPipelineAt.IsZero() || createdAt.Before(state.FirstPipelineAt) {
+			state.FirstPipelineAt = createdAt
+		}
+		state.Pipelines[pipelineID] = struct{}{}
+	})
+}
+
+// reopen records that a merge request was reopened.
+func (t *mergeRequestTracker) reopen(key string) {
+	t.update(key, func(state *mergeRequestState) {
+		state.Reopened++
+	})
+}
+
+// reopened returns the number of times a merge request was reopened.
+func (t *mergeRequestTracker) reopened(key string) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	state, ok := t.states.Get(key)
+	if !ok {
+		return 0
+	}
+	return state.Reopened
+}
+
+// summary returns the time of the first pipeline and the number of pipelines
+// run for a merge request.
+func (t *mergeRequestTracker) summary(key string) (time.Time, int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	state, ok := t.states.Get(key)
+	if !ok {
+		return time.Time{}, 0
+	}
+	return state.FirstPipelineAt, len(state.Pipelines)
+}
+
+// mergeRequestTraceID returns the trace ID of a merge request's lifecycle
+// trace, which is also the span ID of its root span.
+func mergeRequestTraceID(targetProjectID, iid int64) string {
+	return fmt.Sprintf("mr-%d-%d", targetProjectID, iid)
+}
+
+func (l *Listener) handleMergeRequest(m types.MergeRequestEventPayload, d *delivery) error {
+	mr := m.ObjectAttributes
+	if time.Time(mr.CreatedAt).IsZero() {
+		return errors.New("MergeRequest.ObjectAttributes.CreatedAt is zero")
+	}
+
+	traceID := mergeRequestTraceID(mr.TargetProjectID, mr.IID)
+	createdAt := time.Time(mr.CreatedAt)
+	updatedAt := time.Time(mr.UpdatedAt)
+	if updatedAt.IsZero() {
+		updatedAt = createdAt
+	}
+
+	fields := map[string]interface{}{
+		"ci_provider":      "GitLab-CI",
+		"repo":             m.Project.WebURL,
+		"pr_number":        mr.IID,
+		"pr_branch":        mr.SourceBranch,
+		"pr_repo":          mr.Source.PathWithNamespace,
+		"pr_title":         mr.Title,
+		"pr_url":           mr.URL,
+		"pr_target_branch": mr.TargetBranch,
+		"pr_state":         mr.State,
+		"pr_draft":         mr.Draft || mr.WorkInProgress,
+		"action":           mr.Action,
+	}
+	l.addName(fields, "user.username", m.User.UserName)
+
+	// Every action is a marker on the merge request's timeline.
+	l.emit(Span{
+		ServiceName: "merge_request",
+		TraceID:     traceID,
+		SpanID:      fmt.Sprintf("%s-%s-%d", traceID, mr.Action, updatedAt.Unix()),
+		ParentID:    traceID,
+		Name:        "merge request " + mr.Action,
+		Timestamp:   updatedAt,
+		Fields:      fields,
+	}, d)
+
+	if mr.Action == "reopen" {
+		l.mergeRequests.reopen(traceID)
+	}
+	if mr.Action != "merge" && mr.Action != "close" {
+		return nil
+	}
+
+	rootFields := make(map[string]interface{}, len(fields)+3)
+	for k, v := range fields {
+		rootFields[k] = v
+	}
+	cycleTime := updatedAt.Sub(createdAt)
+	rootFields["mr.cycle_time_ms"] = cycleTime.Milliseconds()
+
+	firstPipelineAt, attempts := l.mergeRequests.summary(traceID)
+	rootFields["mr.pipeline_attempts"] = attempts
+	if !firstPipelineAt.IsZero() {
+		rootFields["mr.time_to_first_pipeline_ms"] = firstPipelineAt.Sub(createdAt).Milliseconds()
+	}
+
+	// A closed merge request can be reopened and then merged or closed
+	// again. The first close is the root span, and later ones are its
+	// children, so that every span has a unique ID.
+	spanID, parentID := traceID, ""
+	if reopened := l.mergeRequests.reopened(traceID); reopened > 0 {
+		spanID, parentID = fmt.Sprintf("%s-reopened-%d", traceID, reopened), traceID
+	}
+	l.emit(Span{
+		ServiceName: "merge_request",
+		TraceID:     traceID,
+		SpanID:      spanID,
+		ParentID:    parentID,
+		Name:        fmt.Sprintf("merge request !%d", mr.IID),
+		Timestamp:   createdAt,
+		Duration:    cycleTime,
+		Fields:      rootFields,
+	}, d)
+
+	return nil
+}
+
+// trackMergeRequestPipeline records a pipeline run for a merge request, and
+// once it has finished adds it to the merge request's lifecycle trace.
+func (l *Listener) trackMergeRequestPipeline(p types.PipelineEventPayload, d *delivery) {
+	if p.MergeRequest.IID == 0 || time.Time(p.ObjectAttributes.CreatedAt).IsZero() {
+		return
+	}
+
+	traceID := mergeRequestTraceID(p.MergeRequest.TargetProjectID, p.MergeRequest.IID)
+	createdAt := time.Time(p.ObjectAttributes.CreatedAt)
+	l.mergeRequests.addPipeline(traceID, p.ObjectAttributes.ID, createdAt)
+
+	if !finishedStatuses[p.ObjectAttributes.Status] {
+		return
+	}
+	duration, _ := pipelineTiming(p.ObjectAttributes)
+
+	pipelineTraceID := l.pipelineTraceID(p.ObjectAttributes.ID)
+	l.emit(Span{
+		ServiceName: "merge_request",
+		TraceID:     traceID,
+		SpanID:      fmt.Sprintf("%s-pipeline-%d", traceID, p.ObjectAttributes.ID),
+		ParentID:    traceID,
+		Name:        fmt.Sprintf("pipeline %d", p.ObjectAttributes.ID),
+		Timestamp:   createdAt,
+		Duration:    duration,
+		Fields: map[string]interface{}{
+			"ci_provider":       "GitLab-CI",
+			"build_num":         p.ObjectAttributes.ID,
+			"build_url":         fmt.Sprintf("%s/-/pipelines/%d", p.Project.WebURL, p.ObjectAttributes.ID),
+			"pr_number":         p.MergeRequest.IID,
+			"status":            p.ObjectAttributes.Status,
+			"pipeline.trace_id": pipelineTraceID,
+		},
+	}, d)
+}
+
+// Pipeline types, telling apart the kinds of merge request pipelines.
+const (
+	pipelineTypeBranch       = "branch"
+	pipelineTypeTag          = "tag"
+	pipelineTypeMergeRequest = "merge_request"
+	pipelineTypeMergedResult = "merged_result"
+	pipelineTypeMergeTrain   = "merge_train"
+)
+
+// pipelineType returns what a pipeline ran for. Merge request pipelines run
+// on refs/merge-requests/<iid>/head, merged results pipelines on
+// refs/merge-requests/<iid>/merge and merge train pipelines on
+// refs/merge-requests/<iid>/train.
+func pipelineType(p types.PipelineEventPayload) string {
+	ref := p.ObjectAttributes.Ref
+	switch {
+	case strings.HasPrefix(ref, "refs/merge-requests/") && strings.HasSuffix(ref, "/train"):
+		return pipelineTypeMergeTrain
+	case strings.HasPrefix(ref, "refs/merge-requests/") && strings.HasSuffix(ref, "/merge"):
+		return pipelineTypeMergedResult
+	case strings.HasPrefix(ref, "refs/merge-requests/") || p.ObjectAttributes.Source == "merge_request_event":
+		return pipelineTypeMergeRequest
+	case p.ObjectAttributes.Tag:
+		return pipelineTypeTag
+	default:
+		return pipelineTypeBranch
+	}
+}
+
+// mergeRequestSourcePath returns the path of the project a merge request
+// pipeline's changes come from. Pipeline hooks only have its ID, so the path
+// is only known when it's the pipeline's own project, rather than a fork.
+func mergeRequestSourcePath(p types.PipelineEventPayload) string {
+	mr := p.MergeRequest
+	switch {
+	case mr.Source.PathWithNamespace != "":
+		return mr.Source.PathWithNamespace
+	case mr.IID == 0:
+		return ""
+	case mr.SourceProjectID == p.Project.ID:
+		return p.Project.PathWithNamespace
+	default:
+		return fmt.Sprint(mr.SourceProjectID)
+	}
+}
+
+// addMergeRequestContext adds the merge request a pipeline ran for to its
+// span.
+func addMergeRequestContext(p types.PipelineEventPayload, fields map[string]interface{}) {
+	kind := pipelineType(p)
+	fields["pipeline_type"] = kind
+	fields["merge_train"] = kind == pipelineTypeMergeTrain
+
+	mr := p.MergeRequest
+	if mr.IID == 0 {
+		return
+	}
+
+	fields["pr_title"] = mr.Title
+	fields["pr_url"] = mr.URL
+	fields["pr_target_branch"] = mr.TargetBranch
+	fields["pr_target_repo"] = mr.Target.PathWithNamespace
+	if mr.Target.PathWithNamespace == "" && mr.TargetProjectID == p.Project.ID {
+		fields["pr_target_repo"] = p.Project.PathWithNamespace
+	}
+	fields["pr_state"] = mr.State
+	fields["pr_merge_status"] = mr.MergeStatus
+	if mr.DetailedMergeStatus != "" {
+		fields["pr_detailed_merge_status"] = mr.DetailedMergeStatus
+	}
+	fields["pr_draft"] = mr.Draft || mr.WorkInProgress || isDraftTitle(mr.Title)
+}
+
+// isDraftTitle reports whether a merge request title marks it as a draft,
+// for payloads that don't have the draft flag.
+func isDraftTitle(title string) bool {
+	lower := strings.ToLower(title)
+	for _, prefix := range []string{"draft:", "[draft]", "(draft)", "wip:", "[wip]"} {
+		if strings.HasPrefix(lower, prefix) {
+			return true
+		}
+	}
+	return false
+}
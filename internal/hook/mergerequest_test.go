@@ -0,0 +1,210 @@
+package hook
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/zoidyzoidzoid/gitlab-honeycomb-buildevents-webhooks-sink/internal/hook/types"
+)
+
+func Test_handleMergeRequestLifecycle(t *testing.T) {
+	sink := &MemorySink{}
+	l, err := New(Config{Version: "dev", Sink: sink})
+	if err != nil {
+		t.Fatalf("failed to create listener: %s", err)
+	}
+
+	opened := time.Date(2022, 10, 17, 9, 0, 0, 0, time.UTC)
+	mr := types.MergeRequestObjectAttributes{
+		ID:              1,
+		IID:             7,
+		TargetProjectID: 3,
+		CreatedAt:       types.GitLabTimestamp(opened),
+		UpdatedAt:       types.GitLabTimestamp(opened),
+		Action:          "open",
+	}
+
+	err = l.handleMergeRequest(types.MergeRequestEventPayload{ObjectAttributes: mr}, nil)
+	if err != nil {
+		t.Fatalf("failed to handle open: %s", err)
+	}
+
+	for i, offset := range []time.Duration{10 * time.Minute, time.Hour} {
+		err = l.handlePipeline(types.PipelineEventPayload{
+			ObjectAttributes: types.PipelineObjectAttributes{
+				ID:        int64(100 + i),
+				Status:    "success",
+				CreatedAt: types.GitLabTimestamp(opened.Add(offset)),
+				Duration:  60,
+			},
+			MergeRequest: types.MergeRequest{IID: 7, TargetProjectID: 3},
+		}, nil)
+		if err != nil {
+			t.Fatalf("failed to handle pipeline: %s", err)
+		}
+	}
+
+	mr.Action = "merge"
+	mr.UpdatedAt = types.GitLabTimestamp(opened.Add(2 * time.Hour))
+	err = l.handleMergeRequest(types.MergeRequestEventPayload{ObjectAttributes: mr}, nil)
+	if err != nil {
+		t.Fatalf("failed to handle merge: %s", err)
+	}
+
+	var root, pipelines int
+	for _, span := range sink.Spans() {
+		if span.TraceID != "mr-3-7" {
+			continue
+		}
+		if span.Name == "pipeline 100" || span.Name == "pipeline 101" {
+			pipelines++
+			if span.ParentID != "mr-3-7" {
+				t.Errorf("pipeline span parent = %q, want mr-3-7", span.ParentID)
+			}
+		}
+		if span.SpanID != "mr-3-7" {
+			continue
+		}
+		root++
+		if span.ParentID != "" || span.Duration != 2*time.Hour {
+			t.Errorf("root span = %+v, want a 2h root span", span)
+		}
+		if got := span.Fields["mr.pipeline_attempts"]; got != 2 {
+			t.Errorf("mr.pipeline_attempts = %v, want 2", got)
+		}
+		if got := span.Fields["mr.time_to_first_pipeline_ms"]; got != (10 * time.Minute).Milliseconds() {
+			t.Errorf("mr.time_to_first_pipeline_ms = %v, want %d", got, (10 * time.Minute).Milliseconds())
+		}
+		if got := span.Fields["mr.cycle_time_ms"]; got != (2 * time.Hour).Milliseconds() {
+			t.Errorf("mr.cycle_time_ms = %v, want %d", got, (2 * time.Hour).Milliseconds())
+		}
+	}
+	if root != 1 || pipelines != 2 {
+		t.Errorf("got %d root spans and %d pipeline spans, want 1 and 2", root, pipelines)
+	}
+}
+
+func Test_handleMergeRequestReopened(t *testing.T) {
+	sink := &MemorySink{}
+	l, err := New(Config{Version: "dev", Sink: sink})
+	if err != nil {
+		t.Fatalf("failed to create listener: %s", err)
+	}
+
+	opened := time.Date(2022, 10, 17, 9, 0, 0, 0, time.UTC)
+	// A pipeline canceled before it started has no duration.
+	err = l.handlePipeline(types.PipelineEventPayload{
+		ObjectAttributes: types.PipelineObjectAttributes{
+			ID:         100,
+			Status:     "canceled",
+			CreatedAt:  types.GitLabTimestamp(opened),
+			FinishedAt: types.GitLabTimestamp(opened.Add(time.Minute)),
+		},
+		MergeRequest: types.MergeRequest{IID: 7, TargetProjectID: 3},
+	}, nil)
+	if err != nil {
+		t.Fatalf("failed to handle pipeline: %s", err)
+	}
+
+	for i, action := range []string{"close", "reopen", "merge"} {
+		err = l.handleMergeRequest(types.MergeRequestEventPayload{ObjectAttributes: types.MergeRequestObjectAttributes{
+			IID:             7,
+			TargetProjectID: 3,
+			CreatedAt:       types.GitLabTimestamp(opened),
+			UpdatedAt:       types.GitLabTimestamp(opened.Add(time.Duration(i+1) * time.Hour)),
+			Action:          action,
+		}}, nil)
+		if err != nil {
+			t.Fatalf("failed to handle %s: %s", action, err)
+		}
+	}
+
+	ids := make(map[string]int)
+	roots := make(map[string]string)
+	for _, span := range sink.Spans() {
+		if span.TraceID != "mr-3-7" {
+			continue
+		}
+		ids[span.SpanID]++
+		if span.Name == "merge request !7" {
+			roots[span.SpanID] = span.ParentID
+		}
+	}
+	for id, n := range ids {
+		if n > 1 {
+			t.Errorf("span %s was sent %d times, want unique span IDs", id, n)
+		}
+	}
+	if want := map[string]string{"mr-3-7": "", "mr-3-7-reopened-1": "mr-3-7"}; !reflect.DeepEqual(roots, want) {
+		t.Errorf("root spans = %v, want the merge under the first close", roots)
+	}
+	if ids["mr-3-7-pipeline-100"] != 1 {
+		t.Errorf("spans = %v, want the canceled pipeline", ids)
+	}
+}
+
+func Test_pipelineType(t *testing.T) {
+	tests := []struct {
+		ref    string
+		source string
+		tag    bool
+		want   string
+	}{
+		{"main", "push", false, "branch"},
+		{"v1.0.0", "push", true, "tag"},
+		{"refs/merge-requests/7/head", "merge_request_event", false, "merge_request"},
+		{"feature", "merge_request_event", false, "merge_request"},
+		{"refs/merge-requests/7/merge", "merge_request_event", false, "merged_result"},
+		{"refs/merge-requests/7/train", "merge_request_event", false, "merge_train"},
+	}
+	for _, tt := range tests {
+		p := types.PipelineEventPayload{ObjectAttributes: types.PipelineObjectAttributes{Ref: tt.ref, Source: tt.source, Tag: tt.tag}}
+		if got := pipelineType(p); got != tt.want {
+			t.Errorf("pipelineType(%s, %s) = %s, want %s", tt.ref, tt.source, got, tt.want)
+		}
+	}
+}
+
+func Test_addMergeRequestContext(t *testing.T) {
+	p := types.PipelineEventPayload{
+		Project: types.Project{ID: 3, PathWithNamespace: "group/project"},
+		ObjectAttributes: types.PipelineObjectAttributes{
+			Ref:    "refs/merge-requests/7/train",
+			Source: "merge_request_event",
+		},
+		MergeRequest: types.MergeRequest{
+			IID:             7,
+			Title:           "Draft: Speed up the build",
+			URL:             "https://gitlab.com/group/project/-/merge_requests/7",
+			SourceProjectID: 3,
+			TargetProjectID: 3,
+			TargetBranch:    "main",
+			State:           "opened",
+			MergeStatus:     "can_be_merged",
+		},
+	}
+
+	fields := make(map[string]interface{})
+	addMergeRequestContext(p, fields)
+
+	want := map[string]interface{}{
+		"pipeline_type":    "merge_train",
+		"merge_train":      true,
+		"pr_title":         "Draft: Speed up the build",
+		"pr_url":           "https://gitlab.com/group/project/-/merge_requests/7",
+		"pr_target_branch": "main",
+		"pr_target_repo":   "group/project",
+		"pr_state":         "opened",
+		"pr_merge_status":  "can_be_merged",
+		"pr_draft":         true,
+	}
+	for k, v := range want {
+		if fields[k] != v {
+			t.Errorf("%s = %v, want %v", k, fields[k], v)
+		}
+	}
+	if got := mergeRequestSourcePath(p); got != "group/project" {
+		t.Errorf("mergeRequestSourcePath() = %q, want group/project", got)
+	}
+}
@@ -0,0 +1,618 @@
+package hook
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	resourcepb "go.opentelemetry.io/proto/otlp/resource/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+// OTLP protocols supported by OTLPSink.
+const (
+	OTLPProtocolGRPC         = "grpc"
+	OTLPProtocolHTTPProtobuf = "http/protobuf"
+	OTLPProtocolHTTPJSON     = "http/json"
+
+	// DefaultOTLPBatchSize is the number of spans exported in one request.
+	DefaultOTLPBatchSize = 512
+	// DefaultOTLPFlushInterval is the longest a span waits to be exported.
+	DefaultOTLPFlushInterval = 5 * time.Second
+
+	otlpScopeName = "github.com/zoidyzoidzoid/gitlab-honeycomb-buildevents-webhooks-sink"
+	otlpTimeout   = 10 * time.Second
+)
+
+// OTLPSinkConfig configures an OTLPSink.
+type OTLPSinkConfig struct {
+	Version string
+	// Protocol is one of grpc, http/protobuf or http/json. Defaults to
+	// http/protobuf.
+	Protocol string
+	// Endpoint is host:port for grpc, or the base URL for the http protocols,
+	// to which /v1/traces is added. Defaults to the OTLP default port on
+	// localhost.
+	Endpoint string
+	// Headers are sent with every export request.
+	Headers map[string]string
+	// Insecure disables TLS for grpc.
+	Insecure bool
+	// BatchSize is the number of spans exported in one request. Defaults to
+	// DefaultOTLPBatchSize.
+	BatchSize int
+	// FlushInterval is the longest a span waits to be exported. Defaults to
+	// DefaultOTLPFlushInterval.
+	FlushInterval time.Duration
+	// MaxRetries is the number of times a span is exported again after an
+	// export fails. Defaults to DefaultMaxRetries.
+	MaxRetries int
+	// DeadLetterPath is the JSON lines file that spans which couldn't be
+	// exported are written to, as Honeycomb events. They're only logged when
+	// it's empty.
+	DeadLetterPath string
+}
+
+// OTLPSink exports spans to an OpenTelemetry collector over OTLP. Trace and
+// span IDs are derived from the buildevents IDs, so the same pipeline always
+// produces the same trace.
+type OTLPSink struct {
+	cfg         OTLPSinkConfig
+	export      func(context.Context, *coltracepb.ExportTraceServiceRequest) error
+	conn        *grpc.ClientConn
+	deadLetters *deadLetterFile
+
+	mu      sync.Mutex
+	pending []otlpPending
+	// retryAt is when spans are next exported after an export failed.
+	retryAt time.Time
+
+	flushMu   sync.Mutex
+	full      chan struct{}
+	stop      chan struct{}
+	stopped   sync.WaitGroup
+	closeOnce sync.Once
+	closeErr  error
+}
+
+type otlpPending struct {
+	service string
+	span    *tracepb.Span
+	attempt int
+	done    func()
+	// source is the span that was sent, to dead-letter it.
+	source Span
+}
+
+// NewOTLPSink returns a sink exporting to the collector described by cfg.
+func NewOTLPSink(cfg OTLPSinkConfig) (*OTLPSink, error) {
+	if cfg.Protocol == "" {
+		cfg.Protocol = OTLPProtocolHTTPProtobuf
+	}
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = DefaultOTLPBatchSize
+	}
+	if cfg.FlushInterval <= 0 {
+		cfg.FlushInterval = DefaultOTLPFlushInterval
+	}
+	if cfg.MaxRetries <= 0 {
+		cfg.MaxRetries = DefaultMaxRetries
+	}
+
+	s := &OTLPSink{
+		cfg:  cfg,
+		full: make(chan struct{}, 1),
+		stop: make(chan struct{}),
+	}
+	if cfg.DeadLetterPath != "" {
+		s.deadLetters = &deadLetterFile{path: cfg.DeadLetterPath}
+	}
+
+	switch cfg.Protocol {
+	case OTLPProtocolGRPC:
+		if s.cfg.Endpoint == "" {
+			s.cfg.Endpoint = "localhost:4317"
+		}
+		// OTEL_EXPORTER_OTLP_ENDPOINT is usually a URL, even for gRPC.
+		if endpoint, ok := strings.CutPrefix(s.cfg.Endpoint, "http://"); ok {
+			s.cfg.Endpoint = endpoint
+			s.cfg.Insecure = true
+		}
+		s.cfg.Endpoint = strings.TrimPrefix(s.cfg.Endpoint, "https://")
+
+		creds := credentials.NewTLS(&tls.Config{MinVersion: tls.VersionTLS12})
+		if s.cfg.Insecure {
+			creds = insecure.NewCredentials()
+		}
+		conn, err := grpc.NewClient(s.cfg.Endpoint, grpc.WithTransportCredentials(creds))
+		if err != nil {
+			return nil, fmt.Errorf("failed to create OTLP gRPC client: %w", err)
+		}
+		s.conn = conn
+		s.export = s.exportGRPC(coltracepb.NewTraceServiceClient(conn))
+	case OTLPProtocolHTTPProtobuf, OTLPProtocolHTTPJSON:
+		if s.cfg.Endpoint == "" {
+			s.cfg.Endpoint = "http://localhost:4318"
+		}
+		s.export = s.exportHTTP(&http.Client{Timeout: otlpTimeout})
+	default:
+		return nil, fmt.Errorf("unknown OTLP protocol %q, expected %s, %s or %s", cfg.Protocol, OTLPProtocolGRPC, OTLPProtocolHTTPProtobuf, OTLPProtocolHTTPJSON)
+	}
+
+	s.stopped.Add(1)
+	go s.flushLoop()
+
+	return s, nil
+}
+
+// Send buffers span to be exported in the next batch.
+func (s *OTLPSink) Send(span Span, done func()) {
+	s.mu.Lock()
+	s.pending = append(s.pending, otlpPending{
+		service: span.ServiceName,
+		span:    otlpSpan(span),
+		attempt: 1,
+		done:    done,
+		source:  span,
+	})
+	full := len(s.pending) >= s.cfg.BatchSize
+	s.mu.Unlock()
+
+	if full {
+		// The flush loop exports the batch, so there's only ever one
+		// export at a time.
+		select {
+		case s.full <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Flush exports all buffered spans. Spans are only done once they've been
+// exported, and when an export fails they're exported again later, with
+// backoff.
+func (s *OTLPSink) Flush() error {
+	s.flushMu.Lock()
+	defer s.flushMu.Unlock()
+
+	s.mu.Lock()
+	batch := s.pending
+	s.pending = nil
+	s.mu.Unlock()
+
+	if len(batch) == 0 {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), otlpTimeout)
+	defer cancel()
+	err := s.export(ctx, s.request(batch))
+	if err != nil {
+		log.Printf("failed to export %d spans over OTLP: %s", len(batch), err)
+		s.requeue(batch, err)
+		return err
+	}
+
+	s.mu.Lock()
+	s.retryAt = time.Time{}
+	s.mu.Unlock()
+	for _, p := range batch {
+		p.done()
+	}
+	return nil
+}
+
+// requeue puts a batch whose export failed back in front of the buffered
+// spans, and holds off exporting them again until after a delay. Spans that
+// have failed too often are dead-lettered.
+func (s *OTLPSink) requeue(batch []otlpPending, exportErr error) {
+	retry := make([]otlpPending, 0, len(batch))
+	var dropped []otlpPending
+	attempt := 0
+	for _, p := range batch {
+		if p.attempt > s.cfg.MaxRetries {
+			dropped = append(dropped, p)
+			continue
+		}
+		p.attempt++
+		attempt = max(attempt, p.attempt)
+		retry = append(retry, p)
+	}
+	if len(dropped) > 0 {
+		log.Printf("failed to export %d spans after %d attempts", len(dropped), s.cfg.MaxRetries+1)
+		s.deadLetter(dropped, exportErr.Error())
+	}
+	if len(retry) == 0 {
+		return
+	}
+
+	s.mu.Lock()
+	s.pending = append(retry, s.pending...)
+	s.retryAt = time.Now().Add(retryDelay(attempt - 1))
+	s.mu.Unlock()
+}
+
+// deadLetter records spans that couldn't be exported, as the Honeycomb
+// events they'd have been sent as, and marks them as done.
+func (s *OTLPSink) deadLetter(batch []otlpPending, reason string) {
+	for _, p := range batch {
+		fields := make(map[string]interface{}, len(p.source.Fields)+8)
+		for k, v := range p.source.Fields {
+			fields[k] = v
+		}
+		fields["ci_provider"] = "GitLab-CI"
+		fields["meta.version"] = s.cfg.Version
+		fields["service_name"] = p.source.ServiceName
+		fields["trace.span_id"] = p.source.SpanID
+		fields["trace.trace_id"] = p.source.TraceID
+		fields["name"] = p.source.Name
+		fields["duration_ms"] = float64(p.source.Duration) / float64(time.Millisecond)
+		if p.source.ParentID != "" {
+			fields["trace.parent_id"] = p.source.ParentID
+		}
+
+		s.deadLetters.record(deadLetter{
+			FailedAt:  time.Now(),
+			Attempts:  p.attempt,
+			Error:     reason,
+			Timestamp: p.source.Timestamp,
+			Fields:    fields,
+		})
+		p.done()
+	}
+}
+
+// Close exports any buffered spans and closes the connection to the
+// collector. It is safe to call more than once.
+func (s *OTLPSink) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.stop)
+		s.stopped.Wait()
+
+		// Spans that still couldn't be exported won't be retried.
+		err := s.Flush()
+		if err != nil {
+			s.mu.Lock()
+			batch := s.pending
+			s.pending = nil
+			s.mu.Unlock()
+			s.deadLetter(batch, err.Error())
+		}
+		if s.conn != nil {
+			if closeErr := s.conn.Close(); closeErr != nil && err == nil {
+				err = closeErr
+			}
+		}
+		s.closeErr = err
+	})
+
+	return s.closeErr
+}
+
+func (s *OTLPSink) flushLoop() {
+	defer s.stopped.Done()
+
+	ticker := time.NewTicker(s.cfg.FlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.full:
+		case <-s.stop:
+			return
+		}
+
+		s.mu.Lock()
+		backingOff := time.Now().Before(s.retryAt)
+		s.mu.Unlock()
+		if !backingOff {
+			_ = s.Flush()
+		}
+	}
+}
+
+// request groups a batch of spans into one resource per service.
+func (s *OTLPSink) request(batch []otlpPending) *coltracepb.ExportTraceServiceRequest {
+	byService := make(map[string][]*tracepb.Span)
+	var services []string
+	for _, p := range batch {
+		if _, ok := byService[p.service]; !ok {
+			services = append(services, p.service)
+		}
+		byService[p.service] = append(byService[p.service], p.span)
+	}
+
+	req := &coltracepb.ExportTraceServiceRequest{}
+	for _, service := range services {
+		req.ResourceSpans = append(req.ResourceSpans, &tracepb.ResourceSpans{
+			Resource: &resourcepb.Resource{
+				Attributes: []*commonpb.KeyValue{
+					otlpAttribute("service.name", service),
+					otlpAttribute("ci_provider", "GitLab-CI"),
+				},
+			},
+			ScopeSpans: []*tracepb.ScopeSpans{{
+				Scope: &commonpb.InstrumentationScope{
+					Name:    otlpScopeName,
+					Version: s.cfg.Version,
+				},
+				Spans: byService[service],
+			}},
+		})
+	}
+
+	return req
+}
+
+func (s *OTLPSink) exportGRPC(client coltracepb.TraceServiceClient) func(context.Context, *coltracepb.ExportTraceServiceRequest) error {
+	return func(ctx context.Context, req *coltracepb.ExportTraceServiceRequest) error {
+		if len(s.cfg.Headers) > 0 {
+			ctx = metadata.NewOutgoingContext(ctx, metadata.New(s.cfg.Headers))
+		}
+
+		resp, err := client.Export(ctx, req)
+		if err != nil {
+			return err
+		}
+		if rejected := resp.GetPartialSuccess().GetRejectedSpans(); rejected > 0 {
+			return fmt.Errorf("collector rejected %d spans: %s", rejected, resp.GetPartialSuccess().GetErrorMessage())
+		}
+
+		return nil
+	}
+}
+
+func (s *OTLPSink) exportHTTP(client *http.Client) func(context.Context, *coltracepb.ExportTraceServiceRequest) error {
+	url := strings.TrimSuffix(s.cfg.Endpoint, "/") + "/v1/traces"
+
+	return func(ctx context.Context, req *coltracepb.ExportTraceServiceRequest) error {
+		var body []byte
+		var err error
+		contentType := "application/x-protobuf"
+		if s.cfg.Protocol == OTLPProtocolHTTPJSON {
+			contentType = "application/json"
+			body, err = MarshalOTLPJSON(req)
+		} else {
+			body, err = proto.Marshal(req)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to encode export request: %w", err)
+		}
+
+		httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		httpReq.Header.Set("Content-Type", contentType)
+		for k, v := range s.cfg.Headers {
+			httpReq.Header.Set(k, v)
+		}
+
+		resp, err := client.Do(httpReq)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+
+		respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+			return fmt.Errorf("%d %s: %s", resp.StatusCode, http.StatusText(resp.StatusCode), respBody)
+		}
+
+		return nil
+	}
+}
+
+// OTLPTraceID derives an OTLP trace ID from a buildevents trace ID.
+func OTLPTraceID(traceID string) []byte {
+	sum := md5.Sum([]byte(traceID))
+	return sum[:]
+}
+
+// OTLPSpanID derives an OTLP span ID from a buildevents span ID. Job span IDs
+// are already md5 hashes, so their first 8 bytes are used as they are.
+func OTLPSpanID(spanID string) []byte {
+	if len(spanID) == 32 {
+		if b, err := hex.DecodeString(spanID); err == nil {
+			return b[:8]
+		}
+	}
+
+	sum := md5.Sum([]byte(spanID))
+	return sum[:8]
+}
+
+func otlpSpan(span Span) *tracepb.Span {
+	s := &tracepb.Span{
+		TraceId:           OTLPTraceID(span.TraceID),
+		SpanId:            OTLPSpanID(span.SpanID),
+		Name:              span.Name,
+		Kind:              tracepb.Span_SPAN_KIND_INTERNAL,
+		StartTimeUnixNano: uint64(span.Timestamp.UnixNano()),
+		EndTimeUnixNano:   uint64(span.Timestamp.Add(span.Duration).UnixNano()),
+		Attributes: []*commonpb.KeyValue{
+			otlpAttribute("trace.trace_id", span.TraceID),
+			otlpAttribute("trace.span_id", span.SpanID),
+		},
+	}
+	if span.ParentID != "" {
+		s.ParentSpanId = OTLPSpanID(span.ParentID)
+		s.Attributes = append(s.Attributes, otlpAttribute("trace.parent_id", span.ParentID))
+	}
+
+	keys := make([]string, 0, len(span.Fields))
+	for k := range span.Fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		s.Attributes = append(s.Attributes, otlpAttribute(k, span.Fields[k]))
+	}
+
+	for _, link := range span.Links {
+		s.Links = append(s.Links, &tracepb.Span_Link{
+			TraceId: OTLPTraceID(link.TraceID),
+			SpanId:  OTLPSpanID(link.SpanID),
+			Attributes: []*commonpb.KeyValue{
+				otlpAttribute("trace.link.trace_id", link.TraceID),
+				otlpAttribute("trace.link.span_id", link.SpanID),
+			},
+		})
+	}
+
+	isError, ok := span.Fields["error"].(bool)
+	if !ok {
+		isError = span.Fields["status"] == "failed"
+	}
+	if isError {
+		s.Status = &tracepb.Status{Code: tracepb.Status_STATUS_CODE_ERROR}
+	}
+
+	return s
+}
+
+func otlpAttribute(key string, value interface{}) *commonpb.KeyValue {
+	return &commonpb.KeyValue{Key: key, Value: otlpValue(value)}
+}
+
+func otlpValue(value interface{}) *commonpb.AnyValue {
+	switch v := value.(type) {
+	case string:
+		return &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: v}}
+	case bool:
+		return &commonpb.AnyValue{Value: &commonpb.AnyValue_BoolValue{BoolValue: v}}
+	case int:
+		return &commonpb.AnyValue{Value: &commonpb.AnyValue_IntValue{IntValue: int64(v)}}
+	case int32:
+		return &commonpb.AnyValue{Value: &commonpb.AnyValue_IntValue{IntValue: int64(v)}}
+	case int64:
+		return &commonpb.AnyValue{Value: &commonpb.AnyValue_IntValue{IntValue: v}}
+	case float32:
+		return &commonpb.AnyValue{Value: &commonpb.AnyValue_DoubleValue{DoubleValue: float64(v)}}
+	case float64:
+		return &commonpb.AnyValue{Value: &commonpb.AnyValue_DoubleValue{DoubleValue: v}}
+	case []string:
+		values := make([]*commonpb.AnyValue, 0, len(v))
+		for _, s := range v {
+			values = append(values, otlpValue(s))
+		}
+		return &commonpb.AnyValue{Value: &commonpb.AnyValue_ArrayValue{ArrayValue: &commonpb.ArrayValue{Values: values}}}
+	default:
+		return &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: fmt.Sprint(v)}}
+	}
+}
+
+// otlpJSONIDFields are the fields that OTLP/JSON encodes as hex, rather than
+// the base64 used for bytes by the protobuf JSON mapping.
+var otlpJSONIDFields = map[string]bool{
+	"traceId":      true,
+	"spanId":       true,
+	"parentSpanId": true,
+}
+
+// MarshalOTLPJSON encodes req as OTLP/JSON.
+func MarshalOTLPJSON(req *coltracepb.ExportTraceServiceRequest) ([]byte, error) {
+	data, err := protojson.MarshalOptions{UseEnumNumbers: true}.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+
+	var doc interface{}
+	err = json.Unmarshal(data, &doc)
+	if err != nil {
+		return nil, err
+	}
+
+	err = rewriteOTLPIDs(doc, base64ToHex)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(doc)
+}
+
+// UnmarshalOTLPJSON decodes OTLP/JSON into req.
+func UnmarshalOTLPJSON(data []byte, req *coltracepb.ExportTraceServiceRequest) error {
+	var doc interface{}
+	err := json.Unmarshal(data, &doc)
+	if err != nil {
+		return err
+	}
+
+	err = rewriteOTLPIDs(doc, hexToBase64)
+	if err != nil {
+		return err
+	}
+
+	data, err = json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+
+	return protojson.Unmarshal(data, req)
+}
+
+func rewriteOTLPIDs(doc interface{}, convert func(string) (string, error)) error {
+	switch v := doc.(type) {
+	case map[string]interface{}:
+		for k, child := range v {
+			if s, ok := child.(string); ok && otlpJSONIDFields[k] {
+				converted, err := convert(s)
+				if err != nil {
+					return fmt.Errorf("failed to convert %s: %w", k, err)
+				}
+				v[k] = converted
+				continue
+			}
+			err := rewriteOTLPIDs(child, convert)
+			if err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		for _, child := range v {
+			err := rewriteOTLPIDs(child, convert)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func base64ToHex(s string) (string, error) {
+	b, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func hexToBase64(s string) (string, error) {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(b), nil
+}
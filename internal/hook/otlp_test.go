@@ -0,0 +1,267 @@
+package hook
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/proto"
+)
+
+// otlpReceiver is an in-process OTLP trace receiver for both gRPC and HTTP.
+type otlpReceiver struct {
+	coltracepb.UnimplementedTraceServiceServer
+	requests chan *coltracepb.ExportTraceServiceRequest
+}
+
+func (r *otlpReceiver) Export(_ context.Context, req *coltracepb.ExportTraceServiceRequest) (*coltracepb.ExportTraceServiceResponse, error) {
+	r.requests <- req
+	return &coltracepb.ExportTraceServiceResponse{}, nil
+}
+
+func (r *otlpReceiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var export coltracepb.ExportTraceServiceRequest
+	if req.Header.Get("Content-Type") == "application/json" {
+		err = UnmarshalOTLPJSON(body, &export)
+	} else {
+		err = proto.Unmarshal(body, &export)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	r.requests <- &export
+	w.WriteHeader(http.StatusOK)
+}
+
+func otlpAttributeValue(span *tracepb.Span, key string) *commonpb.AnyValue {
+	for _, kv := range span.Attributes {
+		if kv.Key == key {
+			return kv.Value
+		}
+	}
+	return nil
+}
+
+func TestOTLPSink(t *testing.T) {
+	receiver := &otlpReceiver{requests: make(chan *coltracepb.ExportTraceServiceRequest, 1)}
+
+	httpServer := httptest.NewServer(receiver)
+	defer httpServer.Close()
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %s", err)
+	}
+	grpcServer := grpc.NewServer()
+	coltracepb.RegisterTraceServiceServer(grpcServer, receiver)
+	go grpcServer.Serve(lis)
+	defer grpcServer.Stop()
+
+	start := time.Date(2022, 10, 17, 14, 44, 20, 0, time.UTC)
+	jobSpanID := "5d41402abc4b2a76b9719d911017c592"
+	span := Span{
+		TraceID:     "352792318",
+		SpanID:      jobSpanID,
+		ParentID:    "352792318",
+		Name:        "compile",
+		ServiceName: "job",
+		Timestamp:   start,
+		Duration:    39 * time.Second,
+		Fields: map[string]interface{}{
+			"build_id": int64(1501730157),
+			"status":   "failed",
+		},
+		Links: []SpanLink{{TraceID: "352792000", SpanID: "352792000"}},
+	}
+
+	tests := []struct {
+		name     string
+		protocol string
+		endpoint string
+	}{
+		{"http/protobuf", OTLPProtocolHTTPProtobuf, httpServer.URL},
+		{"http/json", OTLPProtocolHTTPJSON, httpServer.URL},
+		{"grpc", OTLPProtocolGRPC, lis.Addr().String()},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sink, err := NewOTLPSink(OTLPSinkConfig{
+				Version:  "dev",
+				Protocol: tt.protocol,
+				Endpoint: tt.endpoint,
+				Insecure: true,
+			})
+			if err != nil {
+				t.Fatalf("failed to create sink: %s", err)
+			}
+			defer sink.Close()
+
+			var done bool
+			sink.Send(span, func() { done = true })
+			err = sink.Flush()
+			if err != nil {
+				t.Fatalf("failed to flush: %s", err)
+			}
+			if !done {
+				t.Errorf("done wasn't called after flushing")
+			}
+
+			req := <-receiver.requests
+			if len(req.ResourceSpans) != 1 || len(req.ResourceSpans[0].ScopeSpans) != 1 || len(req.ResourceSpans[0].ScopeSpans[0].Spans) != 1 {
+				t.Fatalf("exported request = %v, want a single span", req)
+			}
+			got := req.ResourceSpans[0].ScopeSpans[0].Spans[0]
+
+			if !bytes.Equal(got.TraceId, OTLPTraceID("352792318")) {
+				t.Errorf("trace ID = %x, want %x", got.TraceId, OTLPTraceID("352792318"))
+			}
+			if hex.EncodeToString(got.SpanId) != jobSpanID[:16] {
+				t.Errorf("span ID = %x, want %s", got.SpanId, jobSpanID[:16])
+			}
+			if !bytes.Equal(got.ParentSpanId, OTLPSpanID("352792318")) {
+				t.Errorf("parent span ID = %x, want %x", got.ParentSpanId, OTLPSpanID("352792318"))
+			}
+			if got.StartTimeUnixNano != uint64(start.UnixNano()) || got.EndTimeUnixNano != uint64(start.Add(39*time.Second).UnixNano()) {
+				t.Errorf("span times = %d-%d, want %d-%d", got.StartTimeUnixNano, got.EndTimeUnixNano, start.UnixNano(), start.Add(39*time.Second).UnixNano())
+			}
+
+			if got := otlpAttributeValue(got, "build_id").GetIntValue(); got != 1501730157 {
+				t.Errorf("build_id attribute = %d, want 1501730157", got)
+			}
+			if got := otlpAttributeValue(got, "status").GetStringValue(); got != "failed" {
+				t.Errorf("status attribute = %q, want failed", got)
+			}
+			if len(got.Links) != 1 || !bytes.Equal(got.Links[0].TraceId, OTLPTraceID("352792000")) || !bytes.Equal(got.Links[0].SpanId, OTLPSpanID("352792000")) {
+				t.Errorf("links = %v, want a link to 352792000", got.Links)
+			}
+			if got.Status.GetCode() != tracepb.Status_STATUS_CODE_ERROR {
+				t.Errorf("span status = %v, want an error", got.Status)
+			}
+		})
+	}
+}
+
+func TestOTLPSinkRetry(t *testing.T) {
+	var failing atomic.Bool
+	failing.Store(true)
+	exported := make(chan struct{}, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failing.Load() {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		exported <- struct{}{}
+	}))
+	defer server.Close()
+
+	sink, err := NewOTLPSink(OTLPSinkConfig{Version: "dev", Endpoint: server.URL, BatchSize: 1, FlushInterval: time.Hour})
+	if err != nil {
+		t.Fatalf("failed to create sink: %s", err)
+	}
+
+	var done atomic.Int32
+	span := Span{TraceID: "42", SpanID: "42", Name: "build 42", ServiceName: "pipeline", Timestamp: time.Now()}
+	sink.Send(span, func() { done.Add(1) })
+	err = sink.Flush()
+	if err == nil {
+		t.Fatalf("Flush() succeeded, want the export to fail")
+	}
+	if done.Load() != 0 {
+		t.Errorf("done was called for a span that wasn't exported")
+	}
+
+	// The span is kept, and exported once the collector is back.
+	failing.Store(false)
+	err = sink.Flush()
+	if err != nil {
+		t.Fatalf("Flush() error = %s", err)
+	}
+	if done.Load() != 1 {
+		t.Errorf("done was called %d times, want once", done.Load())
+	}
+	<-exported
+
+	// A full batch is exported by the flush loop.
+	sink.Send(span, func() { done.Add(1) })
+	select {
+	case <-exported:
+	case <-time.After(5 * time.Second):
+		t.Errorf("full batch wasn't exported")
+	}
+
+	for i := 0; i < 2; i++ {
+		err = sink.Close()
+		if err != nil {
+			t.Errorf("Close() error = %s", err)
+		}
+	}
+	if done.Load() != 2 {
+		t.Errorf("done was called %d times, want twice", done.Load())
+	}
+}
+
+func TestOTLPSinkDeadLetter(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	deadLetterPath := filepath.Join(t.TempDir(), "dead-letters.jsonl")
+	sink, err := NewOTLPSink(OTLPSinkConfig{Version: "dev", Endpoint: server.URL, FlushInterval: time.Hour, MaxRetries: 1, DeadLetterPath: deadLetterPath})
+	if err != nil {
+		t.Fatalf("failed to create sink: %s", err)
+	}
+
+	// Spans are done once they've failed too often, so that their webhooks
+	// are acknowledged.
+	var done atomic.Int32
+	sink.Send(Span{TraceID: "42", SpanID: "42", Name: "build 42", ServiceName: "pipeline", Timestamp: time.Now()}, func() { done.Add(1) })
+	for i := 0; i < 2; i++ {
+		if sink.Flush() == nil {
+			t.Fatalf("Flush() succeeded, want the export to fail")
+		}
+	}
+	if done.Load() != 1 {
+		t.Errorf("done was called %d times, want once after the last retry", done.Load())
+	}
+
+	// Spans that are still buffered when the sink is closed are done too.
+	sink.Send(Span{TraceID: "42", SpanID: "unit", ParentID: "42", Name: "unit", ServiceName: "job", Timestamp: time.Now()}, func() { done.Add(1) })
+	if sink.Close() == nil {
+		t.Errorf("Close() succeeded, want the export to fail")
+	}
+	if done.Load() != 2 {
+		t.Errorf("done was called %d times, want twice", done.Load())
+	}
+
+	contents, err := os.ReadFile(deadLetterPath)
+	if err != nil {
+		t.Fatalf("failed to read dead letters: %s", err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(contents)), "\n")
+	if len(lines) != 2 || !strings.Contains(lines[0], `"trace.span_id":"42"`) || !strings.Contains(lines[1], `"trace.parent_id":"42"`) {
+		t.Errorf("dead letters = %s, want both spans", contents)
+	}
+}
@@ -0,0 +1,70 @@
+package hook
+
+import (
+	"time"
+
+	"github.com/zoidyzoidzoid/gitlab-honeycomb-buildevents-webhooks-sink/internal/hook/types"
+)
+
+// finishedStatuses are the statuses that jobs and pipelines don't leave,
+// other than by being retried. Manual jobs aren't finished until their
+// pipeline is, as they can be played until then.
+var finishedStatuses = map[string]bool{
+	"success":  true,
+	"failed":   true,
+	"canceled": true,
+	"skipped":  true,
+}
+
+// outcome returns how a job or pipeline ended, telling apart failures and
+// cancellations that happened before it started.
+func outcome(status string, started bool) string {
+	switch {
+	case status == "failed" && !started:
+		return "failed_before_start"
+	case status == "canceled" && !started:
+		return "canceled_before_start"
+	default:
+		return status
+	}
+}
+
+// jobTiming returns when a finished job's span starts and how long it lasts,
+// and whether the job started. Jobs that never started cover the time from
+// their creation until they finished, or are zero-length when that isn't
+// known. The start is zero when the job has no timestamps at all.
+func jobTiming(j types.JobEventPayload) (time.Time, time.Duration, bool) {
+	startedAt := time.Time(j.BuildStartedAt)
+	finishedAt := time.Time(j.BuildFinishedAt)
+	if !startedAt.IsZero() {
+		duration := time.Duration(j.BuildDuration * float64(time.Second))
+		if duration == 0 && !finishedAt.IsZero() {
+			duration = finishedAt.Sub(startedAt)
+		}
+		return startedAt, duration, true
+	}
+
+	createdAt := time.Time(j.BuildCreatedAt)
+	switch {
+	case !createdAt.IsZero() && !finishedAt.IsZero():
+		return createdAt, finishedAt.Sub(createdAt), false
+	case !createdAt.IsZero():
+		return createdAt, 0, false
+	default:
+		return finishedAt, 0, false
+	}
+}
+
+// pipelineTiming returns the duration of a finished pipeline, and whether it
+// started.
+func pipelineTiming(p types.PipelineObjectAttributes) (time.Duration, bool) {
+	if p.Duration > 0 {
+		return time.Duration(p.Duration) * time.Second, true
+	}
+
+	finishedAt := time.Time(p.FinishedAt)
+	if finishedAt.IsZero() {
+		return 0, false
+	}
+	return finishedAt.Sub(time.Time(p.CreatedAt)), false
+}
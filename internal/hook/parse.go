@@ -1,6 +1,7 @@
 package hook
 
 import (
+	"crypto/subtle"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -14,11 +15,17 @@ import (
 var (
 	ErrInvalidHTTPMethod             = errors.New("invalid HTTP Method")
 	ErrGitLabTokenVerificationFailed = errors.New("X-Gitlab-Token validation failed")
+	ErrPayloadTooLarge               = errors.New("payload is larger than the maximum body size")
 )
 
+// DefaultMaxBodyBytes is the largest webhook body that's accepted by default.
+const DefaultMaxBodyBytes = 25 << 20
+
 const (
-	PipelineEvents = "Pipeline Hook"
-	JobEvents      = "Job Hook"
+	PipelineEvents     = "Pipeline Hook"
+	JobEvents          = "Job Hook"
+	MergeRequestEvents = "Merge Request Hook"
+	DeploymentEvents   = "Deployment Hook"
 )
 
 type ErrPayloadParse struct {
@@ -35,17 +42,37 @@ func (epp ErrPayloadParse) Unwrap() error {
 }
 
 func (l *Listener) ParseHook(r *http.Request, event string) (interface{}, error) {
+	payload, err := l.ReadHook(r)
+	if err != nil {
+		return nil, err
+	}
+
+	return l.ParsePayload(payload, event)
+}
+
+// ReadHook verifies the request method and X-Gitlab-Token header, and
+// returns the raw request body.
+func (l *Listener) ReadHook(r *http.Request) ([]byte, error) {
 	if r.Method != http.MethodPost {
 		return nil, ErrInvalidHTTPMethod
 	}
 
+	// The token isn't checked when there's no secret, and otherwise is
+	// compared in constant time, so that it can't be guessed from how long
+	// rejecting it takes.
 	signature := r.Header.Get("X-Gitlab-Token")
-	if signature != l.Config.HookSecret {
+	if l.Config.HookSecret != "" && subtle.ConstantTimeCompare([]byte(signature), []byte(l.Config.HookSecret)) != 1 {
 		return nil, ErrGitLabTokenVerificationFailed
 	}
 
-	payload, err := io.ReadAll(r.Body)
+	payload, err := io.ReadAll(io.LimitReader(r.Body, l.Config.MaxBodyBytes+1))
+	if err == nil && int64(len(payload)) > l.Config.MaxBodyBytes {
+		return nil, ErrPayloadTooLarge
+	}
 	if err != nil || len(payload) == 0 {
+		if err == nil {
+			err = errors.New("empty payload")
+		}
 		return nil, ErrPayloadParse{Payload: payload, Err: err}
 	}
 
@@ -53,10 +80,15 @@ func (l *Listener) ParseHook(r *http.Request, event string) (interface{}, error)
 		log.Printf("raw payload: %s", string(payload))
 	}
 
+	return payload, nil
+}
+
+// ParsePayload decodes a raw webhook body into the typed payload for event.
+func (l *Listener) ParsePayload(payload []byte, event string) (interface{}, error) {
 	switch event {
 	case PipelineEvents:
 		var pe types.PipelineEventPayload
-		err = json.Unmarshal(payload, &pe)
+		err := json.Unmarshal(payload, &pe)
 		if err != nil {
 			return nil, fmt.Errorf("failed to parse payload into pipeline event: %w", err)
 		}
@@ -68,7 +100,7 @@ func (l *Listener) ParseHook(r *http.Request, event string) (interface{}, error)
 		return pe, nil
 	case JobEvents:
 		var je types.JobEventPayload
-		err = json.Unmarshal(payload, &je)
+		err := json.Unmarshal(payload, &je)
 		if err != nil {
 			return nil, fmt.Errorf("failed to parse payload into job event: %w", err)
 		}
@@ -78,6 +110,30 @@ func (l *Listener) ParseHook(r *http.Request, event string) (interface{}, error)
 		}
 
 		return je, nil
+	case MergeRequestEvents:
+		var me types.MergeRequestEventPayload
+		err := json.Unmarshal(payload, &me)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse payload into merge request event: %w", err)
+		}
+
+		if l.Config.Debug {
+			log.Printf("parsed merge request event: %+v", me)
+		}
+
+		return me, nil
+	case DeploymentEvents:
+		var de types.DeploymentEventPayload
+		err := json.Unmarshal(payload, &de)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse payload into deployment event: %w", err)
+		}
+
+		if l.Config.Debug {
+			log.Printf("parsed deployment event: %+v", de)
+		}
+
+		return de, nil
 	default:
 		return nil, fmt.Errorf("%s is not a valid event we're catching", event)
 	}
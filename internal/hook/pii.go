@@ -0,0 +1,108 @@
+package hook
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/zoidyzoidzoid/gitlab-honeycomb-buildevents-webhooks-sink/internal/hook/types"
+)
+
+// Redaction policies for personal information in span fields.
+const (
+	// RedactKeep sends the value as it is.
+	RedactKeep = "keep"
+	// RedactHash sends a hash of the value, which can still be grouped by.
+	RedactHash = "hash"
+	// RedactDrop doesn't send the field.
+	RedactDrop = "drop"
+
+	// DefaultRedactEmails is the default policy for email addresses.
+	DefaultRedactEmails = RedactHash
+	// DefaultRedactNames is the default policy for names and usernames.
+	DefaultRedactNames = RedactKeep
+)
+
+// validRedactPolicy returns an error if policy isn't a redaction policy.
+func validRedactPolicy(name, policy string) error {
+	switch policy {
+	case RedactKeep, RedactHash, RedactDrop:
+		return nil
+	default:
+		return fmt.Errorf("unknown %s redaction policy %q, expected %s, %s or %s", name, policy, RedactKeep, RedactHash, RedactDrop)
+	}
+}
+
+// randomRedactKey returns a key for hashing values when none is configured.
+func randomRedactKey() (string, error) {
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+	if err != nil {
+		return "", fmt.Errorf("failed to generate redaction key: %w", err)
+	}
+	return hex.EncodeToString(key), nil
+}
+
+// redact sets a field to value, following policy. Empty values aren't set.
+// Values are hashed with an HMAC, so that they can't be found by hashing a
+// list of known values without the key.
+func (l *Listener) redact(fields map[string]interface{}, key, value, policy string) {
+	if value == "" {
+		return
+	}
+
+	switch policy {
+	case RedactKeep:
+		fields[key] = value
+	case RedactHash:
+		mac := hmac.New(sha256.New, []byte(l.Config.RedactKey))
+		mac.Write([]byte(strings.ToLower(value)))
+		fields[key] = hex.EncodeToString(mac.Sum(nil)[:8])
+	}
+}
+
+// addName sets a name or username field, following the name policy.
+func (l *Listener) addName(fields map[string]interface{}, key, value string) {
+	l.redact(fields, key, value, l.Config.RedactNames)
+}
+
+// addEmail sets an email address field, following the email policy.
+func (l *Listener) addEmail(fields map[string]interface{}, key, value string) {
+	l.redact(fields, key, value, l.Config.RedactEmails)
+}
+
+// addUser adds the fields of the user that triggered a pipeline or job.
+func (l *Listener) addUser(fields map[string]interface{}, u types.User) {
+	if u.ID == 0 && u.UserName == "" {
+		return
+	}
+
+	fields["user.id"] = u.ID
+	l.addName(fields, "user.username", u.UserName)
+	l.addName(fields, "user.name", u.Name)
+	l.addEmail(fields, "user.email", u.Email)
+}
+
+// addCommit adds the fields of the commit a pipeline or job ran for.
+func (l *Listener) addCommit(fields map[string]interface{}, sha, message, url, authorName, authorEmail string, timestamp time.Time) {
+	if sha == "" {
+		return
+	}
+
+	fields["commit.sha"] = sha
+	if title, _, _ := strings.Cut(strings.TrimSpace(message), "\n"); title != "" {
+		fields["commit.title"] = title
+	}
+	if url != "" {
+		fields["commit.url"] = url
+	}
+	if !timestamp.IsZero() {
+		fields["commit.timestamp"] = timestamp
+	}
+	l.addName(fields, "commit.author.name", authorName)
+	l.addEmail(fields, "commit.author.email", authorEmail)
+}
@@ -0,0 +1,96 @@
+package hook
+
+import (
+	"testing"
+	"time"
+
+	"github.com/zoidyzoidzoid/gitlab-honeycomb-buildevents-webhooks-sink/internal/hook/types"
+)
+
+func Test_commitAndUserFields(t *testing.T) {
+	pipeline := types.PipelineEventPayload{
+		User: types.User{ID: 7, UserName: "jdoe", Name: "Jane Doe", Email: "Jane@example.com"},
+		Commit: types.Commit{
+			ID:      "bcbb5ec396a2c0f828686f14fac9b80b780504f2",
+			Message: "Fix the build\n\nIt was broken.",
+			URL:     "https://gitlab.com/group/project/-/commit/bcbb5ec3",
+			Author:  types.Author{Name: "Jane Doe", Email: "jane@example.com"},
+		},
+		ObjectAttributes: types.PipelineObjectAttributes{
+			ID:        42,
+			Status:    "success",
+			CreatedAt: types.GitLabTimestamp(time.Date(2022, 10, 17, 14, 0, 0, 0, time.UTC)),
+			Duration:  60,
+		},
+	}
+
+	tests := []struct {
+		policy    string
+		wantName  interface{}
+		wantEmail interface{}
+	}{
+		{RedactKeep, "Jane Doe", "jane@example.com"},
+		{RedactHash, nil, nil},
+		{RedactDrop, nil, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			sink := &MemorySink{}
+			l, err := New(Config{Version: "dev", Sink: sink, RedactNames: tt.policy, RedactEmails: tt.policy})
+			if err != nil {
+				t.Fatalf("failed to create listener: %s", err)
+			}
+
+			err = l.handlePipeline(pipeline, nil)
+			if err != nil {
+				t.Fatalf("failed to handle pipeline: %s", err)
+			}
+			fields := sink.Spans()[0].Fields
+
+			if fields["commit.sha"] != pipeline.Commit.ID || fields["commit.title"] != "Fix the build" || fields["user.id"] != int64(7) {
+				t.Errorf("fields = %v, want the commit and user", fields)
+			}
+			if tt.policy == RedactHash {
+				// Hashes are stable, and emails are hashed case-insensitively.
+				if fields["commit.author.name"] != fields["user.name"] || fields["commit.author.email"] != fields["user.email"] || fields["user.name"] == "Jane Doe" {
+					t.Errorf("hashed fields = %v, want matching hashes", fields)
+				}
+				return
+			}
+			if fields["commit.author.name"] != tt.wantName || fields["user.name"] != tt.wantName {
+				t.Errorf("names = %v/%v, want %v", fields["commit.author.name"], fields["user.name"], tt.wantName)
+			}
+			if fields["commit.author.email"] != tt.wantEmail {
+				t.Errorf("email = %v, want %v", fields["commit.author.email"], tt.wantEmail)
+			}
+		})
+	}
+
+	if _, err := New(Config{Version: "dev", Sink: &MemorySink{}, RedactEmails: "scramble"}); err == nil {
+		t.Errorf("New() accepted an unknown redaction policy")
+	}
+}
+
+func Test_redactKey(t *testing.T) {
+	hash := func(key string) interface{} {
+		l, err := New(Config{Version: "dev", Sink: &MemorySink{}, RedactKey: key})
+		if err != nil {
+			t.Fatalf("failed to create listener: %s", err)
+		}
+		fields := make(map[string]interface{})
+		l.addEmail(fields, "user.email", "jane@example.com")
+		return fields["user.email"]
+	}
+
+	// Hashes are only stable for the same key, so they can't be reversed
+	// without it.
+	if hash("a") != hash("a") {
+		t.Errorf("hashes with the same key differ")
+	}
+	if hash("a") == hash("b") {
+		t.Errorf("hashes with different keys match")
+	}
+	if hash("") == hash("") {
+		t.Errorf("hashes without a key match, want a random key")
+	}
+}
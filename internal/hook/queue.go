@@ -0,0 +1,275 @@
+package hook
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/zoidyzoidzoid/gitlab-honeycomb-buildevents-webhooks-sink/internal/hook/types"
+	"github.com/zoidyzoidzoid/gitlab-honeycomb-buildevents-webhooks-sink/internal/spool"
+)
+
+const (
+	// DefaultQueueSize is the number of accepted webhooks that can be waiting
+	// to be processed before new ones are rejected.
+	DefaultQueueSize = 1000
+	// DefaultWorkers is the number of goroutines draining the queue.
+	DefaultWorkers = 4
+
+	// queueRetryAfter is the value of the Retry-After header, in seconds, sent
+	// to GitLab when the queue is full.
+	queueRetryAfter = "10"
+
+	// replayInterval is how long replaying the spool waits for the queue to
+	// have free capacity.
+	replayInterval = 100 * time.Millisecond
+)
+
+var (
+	// ErrQueueFull is returned when a webhook can't be enqueued because the
+	// queue has no free capacity.
+	ErrQueueFull = errors.New("ingestion queue is full")
+	// ErrQueueClosed is returned when a webhook is received during shutdown.
+	ErrQueueClosed = errors.New("ingestion queue is closed")
+)
+
+// queuedHook is a validated webhook waiting to be processed. It is also the
+// record format of the spool.
+type queuedHook struct {
+	Event      string          `json:"event"`
+	Payload    json.RawMessage `json:"payload"`
+	ReceivedAt time.Time       `json:"received_at"`
+	// DedupKeys identify the delivery, and are forgotten if it can't be
+	// processed, so that GitLab's retry of it isn't ignored.
+	DedupKeys []string `json:"dedup_keys,omitempty"`
+
+	// spoolID is set when the webhook has been written to the spool, and
+	// must be acknowledged once it has been sent.
+	spoolID *spool.ID
+}
+
+// accept durably records h, if the spool is enabled, and enqueues it.
+func (l *Listener) accept(h queuedHook) error {
+	if l.spool != nil {
+		data, err := json.Marshal(h)
+		if err != nil {
+			return fmt.Errorf("failed to encode webhook for spool: %w", err)
+		}
+
+		id, err := l.spool.Append(data)
+		if err != nil {
+			return fmt.Errorf("failed to spool webhook: %w", err)
+		}
+		h.spoolID = &id
+	}
+
+	err := l.enqueue(h)
+	if err != nil {
+		// GitLab will retry, so there's no need to keep our copy.
+		l.ack(h)
+		return err
+	}
+
+	return nil
+}
+
+// ack removes h from the spool.
+func (l *Listener) ack(h queuedHook) {
+	if h.spoolID == nil {
+		return
+	}
+
+	err := l.spool.Ack(*h.spoolID)
+	if err != nil {
+		log.Printf("failed to acknowledge spooled %s: %s", h.Event, err)
+	}
+}
+
+// replaySpool enqueues the webhooks left in the spool by a previous process,
+// waiting for the queue to have free capacity. It stops once the queue is
+// closed, and the webhooks it hasn't enqueued are replayed the next time the
+// spool is opened.
+func (l *Listener) replaySpool() error {
+	var replayed int
+	err := l.spool.Replay(func(rec spool.Record) error {
+		var h queuedHook
+		err := json.Unmarshal(rec.Data, &h)
+		if err != nil {
+			log.Printf("dropping unreadable spool record %+v: %s", rec.ID, err)
+			return l.spool.Ack(rec.ID)
+		}
+		h.spoolID = &rec.ID
+
+		for {
+			err := l.enqueue(h)
+			if !errors.Is(err, ErrQueueFull) {
+				if err == nil {
+					replayed++
+				}
+				return err
+			}
+			time.Sleep(replayInterval)
+		}
+	})
+	if replayed > 0 {
+		log.Printf("replayed %d webhooks from the spool", replayed)
+	}
+	if err != nil && !errors.Is(err, ErrQueueClosed) {
+		return fmt.Errorf("failed to replay spool: %w", err)
+	}
+
+	return nil
+}
+
+// enqueue adds h to the queue without blocking.
+func (l *Listener) enqueue(h queuedHook) error {
+	l.queueMu.RLock()
+	defer l.queueMu.RUnlock()
+	if l.queueClosed {
+		return ErrQueueClosed
+	}
+
+	select {
+	case l.queue <- h:
+		return nil
+	default:
+		return ErrQueueFull
+	}
+}
+
+// Start launches the worker pool draining the queue, and replays anything
+// left in the spool in the background, so that webhooks are received while
+// it's replayed. It is safe to call more than once.
+func (l *Listener) Start() error {
+	l.startOnce.Do(func() {
+		for i := 0; i < l.Config.Workers; i++ {
+			l.workers.Add(1)
+			go l.worker()
+		}
+
+		if l.spool != nil {
+			l.replaying.Add(1)
+			go func() {
+				defer l.replaying.Done()
+				err := l.replaySpool()
+				if err != nil {
+					log.Print(err)
+				}
+			}()
+		}
+	})
+
+	return nil
+}
+
+func (l *Listener) worker() {
+	defer l.workers.Done()
+	for h := range l.queue {
+		// The webhook stays in the spool until all of its spans have been
+		// sent or given up on.
+		l.inflight.Add(1)
+		d := newDelivery(func() {
+			l.ack(h)
+			l.inflight.Done()
+		})
+
+		err := l.process(h, d)
+		if err != nil {
+			// Handler errors come from the payload itself, so retrying
+			// wouldn't help, but GitLab redelivering it with changes
+			// might.
+			log.Printf("failed to process %s: %s", h.Event, err)
+			l.forgetDelivered(h.DedupKeys)
+		}
+		d.finish()
+	}
+}
+
+// process parses a queued webhook and builds events for it.
+func (l *Listener) process(h queuedHook, d *delivery) error {
+	event, err := l.ParsePayload(h.Payload, h.Event)
+	if err != nil {
+		return err
+	}
+
+	return l.handle(event, d)
+}
+
+// handle dispatches a parsed webhook payload to its handler.
+func (l *Listener) handle(event interface{}, d *delivery) error {
+	switch e := event.(type) {
+	case types.PipelineEventPayload:
+		err := l.handlePipeline(e, d)
+		if err != nil {
+			return fmt.Errorf("failed to handle pipeline event: %w", err)
+		}
+	case types.JobEventPayload:
+		err := l.handleJob(e, d)
+		if err != nil {
+			return fmt.Errorf("failed to handle job event: %w", err)
+		}
+	case types.MergeRequestEventPayload:
+		err := l.handleMergeRequest(e, d)
+		if err != nil {
+			return fmt.Errorf("failed to handle merge request event: %w", err)
+		}
+	case types.DeploymentEventPayload:
+		err := l.handleDeployment(e, d)
+		if err != nil {
+			return fmt.Errorf("failed to handle deployment event: %w", err)
+		}
+	default:
+		return fmt.Errorf("invalid event type: %T", e)
+	}
+
+	return nil
+}
+
+// Shutdown stops accepting webhooks, and waits for the queue to be drained
+// or for ctx to be done.
+func (l *Listener) Shutdown(ctx context.Context) error {
+	err := l.HTTPServer.Shutdown(ctx)
+
+	l.queueMu.Lock()
+	if !l.queueClosed {
+		l.queueClosed = true
+		close(l.queue)
+	}
+	l.queueMu.Unlock()
+
+	// Replaying stops once the queue is closed.
+	err = errors.Join(err, waitContext(ctx, &l.replaying, "spool replay not stopped"))
+	err = errors.Join(err, waitContext(ctx, &l.workers, "queue not drained"))
+
+	// Wait for the spans that have been built to be sent, including any
+	// waiting to be retried.
+	err = errors.Join(err, l.sink.Flush())
+	err = errors.Join(err, waitContext(ctx, &l.inflight, "spans not sent"))
+	err = errors.Join(err, l.sink.Close())
+
+	if l.spool != nil {
+		err = errors.Join(err, l.spool.Close())
+	}
+
+	return err
+}
+
+// waitContext waits for wg, or returns an error once ctx is done.
+func waitContext(ctx context.Context, wg *sync.WaitGroup, msg string) error {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("%s: %w", msg, ctx.Err())
+	}
+}
@@ -0,0 +1,176 @@
+package hook
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultRecordMaxBytes is the size a recording grows to before it's
+	// rotated.
+	DefaultRecordMaxBytes = 100 << 20
+	// DefaultRecordMaxFiles is the number of rotated recordings kept.
+	DefaultRecordMaxFiles = 5
+)
+
+// recordedHeaders are the request headers kept in recordings.
+var recordedHeaders = []string{
+	"Content-Type",
+	"User-Agent",
+	"X-Gitlab-Event",
+	"X-Gitlab-Event-UUID",
+	"X-Gitlab-Webhook-UUID",
+	"X-Gitlab-Instance",
+	"Idempotency-Key",
+}
+
+// scrubbedHeaders are the request headers whose presence is recorded, but not
+// their value.
+var scrubbedHeaders = []string{
+	"X-Gitlab-Token",
+	"Authorization",
+}
+
+// recorder appends received webhooks to a JSON lines file, rotating it to
+// <path>.1, <path>.2 and so on once it's too big.
+type recorder struct {
+	mu       sync.Mutex
+	path     string
+	maxBytes int64
+	maxFiles int
+}
+
+// record appends a recording to the file.
+func (r *recorder) record(rec Recording) error {
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return fmt.Errorf("failed to encode recording: %w", err)
+	}
+	line = append(line, '\n')
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if info, err := os.Stat(r.path); err == nil && info.Size() > 0 && info.Size()+int64(len(line)) > r.maxBytes {
+		err := r.rotate()
+		if err != nil {
+			return err
+		}
+	}
+
+	file, err := os.OpenFile(r.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o640)
+	if err != nil {
+		return fmt.Errorf("failed to open recording: %w", err)
+	}
+
+	_, err = file.Write(line)
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("failed to write recording: %w", err)
+	}
+
+	return file.Close()
+}
+
+// rotate moves each rotated recording up one, dropping the oldest, and the
+// current recording to <path>.1.
+func (r *recorder) rotate() error {
+	for i := r.maxFiles; i > 0; i-- {
+		from := r.path
+		if i > 1 {
+			from = fmt.Sprintf("%s.%d", r.path, i-1)
+		}
+		err := os.Rename(from, fmt.Sprintf("%s.%d", r.path, i))
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("failed to rotate recording: %w", err)
+		}
+	}
+	return nil
+}
+
+// recordingBody returns a request body as it's kept in recordings: as JSON
+// when it is JSON, so it can be read, and as a JSON string otherwise.
+func recordingBody(body []byte) json.RawMessage {
+	if json.Valid(body) {
+		return body
+	}
+	quoted, _ := json.Marshal(string(body))
+	return quoted
+}
+
+// recordingHeaders returns the headers of a request that are kept in
+// recordings.
+func recordingHeaders(h http.Header) map[string]string {
+	headers := make(map[string]string)
+	for _, key := range recordedHeaders {
+		if v := h.Get(key); v != "" {
+			headers[key] = v
+		}
+	}
+	for _, key := range scrubbedHeaders {
+		if h.Get(key) != "" {
+			headers[key] = redactedValue
+		}
+	}
+	return headers
+}
+
+// statusWriter remembers the status code of a response.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// recordRequest reads a webhook's body so that it can still be handled, and
+// returns a writer for its response and a function that records it once it
+// has been answered.
+func (l *Listener) recordRequest(w http.ResponseWriter, r *http.Request) (http.ResponseWriter, func()) {
+	receivedAt := time.Now()
+	// Bodies that are too big are cut short, and rejected by ReadHook.
+	body, err := io.ReadAll(io.LimitReader(r.Body, l.Config.MaxBodyBytes+1))
+	if err != nil {
+		log.Printf("failed to read webhook to record it: %s", err)
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+
+	sw := &statusWriter{ResponseWriter: w}
+	return sw, func() {
+		status := sw.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+
+		err := l.recorder.record(Recording{
+			ReceivedAt: receivedAt,
+			Headers:    recordingHeaders(r.Header),
+			Body:       recordingBody(body),
+			Status:     status,
+		})
+		if err != nil {
+			log.Printf("failed to record webhook: %s", err)
+		}
+	}
+}
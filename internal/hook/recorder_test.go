@@ -0,0 +1,112 @@
+package hook
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func Test_recordRequest(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "webhooks.jsonl")
+	l, err := New(Config{Version: "dev", Sink: &MemorySink{}, HookSecret: "secret", RecordPath: path})
+	if err != nil {
+		t.Fatalf("failed to create listener: %s", err)
+	}
+
+	// Bodies are recorded compacted.
+	job := `{"object_kind":"build","build_id":10,"build_name":"unit","build_status":"success","build_started_at":"2022-10-17 14:44:20 UTC","build_duration":60,"pipeline_id":42}`
+	tests := []struct {
+		token    string
+		payload  string
+		wantCode int
+	}{
+		{"secret", job, http.StatusAccepted},
+		{"wrong", job, http.StatusBadRequest},
+		{"secret", "not json", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodPost, "/api/message", strings.NewReader(tt.payload))
+		req.Header.Set("X-Gitlab-Event", JobEvents)
+		req.Header.Set("X-Gitlab-Token", tt.token)
+		req.Header.Set("Cookie", "session")
+		w := httptest.NewRecorder()
+		l.HandleRequest(w, req)
+		if w.Code != tt.wantCode {
+			t.Errorf("status = %d, want %d", w.Code, tt.wantCode)
+		}
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "secret") || strings.Contains(string(data), "session") {
+		t.Errorf("recording = %s, want secret headers scrubbed", data)
+	}
+
+	recs, err := ReadRecordings(path)
+	if err != nil {
+		t.Fatalf("failed to read recording: %s", err)
+	}
+	if len(recs) != len(tests) {
+		t.Fatalf("recorded %d webhooks, want %d", len(recs), len(tests))
+	}
+	for i, tt := range tests {
+		rec := recs[i]
+		if rec.Status != tt.wantCode || string(rec.payload()) != tt.payload || rec.Event() != JobEvents || rec.ReceivedAt.IsZero() {
+			t.Errorf("recording %d = %+v, want the webhook and its %d response", i, rec, tt.wantCode)
+		}
+		if rec.Headers["X-Gitlab-Token"] != redactedValue {
+			t.Errorf("recorded token = %q, want %q", rec.Headers["X-Gitlab-Token"], redactedValue)
+		}
+	}
+
+	// Recordings reproduce the webhook's spans when replayed.
+	sink := &MemorySink{}
+	replayer, err := New(Config{Version: "dev", Sink: sink, HookSecret: "other"})
+	if err != nil {
+		t.Fatalf("failed to create listener: %s", err)
+	}
+	err = replayer.Replay(recs[0])
+	if err != nil {
+		t.Fatalf("failed to replay recording: %s", err)
+	}
+	if spans := sink.Spans(); len(spans) != 1 || spans[0].Name != "unit" {
+		t.Errorf("replayed spans = %+v, want the job's span", spans)
+	}
+}
+
+func Test_recorderRotate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "webhooks.jsonl")
+	r := &recorder{path: path, maxBytes: 100, maxFiles: 2}
+
+	for i := 0; i < 5; i++ {
+		err := r.record(Recording{Body: []byte(`{"object_kind": "build"}`), Status: 200 + i})
+		if err != nil {
+			t.Fatalf("record() error = %s", err)
+		}
+	}
+
+	for _, tt := range []struct {
+		path   string
+		status int
+	}{
+		{path, 204},
+		{path + ".1", 203},
+		{path + ".2", 202},
+	} {
+		recs, err := ReadRecordings(tt.path)
+		if err != nil {
+			t.Fatalf("failed to read %s: %s", tt.path, err)
+		}
+		if len(recs) != 1 || recs[0].Status != tt.status {
+			t.Errorf("%s = %+v, want the recording with status %d", tt.path, recs, tt.status)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); err == nil {
+		t.Errorf("%s.3 exists, want only 2 rotated recordings kept", path)
+	}
+}
@@ -0,0 +1,211 @@
+package hook
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/zoidyzoidzoid/gitlab-honeycomb-buildevents-webhooks-sink/internal/hook/types"
+)
+
+// Recording is a webhook as it was received. Recordings are stored as JSON
+// lines, and can be replayed.
+type Recording struct {
+	ReceivedAt time.Time         `json:"received_at"`
+	Headers    map[string]string `json:"headers"`
+	Body       json.RawMessage   `json:"body"`
+	// Status is the status code of the response to the webhook.
+	Status int `json:"status,omitempty"`
+}
+
+// Event returns the webhook's event, e.g. Pipeline Hook.
+func (r Recording) Event() string {
+	return r.header("X-Gitlab-Event")
+}
+
+// payload returns the webhook's body as it was received. Bodies that aren't
+// JSON are recorded as JSON strings.
+func (r Recording) payload() []byte {
+	var s string
+	if json.Unmarshal(r.Body, &s) == nil {
+		return []byte(s)
+	}
+	return r.Body
+}
+
+// header returns the value of a recorded header, whatever its case.
+func (r Recording) header(key string) string {
+	for k, v := range r.Headers {
+		if http.CanonicalHeaderKey(k) == http.CanonicalHeaderKey(key) {
+			return v
+		}
+	}
+	return ""
+}
+
+// objectKindEvents are the events of webhook payloads, by their object_kind.
+var objectKindEvents = map[string]string{
+	"pipeline":      PipelineEvents,
+	"build":         JobEvents,
+	"merge_request": MergeRequestEvents,
+	"deployment":    DeploymentEvents,
+}
+
+// ReadRecordings reads the webhooks in a file, which holds either recordings
+// or webhook payloads, such as pipeline.json. The event of a payload is
+// worked out from its object_kind.
+func ReadRecordings(path string) ([]Recording, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open recording: %w", err)
+	}
+	defer f.Close()
+
+	var recordings []Recording
+	dec := json.NewDecoder(f)
+	for {
+		var raw json.RawMessage
+		err := dec.Decode(&raw)
+		if errors.Is(err, io.EOF) {
+			return recordings, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", path, err)
+		}
+
+		rec, err := recordingOf(raw)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", path, err)
+		}
+		recordings = append(recordings, rec)
+	}
+}
+
+// recordingOf returns the recording in raw, or wraps raw in one when it's a
+// webhook payload.
+func recordingOf(raw json.RawMessage) (Recording, error) {
+	var rec Recording
+	err := json.Unmarshal(raw, &rec)
+	if err == nil && len(rec.Body) > 0 {
+		return rec, nil
+	}
+
+	var payload struct {
+		ObjectKind string `json:"object_kind"`
+	}
+	err = json.Unmarshal(raw, &payload)
+	if err != nil {
+		return Recording{}, err
+	}
+	event, ok := objectKindEvents[payload.ObjectKind]
+	if !ok {
+		return Recording{}, fmt.Errorf("unknown object_kind %q", payload.ObjectKind)
+	}
+	return Recording{
+		Headers: map[string]string{"X-Gitlab-Event": event},
+		Body:    raw,
+	}, nil
+}
+
+// walkTimestamps calls fn with every timestamp in a decoded JSON value, and
+// replaces it with what fn returns.
+func walkTimestamps(v interface{}, fn func(t time.Time) time.Time) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, e := range v {
+			v[k] = walkTimestamps(e, fn)
+		}
+	case []interface{}:
+		for i, e := range v {
+			v[i] = walkTimestamps(e, fn)
+		}
+	case string:
+		if t, layout, err := types.ParseTimestamp(v); err == nil {
+			return fn(t).Format(layout)
+		}
+	}
+	return v
+}
+
+// decodeBody decodes a webhook body, keeping its numbers as they are.
+func decodeBody(body []byte) (interface{}, error) {
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	var v interface{}
+	err := dec.Decode(&v)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode body: %w", err)
+	}
+	return v, nil
+}
+
+// ShiftTimestamps returns a webhook body with every timestamp in it moved by
+// offset.
+func ShiftTimestamps(body []byte, offset time.Duration) ([]byte, error) {
+	v, err := decodeBody(body)
+	if err != nil {
+		return nil, err
+	}
+
+	v = walkTimestamps(v, func(t time.Time) time.Time { return t.Add(offset) })
+	return json.Marshal(v)
+}
+
+// LatestTimestamp returns the latest timestamp in a webhook body, or zero if
+// it has none.
+func LatestTimestamp(body []byte) time.Time {
+	var latest time.Time
+	v, err := decodeBody(body)
+	if err != nil {
+		return latest
+	}
+
+	walkTimestamps(v, func(t time.Time) time.Time {
+		if t.After(latest) {
+			latest = t
+		}
+		return t
+	})
+	return latest
+}
+
+// Replay processes a recorded webhook as if it had just been received, except
+// that the queue is skipped. Duplicates are ignored, as they are when
+// received, and Shutdown waits for the spans to be sent.
+func (l *Listener) Replay(rec Recording) error {
+	event := rec.Event()
+	if event == "" {
+		return errors.New("recording has no X-Gitlab-Event header")
+	}
+
+	r, err := http.NewRequest(http.MethodPost, "/api/message", bytes.NewReader(rec.payload()))
+	if err != nil {
+		return err
+	}
+	for k, v := range rec.Headers {
+		r.Header.Set(k, v)
+	}
+	// Recordings don't keep the secret, so they're replayed with ours.
+	r.Header.Set("X-Gitlab-Token", l.Config.HookSecret)
+
+	payload, err := l.ParseHook(r, event)
+	if err != nil {
+		return fmt.Errorf("failed to parse %s: %w", event, err)
+	}
+
+	if l.markDelivered(dedupKeys(r, payload)) {
+		log.Printf("ignoring duplicate %s", event)
+		return nil
+	}
+
+	l.inflight.Add(1)
+	d := newDelivery(l.inflight.Done)
+	defer d.finish()
+	return l.handle(payload, d)
+}
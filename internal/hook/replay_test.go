@@ -0,0 +1,87 @@
+package hook
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestReadRecordings(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "webhooks.jsonl")
+	err := os.WriteFile(path, []byte(`{"received_at": "2022-10-17T14:00:00Z", "headers": {"x-gitlab-event": "Job Hook"}, "body": {"object_kind": "build"}, "status": 202}
+{
+  "object_kind": "pipeline",
+  "object_attributes": {"id": 1}
+}
+`), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recs, err := ReadRecordings(path)
+	if err != nil {
+		t.Fatalf("ReadRecordings() error = %s", err)
+	}
+	if len(recs) != 2 {
+		t.Fatalf("ReadRecordings() = %d recordings, want 2", len(recs))
+	}
+	if recs[0].Event() != JobEvents || recs[0].Status != 202 || string(recs[0].Body) != `{"object_kind": "build"}` {
+		t.Errorf("recording = %+v, want the recorded job webhook", recs[0])
+	}
+	if recs[1].Event() != PipelineEvents || !recs[1].ReceivedAt.IsZero() {
+		t.Errorf("recording = %+v, want the pipeline payload", recs[1])
+	}
+
+	err = os.WriteFile(path, []byte(`{"object_kind": "push"}`), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadRecordings(path); err == nil {
+		t.Error("ReadRecordings() of an unknown object_kind succeeded, want an error")
+	}
+}
+
+func TestShiftTimestamps(t *testing.T) {
+	body := []byte(`{"id": 352792318, "created_at": "2022-10-17 14:44:20 +0100", "builds": [{"started_at": "2022-10-17 15:44:20 UTC", "finished_at": null}], "commit": {"timestamp": "2022-10-17T14:00:00Z", "message": "2022"}}`)
+
+	if got, want := LatestTimestamp(body), time.Date(2022, 10, 17, 15, 44, 20, 0, time.UTC); !got.Equal(want) {
+		t.Errorf("LatestTimestamp() = %s, want %s", got, want)
+	}
+
+	shifted, err := ShiftTimestamps(body, 24*time.Hour)
+	if err != nil {
+		t.Fatalf("ShiftTimestamps() error = %s", err)
+	}
+	want := `{"builds":[{"finished_at":null,"started_at":"2022-10-18 15:44:20 UTC"}],"commit":{"message":"2022","timestamp":"2022-10-18T14:00:00Z"},"created_at":"2022-10-18 14:44:20 +0100","id":352792318}`
+	if string(shifted) != want {
+		t.Errorf("ShiftTimestamps() = %s, want %s", shifted, want)
+	}
+}
+
+func TestReplay(t *testing.T) {
+	sink := &MemorySink{}
+	l, err := New(Config{Version: "dev", Sink: sink, HookSecret: "secret"})
+	if err != nil {
+		t.Fatalf("failed to create listener: %s", err)
+	}
+
+	rec := Recording{
+		Headers: map[string]string{"X-Gitlab-Event": JobEvents, "X-Gitlab-Event-UUID": "1"},
+		Body:    []byte(`{"object_kind": "build", "build_id": 10, "build_name": "unit", "build_status": "success", "build_started_at": "2022-10-17 14:44:20 UTC", "build_duration": 60, "pipeline_id": 42}`),
+	}
+	for i := 0; i < 2; i++ {
+		err = l.Replay(rec)
+		if err != nil {
+			t.Fatalf("Replay() error = %s", err)
+		}
+	}
+	if spans := sink.Spans(); len(spans) != 1 || spans[0].Fields["build_id"] != int64(10) {
+		t.Errorf("spans = %+v, want the job's span once", spans)
+	}
+
+	err = l.Replay(Recording{Body: rec.Body})
+	if err == nil {
+		t.Error("Replay() without an event succeeded, want an error")
+	}
+}
@@ -0,0 +1,120 @@
+package hook
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/zoidyzoidzoid/gitlab-honeycomb-buildevents-webhooks-sink/internal/hook/types"
+)
+
+// untaggedRunners is the tag that jobs on runners without tags are rolled up
+// under.
+const untaggedRunners = "untagged"
+
+// runnerType returns the type of a runner: instance, group or project.
+func runnerType(r types.Runner) string {
+	return strings.TrimSuffix(r.RunnerType, "_type")
+}
+
+// runnerTagSummary is the rollup of a pipeline's jobs that ran on runners
+// with a tag.
+type runnerTagSummary struct {
+	Start     time.Time
+	Finish    time.Time
+	Jobs      int
+	Failed    int
+	Queued    time.Duration
+	MaxQueued time.Duration
+}
+
+// runnerTags returns the rollup of a pipeline's jobs by the tags of the
+// runners they ran on. A job counts towards each of its runner's tags.
+func (t *stageTracker) runnerTags(pipelineID int64) map[string]*runnerTagSummary {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	stages, ok := t.pipelines.Get(fmt.Sprint(pipelineID))
+	if !ok {
+		return nil
+	}
+
+	summaries := make(map[string]*runnerTagSummary)
+	for _, jobs := range stages {
+		for _, w := range jobs {
+			if w.Runner == nil || w.Start.IsZero() || w.Finish.IsZero() {
+				continue
+			}
+
+			tags := w.Runner.Tags
+			if len(tags) == 0 {
+				tags = []string{untaggedRunners}
+			}
+			for _, tag := range tags {
+				s, ok := summaries[tag]
+				if !ok {
+					s = &runnerTagSummary{}
+					summaries[tag] = s
+				}
+				if s.Start.IsZero() || w.Start.Before(s.Start) {
+					s.Start = w.Start
+				}
+				if w.Finish.After(s.Finish) {
+					s.Finish = w.Finish
+				}
+				s.Jobs++
+				if w.Status == "failed" {
+					s.Failed++
+				}
+				s.Queued += w.Queued
+				if w.Queued > s.MaxQueued {
+					s.MaxQueued = w.Queued
+				}
+			}
+		}
+	}
+
+	return summaries
+}
+
+// emitRunnerTags sends a span for each runner tag used by a finished
+// pipeline, rolling up the queue time and failures of the jobs on runners
+// with that tag, so that runner pools can be compared.
+func (l *Listener) emitRunnerTags(p types.PipelineEventPayload, d *delivery) {
+	pipelineID := p.ObjectAttributes.ID
+	summaries := l.stages.runnerTags(pipelineID)
+
+	tags := make([]string, 0, len(summaries))
+	for tag := range summaries {
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+
+	traceID := l.pipelineTraceID(pipelineID)
+	for _, tag := range tags {
+		s := summaries[tag]
+		l.emit(Span{
+			ServiceName: "runner_tag",
+			TraceID:     traceID,
+			SpanID:      fmt.Sprintf("%d-runner-tag-%s", pipelineID, tag),
+			ParentID:    fmt.Sprint(pipelineID),
+			Name:        tag,
+			Timestamp:   s.Start,
+			Duration:    s.Finish.Sub(s.Start),
+			Fields: map[string]interface{}{
+				"ci_provider":             "GitLab-CI",
+				"branch":                  p.ObjectAttributes.Ref,
+				"build_num":               pipelineID,
+				"repo":                    p.Project.WebURL,
+				"ci_runner_tag":           tag,
+				"ci_runner_jobs":          s.Jobs,
+				"ci_runner_failed":        s.Failed,
+				"ci_runner_failure_rate":  float64(s.Failed) / float64(s.Jobs),
+				"ci_runner_queued_ms":     s.Queued.Milliseconds(),
+				"ci_runner_queued_ms_avg": float64(s.Queued.Milliseconds()) / float64(s.Jobs),
+				"ci_runner_queued_ms_max": s.MaxQueued.Milliseconds(),
+			},
+		}, d)
+	}
+}
@@ -0,0 +1,70 @@
+package hook
+
+import (
+	"testing"
+	"time"
+
+	"github.com/zoidyzoidzoid/gitlab-honeycomb-buildevents-webhooks-sink/internal/hook/types"
+)
+
+func Test_emitRunnerTags(t *testing.T) {
+	sink := &MemorySink{}
+	l, err := New(Config{Version: "dev", Sink: sink})
+	if err != nil {
+		t.Fatalf("failed to create listener: %s", err)
+	}
+
+	start := time.Date(2022, 10, 17, 14, 0, 0, 0, time.UTC)
+	docker := types.Runner{ID: 1, Description: "docker-1", RunnerType: "instance_type", IsShared: true, Tags: []string{"docker", "linux"}}
+	macos := types.Runner{ID: 2, Description: "mac-mini", RunnerType: "project_type", Tags: []string{"macos"}}
+	for _, j := range []types.JobEventPayload{
+		{BuildID: 1, BuildName: "unit", BuildStatus: "success", BuildQueuedDuration: 10, Runner: docker},
+		{BuildID: 2, BuildName: "lint", BuildStatus: "failed", BuildQueuedDuration: 30, Runner: docker},
+		{BuildID: 3, BuildName: "ios", BuildStatus: "success", BuildQueuedDuration: 600, Runner: macos},
+	} {
+		j.BuildStage, j.PipelineID = "test", 42
+		j.BuildStartedAt, j.BuildFinishedAt, j.BuildDuration = types.GitLabTimestamp(start), types.GitLabTimestamp(start.Add(time.Minute)), 60
+		err = l.handleJob(j, nil)
+		if err != nil {
+			t.Fatalf("failed to handle job %d: %s", j.BuildID, err)
+		}
+	}
+
+	err = l.handlePipeline(types.PipelineEventPayload{
+		ObjectAttributes: types.PipelineObjectAttributes{
+			ID:        42,
+			Status:    "failed",
+			CreatedAt: types.GitLabTimestamp(start),
+			Duration:  60,
+		},
+	}, nil)
+	if err != nil {
+		t.Fatalf("failed to handle pipeline: %s", err)
+	}
+
+	tags := make(map[string]Span)
+	for _, span := range sink.Spans() {
+		switch span.ServiceName {
+		case "runner_tag":
+			tags[span.Name] = span
+		case "job":
+			if span.Name == "unit" && (span.Fields["ci_runner_tags"] != "docker,linux" || span.Fields["ci_runner_type"] != "instance" || span.Fields["ci_runner_shared"] != true) {
+				t.Errorf("job runner fields = %v, want the docker runner", span.Fields)
+			}
+		}
+	}
+
+	if len(tags) != 3 {
+		t.Fatalf("runner tag spans = %v, want docker, linux and macos", tags)
+	}
+	dockerTag := tags["docker"]
+	if dockerTag.ParentID != "42" || dockerTag.Fields["ci_runner_jobs"] != 2 || dockerTag.Fields["ci_runner_failure_rate"] != 0.5 {
+		t.Errorf("docker tag = %+v, want 2 jobs with half failed", dockerTag)
+	}
+	if dockerTag.Fields["ci_runner_queued_ms_avg"] != 20000.0 || dockerTag.Fields["ci_runner_queued_ms_max"] != int64(30000) {
+		t.Errorf("docker tag queue fields = %v, want an average of 20s and a max of 30s", dockerTag.Fields)
+	}
+	if tags["macos"].Fields["ci_runner_queued_ms_avg"] != 600000.0 {
+		t.Errorf("macos tag queue fields = %v, want an average of 10m", tags["macos"].Fields)
+	}
+}
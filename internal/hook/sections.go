@@ -0,0 +1,130 @@
+package hook
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/zoidyzoidzoid/gitlab-honeycomb-buildevents-webhooks-sink/internal/hook/types"
+)
+
+// sectionMarker matches the markers runners write to job logs around
+// sections, e.g. section_start:1560896352:restore_cache[collapsed=true].
+var sectionMarker = regexp.MustCompile(`section_(start|end):(\d+):([A-Za-z0-9_.-]+)`)
+
+// logSection is a section of a job's log.
+type logSection struct {
+	Name   string
+	Start  time.Time
+	End    time.Time
+	Depth  int
+	Parent int // The index of the enclosing section, or -1.
+}
+
+// parseSections returns the sections of a job's log, in the order they
+// started. Sections that end without their inner sections ending close those
+// too, and sections that never end are closed at end.
+func parseSections(trace []byte, end time.Time) []logSection {
+	var sections []logSection
+	var open []int
+
+	closeTo := func(depth int, at time.Time) {
+		for len(open) > depth {
+			sections[open[len(open)-1]].End = at
+			open = open[:len(open)-1]
+		}
+	}
+
+	for _, m := range sectionMarker.FindAllSubmatch(trace, -1) {
+		seconds, err := strconv.ParseInt(string(m[2]), 10, 64)
+		if err != nil {
+			continue
+		}
+		at := time.Unix(seconds, 0).UTC()
+		name := string(m[3])
+
+		if string(m[1]) == "start" {
+			parent := -1
+			if len(open) > 0 {
+				parent = open[len(open)-1]
+			}
+			sections = append(sections, logSection{Name: name, Start: at, Depth: len(open), Parent: parent})
+			open = append(open, len(sections)-1)
+			continue
+		}
+
+		// Ends without a matching start are ignored.
+		for depth := len(open) - 1; depth >= 0; depth-- {
+			if sections[open[depth]].Name == name {
+				closeTo(depth, at)
+				break
+			}
+		}
+	}
+	closeTo(0, end)
+
+	return sections
+}
+
+// sectionSpanID returns the span ID of the i-th section of a job's log.
+func sectionSpanID(jobSpanID string, i int) string {
+	return fmt.Sprintf("%s-section-%d", jobSpanID, i)
+}
+
+// emitSections fetches a finished job's log from the GitLab API and sends
+// its sections as child spans of the job's span. Failures are logged, and
+// the job's span is still sent.
+func (l *Listener) emitSections(j types.JobEventPayload, d *delivery) {
+	if !l.Config.JobSections || l.gitlab == nil || j.ProjectID == 0 {
+		return
+	}
+	start, duration, started := jobTiming(j)
+	if !started {
+		return
+	}
+	if !l.jobSpans.Add(fmt.Sprintf("sections:%d", j.BuildID), struct{}{}) {
+		return
+	}
+
+	ctx, cancel := l.gitLabContext()
+	defer cancel()
+
+	// Logs are only read once, so they aren't cached.
+	trace, err := l.gitlab.fetch(ctx, fmt.Sprintf("/projects/%d/jobs/%d/trace", j.ProjectID, j.BuildID))
+	if err != nil {
+		log.Printf("failed to fetch log sections of job %d: %s", j.BuildID, err)
+		return
+	}
+
+	jobID := jobSpanID(j.BuildName, j.BuildID)
+	traceID := l.pipelineTraceID(j.PipelineID)
+	for i, s := range parseSections(trace, start.Add(duration)) {
+		parentID := jobID
+		if s.Parent >= 0 {
+			parentID = sectionSpanID(jobID, s.Parent)
+		}
+
+		l.emit(Span{
+			ServiceName: "section",
+			TraceID:     traceID,
+			SpanID:      sectionSpanID(jobID, i),
+			ParentID:    parentID,
+			Name:        s.Name,
+			Timestamp:   s.Start,
+			Duration:    s.End.Sub(s.Start),
+			Fields: map[string]interface{}{
+				"ci_provider":   "GitLab-CI",
+				"branch":        j.Ref,
+				"build_num":     j.PipelineID,
+				"build_id":      j.BuildID,
+				"job_name":      j.BuildName,
+				"stage":         j.BuildStage,
+				"repo":          j.Repository.Homepage,
+				"section":       s.Name,
+				"section_depth": s.Depth,
+			},
+		}, d)
+	}
+}
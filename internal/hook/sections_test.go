@@ -0,0 +1,102 @@
+package hook
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/zoidyzoidzoid/gitlab-honeycomb-buildevents-webhooks-sink/internal/hook/types"
+)
+
+func Test_parseSections(t *testing.T) {
+	at := func(seconds int64) time.Time { return time.Unix(seconds, 0).UTC() }
+
+	trace := "\x1b[0Ksection_start:100:prepare_executor\r\x1b[0KPreparing\n" +
+		"\x1b[0Ksection_end:105:prepare_executor\r\x1b[0K\n" +
+		"\x1b[0Ksection_start:105:step_script\r\x1b[0K\n" +
+		"\x1b[0Ksection_start:106:install[collapsed=true]\r\x1b[0K$ npm ci\n" +
+		"\x1b[0Ksection_start:107:postinstall\r\x1b[0K\n" +
+		// The end of install closes postinstall too.
+		"\x1b[0Ksection_end:110:install\r\x1b[0K\n" +
+		"\x1b[0Ksection_end:110:never_started\r\x1b[0K\n" +
+		"\x1b[0Ksection_end:120:step_script\r\x1b[0K\n" +
+		// The log was cut off before upload_artifacts ended.
+		"\x1b[0Ksection_start:121:upload_artifacts_on_success\r\x1b[0K\n"
+
+	want := []logSection{
+		{Name: "prepare_executor", Start: at(100), End: at(105), Depth: 0, Parent: -1},
+		{Name: "step_script", Start: at(105), End: at(120), Depth: 0, Parent: -1},
+		{Name: "install", Start: at(106), End: at(110), Depth: 1, Parent: 1},
+		{Name: "postinstall", Start: at(107), End: at(110), Depth: 2, Parent: 2},
+		{Name: "upload_artifacts_on_success", Start: at(121), End: at(130), Depth: 0, Parent: -1},
+	}
+	if got := parseSections([]byte(trace), at(130)); !reflect.DeepEqual(got, want) {
+		t.Errorf("parseSections() = %+v, want %+v", got, want)
+	}
+}
+
+func Test_emitSections(t *testing.T) {
+	gitlab := newFakeGitLab(t, map[string]string{
+		"/api/v4/projects/3/jobs/10/trace": "section_start:1666015200:get_sources\r\x1b[0K\n" +
+			"section_end:1666015203:get_sources\r\x1b[0K\n" +
+			"section_start:1666015203:step_script\r\x1b[0K\n" +
+			"section_start:1666015204:tests\r\x1b[0K\n" +
+			"section_end:1666015250:tests\r\x1b[0K\n" +
+			"section_end:1666015255:step_script\r\x1b[0K\n",
+	})
+
+	sink := &MemorySink{}
+	l, err := New(Config{Version: "dev", Sink: sink, GitLab: gitlab.config(), JobSections: true})
+	if err != nil {
+		t.Fatalf("failed to create listener: %s", err)
+	}
+
+	job := types.JobEventPayload{
+		BuildID:        10,
+		BuildName:      "unit",
+		BuildStage:     "test",
+		BuildStatus:    "success",
+		BuildStartedAt: types.GitLabTimestamp(time.Unix(1666015200, 0)),
+		BuildDuration:  60,
+		PipelineID:     42,
+		ProjectID:      3,
+	}
+	for i := 0; i < 2; i++ {
+		err = l.handleJob(job, nil)
+		if err != nil {
+			t.Fatalf("failed to handle job: %s", err)
+		}
+	}
+
+	spans := sink.Spans()
+	if len(spans) != 4 {
+		t.Fatalf("sent %d spans, want the job and its 3 sections once", len(spans))
+	}
+	if got := gitlab.count("/api/v4/projects/3/jobs/10/trace"); got != 1 {
+		t.Errorf("log was fetched %d times, want once", got)
+	}
+
+	jobID := jobSpanID("unit", 10)
+	tests := []struct {
+		name     string
+		parentID string
+		duration time.Duration
+	}{
+		{"get_sources", jobID, 3 * time.Second},
+		{"step_script", jobID, 52 * time.Second},
+		{"tests", sectionSpanID(jobID, 1), 46 * time.Second},
+	}
+	for i, tt := range tests {
+		s := spans[i+1]
+		if s.Name != tt.name || s.ParentID != tt.parentID || s.Duration != tt.duration || s.TraceID != "42" {
+			t.Errorf("section %d = %s parent %s for %s in %s, want %s parent %s for %s in 42", i, s.Name, s.ParentID, s.Duration, s.TraceID, tt.name, tt.parentID, tt.duration)
+		}
+	}
+}
+
+func Test_emitSectionsNeedsGitLab(t *testing.T) {
+	_, err := New(Config{Version: "dev", Sink: &MemorySink{}, JobSections: true})
+	if err == nil {
+		t.Error("New() with job sections and no GitLab API succeeded, want an error")
+	}
+}
@@ -0,0 +1,115 @@
+package hook
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"sync"
+	"time"
+)
+
+// Span is a backend-neutral span built from a webhook. Trace and span IDs
+// follow buildevents, so that spans sent by the buildevents CLI from inside a
+// job join the same trace.
+type Span struct {
+	TraceID     string                 `json:"trace_id"`
+	SpanID      string                 `json:"span_id"`
+	ParentID    string                 `json:"parent_id,omitempty"`
+	Name        string                 `json:"name"`
+	ServiceName string                 `json:"service_name"`
+	Timestamp   time.Time              `json:"timestamp"`
+	Duration    time.Duration          `json:"duration_ns"`
+	Fields      map[string]interface{} `json:"fields"`
+	Links       []SpanLink             `json:"links,omitempty"`
+}
+
+// SpanLink links a span to a span in another trace.
+type SpanLink struct {
+	TraceID string `json:"trace_id"`
+	SpanID  string `json:"span_id"`
+}
+
+// Sink sends spans to a backend.
+type Sink interface {
+	// Send sends span. done must be called exactly once, when the span has
+	// been sent or the sink has given up on it, and may be called before
+	// Send returns.
+	Send(span Span, done func())
+	// Flush sends any buffered spans.
+	Flush() error
+	// Close flushes and releases the sink.
+	Close() error
+}
+
+// emit sends span to the sink, tracking it as part of d.
+func (l *Listener) emit(span Span, d *delivery) {
+	d.add()
+	l.sink.Send(span, d.finish)
+}
+
+// MemorySink keeps spans in memory. It's intended for tests.
+type MemorySink struct {
+	mu    sync.Mutex
+	spans []Span
+}
+
+// Send records span.
+func (s *MemorySink) Send(span Span, done func()) {
+	s.mu.Lock()
+	s.spans = append(s.spans, span)
+	s.mu.Unlock()
+	done()
+}
+
+// Spans returns the spans sent so far.
+func (s *MemorySink) Spans() []Span {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Span(nil), s.spans...)
+}
+
+// Flush does nothing.
+func (s *MemorySink) Flush() error {
+	return nil
+}
+
+// Close does nothing.
+func (s *MemorySink) Close() error {
+	return nil
+}
+
+// JSONLinesSink writes each span as a line of JSON.
+type JSONLinesSink struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+// NewJSONLinesSink returns a sink writing to w. The caller is responsible
+// for closing w.
+func NewJSONLinesSink(w io.Writer) *JSONLinesSink {
+	return &JSONLinesSink{
+		enc: json.NewEncoder(w),
+	}
+}
+
+// Send writes span to the sink's writer.
+func (s *JSONLinesSink) Send(span Span, done func()) {
+	defer done()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err := s.enc.Encode(span)
+	if err != nil {
+		log.Printf("failed to write span: %s", err)
+	}
+}
+
+// Flush does nothing, as spans are written as they're sent.
+func (s *JSONLinesSink) Flush() error {
+	return nil
+}
+
+// Close does nothing, as the sink doesn't own its writer.
+func (s *JSONLinesSink) Close() error {
+	return nil
+}
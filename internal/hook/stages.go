@@ -0,0 +1,236 @@
+package hook
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/zoidyzoidzoid/gitlab-honeycomb-buildevents-webhooks-sink/internal/hook/types"
+)
+
+const (
+	// pipelinesTracked is the maximum number of pipelines whose job timings
+	// are remembered.
+	pipelinesTracked = 10000
+	// pipelineTTL is how long a pipeline's job timings are remembered.
+	pipelineTTL = 24 * time.Hour
+)
+
+// jobWindow is when a job ran, how it finished, and the runner it ran on.
+// Jobs that never ran have no start or finish.
+type jobWindow struct {
+	Name   string
+	Start  time.Time
+	Finish time.Time
+	Status string
+	Queued time.Duration
+	Runner *types.Runner
+}
+
+// jobWindowOf returns the window of a job.
+func jobWindowOf(j types.JobEventPayload) jobWindow {
+	w := jobWindow{
+		Name:   j.BuildName,
+		Start:  time.Time(j.BuildStartedAt),
+		Finish: time.Time(j.BuildFinishedAt),
+		Status: j.BuildStatus,
+		Queued: time.Duration(j.BuildQueuedDuration * float64(time.Second)),
+	}
+	if j.Runner.ID != 0 {
+		runner := j.Runner
+		w.Runner = &runner
+	}
+	return w
+}
+
+// pipelineStages is the job windows of a pipeline, by stage and job ID.
+type pipelineStages map[string]map[int64]jobWindow
+
+// stageTracker remembers when the jobs of recent pipelines ran, so that stage
+// spans can be built from Job Hooks as well as the pipeline's builds.
+type stageTracker struct {
+	mu        sync.Mutex
+	pipelines *ttlCache[pipelineStages]
+}
+
+func newStageTracker() *stageTracker {
+	return &stageTracker{
+		pipelines: newTTLCache[pipelineStages](pipelinesTracked, pipelineTTL),
+	}
+}
+
+// addJob records when a pipeline's job ran. Jobs that never ran are recorded
+// too, so that their stage is still sent.
+func (t *stageTracker) addJob(pipelineID int64, stage string, jobID int64, w jobWindow) {
+	if stage == "" {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	key := fmt.Sprint(pipelineID)
+	stages, ok := t.pipelines.Get(key)
+	if !ok {
+		stages = make(pipelineStages)
+	}
+	if stages[stage] == nil {
+		stages[stage] = make(map[int64]jobWindow)
+	}
+	stages[stage][jobID] = w
+	t.pipelines.Set(key, stages)
+}
+
+// stageSummary is the time covered by a stage's jobs. Start and Finish are
+// zero when none of its jobs ran.
+type stageSummary struct {
+	Start  time.Time
+	Finish time.Time
+	Jobs   int
+	Status string
+}
+
+// summaries returns the time covered by each of a pipeline's stages.
+func (t *stageTracker) summaries(pipelineID int64) map[string]stageSummary {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	stages, ok := t.pipelines.Get(fmt.Sprint(pipelineID))
+	if !ok {
+		return nil
+	}
+
+	summaries := make(map[string]stageSummary, len(stages))
+	for stage, jobs := range stages {
+		var s stageSummary
+		// A retried job's status is that of its latest attempt, which has
+		// the highest ID.
+		latest := make(map[string]int64)
+		for id, w := range jobs {
+			if !w.Start.IsZero() && !w.Finish.IsZero() {
+				if s.Start.IsZero() || w.Start.Before(s.Start) {
+					s.Start = w.Start
+				}
+				if w.Finish.After(s.Finish) {
+					s.Finish = w.Finish
+				}
+			}
+			name := w.Name
+			if name == "" {
+				name = fmt.Sprint(id)
+			}
+			if id > latest[name] {
+				latest[name] = id
+			}
+			s.Jobs++
+		}
+		statuses := make(map[string]bool)
+		for _, id := range latest {
+			statuses[jobs[id].Status] = true
+		}
+		s.Status = stageStatus(statuses)
+		summaries[stage] = s
+	}
+
+	return summaries
+}
+
+// stageStatus returns the status of a stage from the statuses of its jobs.
+func stageStatus(statuses map[string]bool) string {
+	for _, status := range []string{"failed", "canceled", "success"} {
+		if statuses[status] {
+			return status
+		}
+	}
+	for status := range statuses {
+		return status
+	}
+	return ""
+}
+
+// stageSpanID returns the span ID of a pipeline's stage. It only depends on
+// the pipeline and the stage name, so jobs can be parented to it before it's
+// sent.
+func stageSpanID(pipelineID int64, stage string) string {
+	return fmt.Sprintf("%d-stage-%s", pipelineID, stage)
+}
+
+// jobParentID returns the span ID that a job's span is parented to.
+func jobParentID(pipelineID int64, stage string) string {
+	if stage == "" {
+		return fmt.Sprint(pipelineID)
+	}
+	return stageSpanID(pipelineID, stage)
+}
+
+// emitStages sends a span for each stage of a finished pipeline, covering
+// the first start to the last finish of its jobs. Stages whose jobs never ran
+// are sent as zero-length spans when the pipeline was created, so that their
+// jobs' spans have a parent.
+func (l *Listener) emitStages(p types.PipelineEventPayload, d *delivery) {
+	pipelineID := p.ObjectAttributes.ID
+	for _, b := range p.Builds {
+		l.stages.addJob(pipelineID, b.Stage, b.ID, jobWindowOf(jobEventFromBuild(p, b)))
+	}
+
+	summaries := l.stages.summaries(pipelineID)
+	if len(summaries) == 0 {
+		return
+	}
+
+	// Stages are sent in the pipeline's order, followed by any the pipeline
+	// didn't list.
+	order := make(map[string]int, len(p.ObjectAttributes.Stages))
+	for i, stage := range p.ObjectAttributes.Stages {
+		order[stage] = i
+	}
+	names := make([]string, 0, len(summaries))
+	for stage := range summaries {
+		names = append(names, stage)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		oi, iok := order[names[i]]
+		oj, jok := order[names[j]]
+		if iok != jok {
+			return iok
+		}
+		if oi != oj {
+			return oi < oj
+		}
+		return names[i] < names[j]
+	})
+
+	traceID := l.pipelineTraceID(pipelineID)
+	for _, stage := range names {
+		s := summaries[stage]
+		index, ok := order[stage]
+		if !ok {
+			index = -1
+		}
+		if s.Start.IsZero() {
+			s.Start = time.Time(p.ObjectAttributes.CreatedAt)
+			s.Finish = s.Start
+		}
+
+		l.emit(Span{
+			ServiceName: "stage",
+			TraceID:     traceID,
+			SpanID:      stageSpanID(pipelineID, stage),
+			ParentID:    fmt.Sprint(pipelineID),
+			Name:        stage,
+			Timestamp:   s.Start,
+			Duration:    s.Finish.Sub(s.Start),
+			Fields: map[string]interface{}{
+				"ci_provider": "GitLab-CI",
+				"branch":      p.ObjectAttributes.Ref,
+				"build_num":   pipelineID,
+				"repo":        p.Project.WebURL,
+				"stage":       stage,
+				"stage_index": index,
+				"stage_jobs":  s.Jobs,
+				"status":      s.Status,
+			},
+		}, d)
+	}
+}
@@ -0,0 +1,109 @@
+package hook
+
+import (
+	"testing"
+	"time"
+
+	"github.com/zoidyzoidzoid/gitlab-honeycomb-buildevents-webhooks-sink/internal/hook/types"
+)
+
+func Test_emitStages(t *testing.T) {
+	sink := &MemorySink{}
+	l, err := New(Config{Version: "dev", Sink: sink})
+	if err != nil {
+		t.Fatalf("failed to create listener: %s", err)
+	}
+
+	start := time.Date(2022, 10, 17, 14, 0, 0, 0, time.UTC)
+	at := func(d time.Duration) types.GitLabTimestamp { return types.GitLabTimestamp(start.Add(d)) }
+
+	// A Job Hook for a job that isn't in the pipeline's builds still counts
+	// towards its stage.
+	err = l.handleJob(types.JobEventPayload{
+		BuildID:         3,
+		BuildName:       "lint",
+		BuildStage:      "test",
+		BuildStatus:     "failed",
+		BuildStartedAt:  at(time.Minute),
+		BuildFinishedAt: at(4 * time.Minute),
+		BuildDuration:   180,
+		PipelineID:      42,
+	}, nil)
+	if err != nil {
+		t.Fatalf("failed to handle job: %s", err)
+	}
+	// A job that never ran still gets its stage sent.
+	err = l.handleJob(types.JobEventPayload{
+		BuildID:        4,
+		BuildName:      "release",
+		BuildStage:     "deploy",
+		BuildStatus:    "skipped",
+		BuildCreatedAt: at(0),
+		PipelineID:     42,
+	}, nil)
+	if err != nil {
+		t.Fatalf("failed to handle job: %s", err)
+	}
+
+	err = l.handlePipeline(types.PipelineEventPayload{
+		ObjectAttributes: types.PipelineObjectAttributes{
+			ID:        42,
+			Status:    "failed",
+			Stages:    []string{"build", "test"},
+			CreatedAt: types.GitLabTimestamp(start),
+			Duration:  300,
+		},
+		Builds: []types.Build{
+			// The build stage's failed job was retried and passed.
+			{ID: 1, Stage: "build", Name: "compile", Status: "failed", StartedAt: at(0), FinishedAt: at(30 * time.Second)},
+			{ID: 5, Stage: "build", Name: "compile", Status: "success", StartedAt: at(30 * time.Second), FinishedAt: at(time.Minute)},
+			{ID: 2, Stage: "test", Name: "unit", Status: "success", StartedAt: at(time.Minute), FinishedAt: at(5 * time.Minute)},
+			{ID: 4, Stage: "deploy", Name: "release", Status: "skipped"},
+		},
+	}, nil)
+	if err != nil {
+		t.Fatalf("failed to handle pipeline: %s", err)
+	}
+
+	stages := make(map[string]Span)
+	jobs := make(map[string]Span)
+	for _, span := range sink.Spans() {
+		switch span.ServiceName {
+		case "stage":
+			stages[span.Name] = span
+		case "job":
+			jobs[span.Name] = span
+		}
+	}
+
+	if len(stages) != 3 {
+		t.Fatalf("sent stages %v, want build, test and deploy", stages)
+	}
+	build, test, deploy := stages["build"], stages["test"], stages["deploy"]
+	if build.SpanID != stageSpanID(42, "build") || build.ParentID != "42" || build.TraceID != "42" {
+		t.Errorf("build stage = %+v, want a child of pipeline 42", build)
+	}
+	if !build.Timestamp.Equal(start) || build.Duration != time.Minute {
+		t.Errorf("build stage = %s for %s, want %s for 1m", build.Timestamp, build.Duration, start)
+	}
+	if build.Fields["status"] != "success" {
+		t.Errorf("build stage status = %v, want the retried job's success", build.Fields["status"])
+	}
+	if !test.Timestamp.Equal(start.Add(time.Minute)) || test.Duration != 4*time.Minute {
+		t.Errorf("test stage = %s for %s, want %s for 4m", test.Timestamp, test.Duration, start.Add(time.Minute))
+	}
+	if test.Fields["stage_jobs"] != 2 || test.Fields["status"] != "failed" || test.Fields["stage_index"] != 1 {
+		t.Errorf("test stage fields = %v, want 2 jobs, failed, index 1", test.Fields)
+	}
+
+	if !deploy.Timestamp.Equal(start) || deploy.Duration != 0 || deploy.Fields["status"] != "skipped" {
+		t.Errorf("deploy stage = %+v, want a zero-length skipped stage when the pipeline was created", deploy)
+	}
+
+	if jobs["lint"].ParentID != test.SpanID {
+		t.Errorf("lint parent = %q, want the test stage %q", jobs["lint"].ParentID, test.SpanID)
+	}
+	if jobs["release"].ParentID != deploy.SpanID {
+		t.Errorf("release parent = %q, want the deploy stage %q", jobs["release"].ParentID, deploy.SpanID)
+	}
+}
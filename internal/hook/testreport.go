@@ -0,0 +1,229 @@
+package hook
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+	"unicode/utf8"
+
+	"github.com/zoidyzoidzoid/gitlab-honeycomb-buildevents-webhooks-sink/internal/hook/types"
+)
+
+const (
+	// testCasesMax is the maximum number of test spans sent for a pipeline.
+	testCasesMax = 10000
+	// testMessageMax is the maximum length of a test's failure message.
+	testMessageMax = 1000
+)
+
+// testReport is a pipeline's test report from the GitLab API.
+type testReport struct {
+	TestSuites []testSuite `json:"test_suites"`
+}
+
+// testSuite is the tests of a job in a test report. Parallel jobs share a
+// suite.
+type testSuite struct {
+	Name         string     `json:"name"`
+	TotalTime    float64    `json:"total_time"`
+	TotalCount   int        `json:"total_count"`
+	SuccessCount int        `json:"success_count"`
+	FailedCount  int        `json:"failed_count"`
+	SkippedCount int        `json:"skipped_count"`
+	ErrorCount   int        `json:"error_count"`
+	TestCases    []testCase `json:"test_cases"`
+}
+
+// testReportSummary is a summary of a pipeline's test report from the GitLab
+// API. Unlike the report, it has the jobs that ran each suite.
+type testReportSummary struct {
+	TestSuites []struct {
+		Name     string  `json:"name"`
+		BuildIDs []int64 `json:"build_ids"`
+	} `json:"test_suites"`
+}
+
+// testCase is a test in a test report.
+type testCase struct {
+	Status        string  `json:"status"`
+	Name          string  `json:"name"`
+	Classname     string  `json:"classname"`
+	File          string  `json:"file"`
+	ExecutionTime float64 `json:"execution_time"`
+	SystemOutput  string  `json:"system_output"`
+}
+
+// truncate shortens s to at most n bytes, marking that it was cut. It's cut
+// between characters, so it's still valid UTF-8.
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	end := n - 3
+	for end > 0 && !utf8.RuneStart(s[end]) {
+		end--
+	}
+	return s[:end] + "..."
+}
+
+// suiteBuild returns the latest of a pipeline's builds that ran a suite.
+func suiteBuild(p types.PipelineEventPayload, buildIDs []int64) (types.Build, bool) {
+	var latest types.Build
+	for _, b := range p.Builds {
+		for _, id := range buildIDs {
+			if b.ID == id && b.ID > latest.ID {
+				latest = b
+			}
+		}
+	}
+	return latest, latest.ID != 0
+}
+
+// suiteBuildIDs fetches the jobs that ran each of a pipeline's suites, by the
+// suite's name. Failures are logged, and the suites are sent under the
+// pipeline instead.
+func (l *Listener) suiteBuildIDs(ctx context.Context, projectID, pipelineID int64) map[string][]int64 {
+	body, err := l.gitlab.fetch(ctx, fmt.Sprintf("/projects/%d/pipelines/%d/test_report_summary", projectID, pipelineID))
+	if err != nil {
+		log.Printf("failed to fetch test report summary of pipeline %d: %s", pipelineID, err)
+		return nil
+	}
+	var summary testReportSummary
+	err = json.Unmarshal(body, &summary)
+	if err != nil {
+		log.Printf("failed to decode test report summary of pipeline %d: %s", pipelineID, err)
+		return nil
+	}
+
+	buildIDs := make(map[string][]int64, len(summary.TestSuites))
+	for _, suite := range summary.TestSuites {
+		buildIDs[suite.Name] = suite.BuildIDs
+	}
+	return buildIDs
+}
+
+// emitTestReport fetches a finished pipeline's test report from the GitLab
+// API, and sends a span for each suite under the job that ran it, with a span
+// for each of its tests. Reports don't say when tests ran, so tests are laid
+// out one after another from the start of their job. Failures are logged,
+// and the pipeline's spans are still sent.
+func (l *Listener) emitTestReport(p types.PipelineEventPayload, d *delivery) {
+	if !l.Config.TestReports || l.gitlab == nil || p.Project.ID == 0 {
+		return
+	}
+	pipelineID := p.ObjectAttributes.ID
+
+	ctx, cancel := l.gitLabContext()
+	defer cancel()
+
+	// Reports are only read once, so they aren't cached.
+	body, err := l.gitlab.fetch(ctx, fmt.Sprintf("/projects/%d/pipelines/%d/test_report", p.Project.ID, pipelineID))
+	if err != nil {
+		log.Printf("failed to fetch test report of pipeline %d: %s", pipelineID, err)
+		return
+	}
+	var report testReport
+	err = json.Unmarshal(body, &report)
+	if err != nil {
+		log.Printf("failed to decode test report of pipeline %d: %s", pipelineID, err)
+		return
+	}
+	if len(report.TestSuites) == 0 {
+		return
+	}
+	buildIDs := l.suiteBuildIDs(ctx, p.Project.ID, pipelineID)
+
+	traceID := l.pipelineTraceID(pipelineID)
+	sent := 0
+	for i, suite := range report.TestSuites {
+		parentID := fmt.Sprint(pipelineID)
+		start := time.Time(p.ObjectAttributes.CreatedAt)
+		suiteID := fmt.Sprintf("%d-suite-%d", pipelineID, i)
+		fields := map[string]interface{}{
+			"ci_provider": "GitLab-CI",
+			"branch":      p.ObjectAttributes.Ref,
+			"build_num":   pipelineID,
+			"repo":        p.Project.WebURL,
+		}
+		if b, ok := suiteBuild(p, buildIDs[suite.Name]); ok {
+			parentID = jobSpanID(b.Name, b.ID)
+			suiteID = parentID + "-suite"
+			if startedAt := time.Time(b.StartedAt); !startedAt.IsZero() {
+				start = startedAt
+			}
+			fields["build_id"] = b.ID
+			fields["job_name"] = b.Name
+			fields["stage"] = b.Stage
+		}
+		// A pipeline finishes again when its jobs are retried, and only the
+		// suites of retried jobs are new then.
+		if !l.jobSpans.Add("tests:"+suiteID, struct{}{}) {
+			continue
+		}
+
+		suiteFields := map[string]interface{}{
+			"suite.name":    suite.Name,
+			"suite.total":   suite.TotalCount,
+			"suite.success": suite.SuccessCount,
+			"suite.failed":  suite.FailedCount,
+			"suite.skipped": suite.SkippedCount,
+			"suite.errors":  suite.ErrorCount,
+			"suite.time_ms": suite.TotalTime * 1000,
+			"error":         suite.FailedCount+suite.ErrorCount > 0,
+		}
+		for k, v := range fields {
+			suiteFields[k] = v
+		}
+		l.emit(Span{
+			ServiceName: "test_suite",
+			TraceID:     traceID,
+			SpanID:      suiteID,
+			ParentID:    parentID,
+			Name:        suite.Name,
+			Timestamp:   start,
+			Duration:    time.Duration(suite.TotalTime * float64(time.Second)),
+			Fields:      suiteFields,
+		}, d)
+
+		at := start
+		for j, tc := range suite.TestCases {
+			if sent == testCasesMax {
+				log.Printf("pipeline %d has more than %d tests, only sending the first", pipelineID, testCasesMax)
+				return
+			}
+			sent++
+
+			duration := time.Duration(tc.ExecutionTime * float64(time.Second))
+			testFields := map[string]interface{}{
+				"suite.name":     suite.Name,
+				"test.name":      tc.Name,
+				"test.classname": tc.Classname,
+				"test.status":    tc.Status,
+				"test.time_ms":   tc.ExecutionTime * 1000,
+				"error":          tc.Status == "failed" || tc.Status == "error",
+			}
+			if tc.File != "" {
+				testFields["test.file"] = tc.File
+			}
+			if tc.SystemOutput != "" && tc.Status != "success" {
+				testFields["test.failure_message"] = truncate(tc.SystemOutput, testMessageMax)
+			}
+			for k, v := range fields {
+				testFields[k] = v
+			}
+			l.emit(Span{
+				ServiceName: "test",
+				TraceID:     traceID,
+				SpanID:      fmt.Sprintf("%s-test-%d", suiteID, j),
+				ParentID:    suiteID,
+				Name:        tc.Name,
+				Timestamp:   at,
+				Duration:    duration,
+				Fields:      testFields,
+			}, d)
+			at = at.Add(duration)
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package hook
+
+import (
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/zoidyzoidzoid/gitlab-honeycomb-buildevents-webhooks-sink/internal/hook/types"
+)
+
+func Test_emitTestReport(t *testing.T) {
+	gitlab := newFakeGitLab(t, map[string]string{
+		"/api/v4/projects/3/pipelines/42/test_report": `{
+			"test_suites": [{
+				"name": "rspec",
+				"total_time": 3.5,
+				"total_count": 2,
+				"success_count": 1,
+				"failed_count": 1,
+				"test_cases": [
+					{"status": "success", "name": "passes", "classname": "spec.models.user", "execution_time": 1.5},
+					{"status": "failed", "name": "fails", "classname": "spec.models.user", "execution_time": 2, "system_output": "` + strings.Repeat("x", 2000) + `"}
+				]
+			}, {
+				"name": "orphan",
+				"total_time": 1,
+				"total_count": 0
+			}]
+		}`,
+		// Only the summary has the jobs that ran each suite.
+		"/api/v4/projects/3/pipelines/42/test_report_summary": `{
+			"test_suites": [
+				{"name": "rspec", "build_ids": [10, 11]},
+				{"name": "orphan", "build_ids": [99]}
+			]
+		}`,
+	})
+
+	sink := &MemorySink{}
+	l, err := New(Config{Version: "dev", Sink: sink, GitLab: gitlab.config(), TestReports: true})
+	if err != nil {
+		t.Fatalf("failed to create listener: %s", err)
+	}
+
+	created := time.Date(2022, 10, 17, 14, 0, 0, 0, time.UTC)
+	started := created.Add(time.Minute)
+	p := types.PipelineEventPayload{
+		ObjectAttributes: types.PipelineObjectAttributes{
+			ID:        42,
+			Status:    "failed",
+			CreatedAt: types.GitLabTimestamp(created),
+		},
+		Project: types.Project{ID: 3},
+		Builds: []types.Build{
+			{ID: 10, Name: "rspec", Stage: "test", Status: "failed"},
+			{ID: 11, Name: "rspec", Stage: "test", Status: "failed", StartedAt: types.GitLabTimestamp(started)},
+		},
+	}
+	for i := 0; i < 2; i++ {
+		l.emitTestReport(p, nil)
+	}
+
+	spans := sink.Spans()
+	if len(spans) != 4 {
+		t.Fatalf("sent %d spans, want 2 suites and 2 tests once: %+v", len(spans), spans)
+	}
+
+	jobID := jobSpanID("rspec", 11)
+	suite := spans[0]
+	if suite.ServiceName != "test_suite" || suite.ParentID != jobID || !suite.Timestamp.Equal(started) || suite.Duration != 3500*time.Millisecond {
+		t.Errorf("suite = %+v, want a span under the latest rspec job", suite)
+	}
+	if suite.Fields["suite.failed"] != 1 || suite.Fields["error"] != true {
+		t.Errorf("suite fields = %v, want 1 failed test", suite.Fields)
+	}
+
+	failed := spans[2]
+	if failed.ServiceName != "test" || failed.ParentID != suite.SpanID || !failed.Timestamp.Equal(started.Add(1500*time.Millisecond)) || failed.Duration != 2*time.Second {
+		t.Errorf("test = %+v, want a span after the first test", failed)
+	}
+	if failed.Fields["test.classname"] != "spec.models.user" || failed.Fields["test.status"] != "failed" || failed.Fields["error"] != true {
+		t.Errorf("test fields = %v, want the failed test", failed.Fields)
+	}
+	if msg, _ := failed.Fields["test.failure_message"].(string); len(msg) != testMessageMax {
+		t.Errorf("failure message is %d long, want it truncated to %d", len(msg), testMessageMax)
+	}
+
+	orphan := spans[3]
+	if orphan.ParentID != "42" || !orphan.Timestamp.Equal(created) {
+		t.Errorf("orphan suite = %+v, want a span under the pipeline", orphan)
+	}
+}
+
+func Test_truncate(t *testing.T) {
+	tests := []struct {
+		s    string
+		n    int
+		want string
+	}{
+		{"short", 10, "short"},
+		{"abcdefghijkl", 10, "abcdefg..."},
+		// "é" is 2 bytes, and isn't split.
+		{"ééééééé", 10, "ééé..."},
+	}
+	for _, tt := range tests {
+		if got := truncate(tt.s, tt.n); got != tt.want || !utf8.ValidString(got) {
+			t.Errorf("truncate(%q, %d) = %q, want %q", tt.s, tt.n, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,177 @@
+package hook
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/zoidyzoidzoid/gitlab-honeycomb-buildevents-webhooks-sink/internal/hook/types"
+)
+
+const (
+	// jobsTracked is the maximum number of jobs remembered, to link later
+	// webhooks about them back to their span.
+	jobsTracked = 100000
+	// jobTTL is how long a job is remembered for.
+	jobTTL = 7 * 24 * time.Hour
+)
+
+// jobRef is what's remembered about a job's span.
+type jobRef struct {
+	PipelineID int64
+	Name       string
+	SpanID     string
+}
+
+// jobSpanID returns the span ID of a job, which buildevents derives from the
+// job's name and ID.
+func jobSpanID(name string, id int64) string {
+	buildNameWithId := fmt.Sprintf("%s%d", name, id)
+	md5HashInBytes := md5.Sum([]byte(buildNameWithId))
+	return hex.EncodeToString(md5HashInBytes[:])
+}
+
+// rememberJob records the span of a job, so that deployments and downstream
+// pipelines can be linked to it, and counts it as an attempt of its name.
+func (l *Listener) rememberJob(pipelineID int64, name string, id int64) {
+	l.jobs.Set(fmt.Sprint(id), jobRef{
+		PipelineID: pipelineID,
+		Name:       name,
+		SpanID:     jobSpanID(name, id),
+	})
+	l.attempts.add(pipelineID, name, id)
+}
+
+// attemptTracker remembers the builds of each job in recent pipelines. A
+// retried job gets a new build ID with the same name, so the builds of a
+// name are its attempts, in build ID order.
+type attemptTracker struct {
+	mu     sync.Mutex
+	builds *ttlCache[[]int64]
+}
+
+func newAttemptTracker() *attemptTracker {
+	return &attemptTracker{
+		builds: newTTLCache[[]int64](jobsTracked, jobTTL),
+	}
+}
+
+func attemptKey(pipelineID int64, name string) string {
+	return fmt.Sprintf("%d/%s", pipelineID, name)
+}
+
+// add records a build of a pipeline's job.
+func (t *attemptTracker) add(pipelineID int64, name string, buildID int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	key := attemptKey(pipelineID, name)
+	builds, _ := t.builds.Get(key)
+	i := sort.Search(len(builds), func(i int) bool { return builds[i] >= buildID })
+	if i < len(builds) && builds[i] == buildID {
+		return
+	}
+
+	updated := make([]int64, 0, len(builds)+1)
+	updated = append(updated, builds[:i]...)
+	updated = append(updated, buildID)
+	updated = append(updated, builds[i:]...)
+	t.builds.Set(key, updated)
+}
+
+// get returns the builds of a pipeline's job, oldest first.
+func (t *attemptTracker) get(pipelineID int64, name string) []int64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	builds, _ := t.builds.Get(attemptKey(pipelineID, name))
+	return builds
+}
+
+// addAttempt adds the attempt fields to a job's span, and links it to the
+// job's earlier attempts. Job Hooks count the job's retries, so the attempt
+// is right even when the earlier attempts weren't seen, e.g. after a restart.
+// Pipeline Hooks don't, so their builds are counted instead.
+func (l *Listener) addAttempt(j types.JobEventPayload, span *Span) {
+	builds := l.attempts.get(j.PipelineID, j.BuildName)
+	i := sort.Search(len(builds), func(i int) bool { return builds[i] >= j.BuildID })
+	if i == len(builds) || builds[i] != j.BuildID {
+		builds, i = []int64{j.BuildID}, 0
+	}
+
+	attempt := max(i, j.RetriesCount) + 1
+	span.Fields["attempt"] = attempt
+	span.Fields["retried"] = attempt > 1
+	if i > 0 {
+		span.Fields["previous_build_id"] = builds[i-1]
+	}
+	for _, id := range builds[:i] {
+		span.Links = append(span.Links, SpanLink{
+			TraceID: span.TraceID,
+			SpanID:  jobSpanID(j.BuildName, id),
+		})
+	}
+}
+
+// jobEventFromBuild returns the Job Hook that GitLab would have sent for one
+// of a pipeline's builds.
+func jobEventFromBuild(p types.PipelineEventPayload, b types.Build) types.JobEventPayload {
+	j := types.JobEventPayload{
+		ObjectKind:          "build",
+		Ref:                 p.ObjectAttributes.Ref,
+		Tag:                 p.ObjectAttributes.Tag,
+		SHA:                 p.ObjectAttributes.SHA,
+		BeforeSHA:           p.ObjectAttributes.BeforeSHA,
+		BuildID:             b.ID,
+		BuildName:           b.Name,
+		BuildStage:          b.Stage,
+		BuildStatus:         b.Status,
+		BuildCreatedAt:      b.CreatedAt,
+		BuildStartedAt:      b.StartedAt,
+		BuildFinishedAt:     b.FinishedAt,
+		BuildDuration:       b.Duration,
+		BuildQueuedDuration: b.QueuedDuration,
+		BuildAllowFailure:   b.AllowFailure,
+		BuildFailureReason:  b.FailureReason,
+		PipelineID:          p.ObjectAttributes.ID,
+		ProjectID:           p.Project.ID,
+		ProjectName:         p.Project.Name,
+		User:                b.User,
+		Repository:          types.Repository{Name: p.Project.Name, Homepage: p.Project.WebURL},
+		Runner:              b.Runner,
+	}
+
+	startedAt, finishedAt := time.Time(b.StartedAt), time.Time(b.FinishedAt)
+	if j.BuildDuration == 0 && !startedAt.IsZero() && !finishedAt.IsZero() {
+		j.BuildDuration = finishedAt.Sub(startedAt).Seconds()
+	}
+
+	return j
+}
+
+// emitBuilds sends job spans for the builds of a finished pipeline, so that
+// Pipeline Hooks alone are enough for complete traces.
+func (l *Listener) emitBuilds(p types.PipelineEventPayload, d *delivery) {
+	// Every build is remembered before any are sent, so that retried jobs
+	// know about all of their attempts.
+	jobs := make([]types.JobEventPayload, 0, len(p.Builds))
+	for _, b := range p.Builds {
+		j := jobEventFromBuild(p, b)
+		l.rememberJob(j.PipelineID, j.BuildName, j.BuildID)
+		jobs = append(jobs, j)
+	}
+
+	for _, j := range jobs {
+		if !finishedStatuses[j.BuildStatus] && j.BuildStatus != "manual" {
+			continue
+		}
+		err := l.emitJob(j, d)
+		if err != nil {
+			log.Printf("failed to send job %d from pipeline %d: %s", j.BuildID, j.PipelineID, err)
+		}
+	}
+}
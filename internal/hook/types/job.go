@@ -11,12 +11,14 @@ type JobEventPayload struct {
 	BuildName           string          `json:"build_name"`
 	BuildStage          string          `json:"build_stage"`
 	BuildStatus         string          `json:"build_status"`
+	BuildCreatedAt      GitLabTimestamp `json:"build_created_at,omitempty"`
 	BuildStartedAt      GitLabTimestamp `json:"build_started_at,omitempty"`
 	BuildFinishedAt     GitLabTimestamp `json:"build_finished_at,omitempty"`
 	BuildDuration       float64         `json:"build_duration"`
 	BuildAllowFailure   bool            `json:"build_allow_failure"`
 	BuildFailureReason  string          `json:"build_failure_reason"`
 	BuildQueuedDuration float64         `json:"build_queued_duration"`
+	RetriesCount        int             `json:"retries_count"`
 	PipelineID          int64           `json:"pipeline_id"`
 	ProjectID           int64           `json:"project_id"`
 	ProjectName         string          `json:"project_name"`
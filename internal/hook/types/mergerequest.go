@@ -2,31 +2,68 @@ package types
 
 import "time"
 
+// MergeRequestEventPayload contains the information for GitLab's merge request event.
+type MergeRequestEventPayload struct {
+	ObjectKind       string                       `json:"object_kind"`
+	EventType        string                       `json:"event_type"`
+	User             User                         `json:"user"`
+	Project          Project                      `json:"project"`
+	ObjectAttributes MergeRequestObjectAttributes `json:"object_attributes"`
+	Repository       Repository                   `json:"repository"`
+}
+
+// MergeRequestObjectAttributes contains merge request specific GitLab object attributes information.
+type MergeRequestObjectAttributes struct {
+	ID                  int64           `json:"id"`
+	IID                 int64           `json:"iid"`
+	TargetBranch        string          `json:"target_branch"`
+	SourceBranch        string          `json:"source_branch"`
+	SourceProjectID     int64           `json:"source_project_id"`
+	TargetProjectID     int64           `json:"target_project_id"`
+	AuthorID            int64           `json:"author_id"`
+	Title               string          `json:"title"`
+	CreatedAt           GitLabTimestamp `json:"created_at,omitempty"`
+	UpdatedAt           GitLabTimestamp `json:"updated_at,omitempty"`
+	State               string          `json:"state"`
+	MergeStatus         string          `json:"merge_status"`
+	DetailedMergeStatus string          `json:"detailed_merge_status"`
+	HeadPipelineID      int64           `json:"head_pipeline_id"`
+	URL                 string          `json:"url"`
+	Source              Source          `json:"source"`
+	Target              Target          `json:"target"`
+	LastCommit          LastCommit      `json:"last_commit"`
+	WorkInProgress      bool            `json:"work_in_progress"`
+	Draft               bool            `json:"draft"`
+	Action              string          `json:"action"`
+}
+
 // MergeRequest contains all the GitLab merge request information.
 type MergeRequest struct {
-	ID              int64           `json:"id"`
-	TargetBranch    string          `json:"target_branch"`
-	SourceBranch    string          `json:"source_branch"`
-	SourceProjectID int64           `json:"source_project_id"`
-	AssigneeID      int64           `json:"assignee_id"`
-	AuthorID        int64           `json:"author_id"`
-	Title           string          `json:"title"`
-	CreatedAt       GitLabTimestamp `json:"created_at,omitempty"`
-	UpdatedAt       GitLabTimestamp `json:"updated_at,omitempty"`
-	MilestoneID     int64           `json:"milestone_id"`
-	State           string          `json:"state"`
-	MergeStatus     string          `json:"merge_status"`
-	TargetProjectID int64           `json:"target_project_id"`
-	IID             int64           `json:"iid"`
-	Description     string          `json:"description"`
-	Position        int64           `json:"position"`
-	LockedAt        GitLabTimestamp `json:"locked_at,omitempty"`
-	Source          Source          `json:"source"`
-	Target          Target          `json:"target"`
-	LastCommit      LastCommit      `json:"last_commit"`
-	WorkInProgress  bool            `json:"work_in_progress"`
-	Assignee        User            `json:"assignee"`
-	URL             string          `json:"url"`
+	ID                  int64           `json:"id"`
+	TargetBranch        string          `json:"target_branch"`
+	SourceBranch        string          `json:"source_branch"`
+	SourceProjectID     int64           `json:"source_project_id"`
+	AssigneeID          int64           `json:"assignee_id"`
+	AuthorID            int64           `json:"author_id"`
+	Title               string          `json:"title"`
+	CreatedAt           GitLabTimestamp `json:"created_at,omitempty"`
+	UpdatedAt           GitLabTimestamp `json:"updated_at,omitempty"`
+	MilestoneID         int64           `json:"milestone_id"`
+	State               string          `json:"state"`
+	MergeStatus         string          `json:"merge_status"`
+	DetailedMergeStatus string          `json:"detailed_merge_status"`
+	TargetProjectID     int64           `json:"target_project_id"`
+	IID                 int64           `json:"iid"`
+	Description         string          `json:"description"`
+	Position            int64           `json:"position"`
+	LockedAt            GitLabTimestamp `json:"locked_at,omitempty"`
+	Source              Source          `json:"source"`
+	Target              Target          `json:"target"`
+	LastCommit          LastCommit      `json:"last_commit"`
+	WorkInProgress      bool            `json:"work_in_progress"`
+	Draft               bool            `json:"draft"`
+	Assignee            User            `json:"assignee"`
+	URL                 string          `json:"url"`
 }
 
 // Source contains all the GitLab source information.
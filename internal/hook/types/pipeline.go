@@ -8,9 +8,25 @@ type PipelineEventPayload struct {
 	Commit           Commit                   `json:"commit"`
 	ObjectAttributes PipelineObjectAttributes `json:"object_attributes"`
 	MergeRequest     MergeRequest             `json:"merge_request"`
+	SourcePipeline   *SourcePipeline          `json:"source_pipeline,omitempty"`
 	Builds           []Build                  `json:"builds"`
 }
 
+// SourcePipeline contains the upstream pipeline that triggered a child or
+// multi-project pipeline.
+type SourcePipeline struct {
+	Project    SourcePipelineProject `json:"project"`
+	PipelineID int64                 `json:"pipeline_id"`
+	JobID      int64                 `json:"job_id"`
+}
+
+// SourcePipelineProject contains the project of an upstream pipeline.
+type SourcePipelineProject struct {
+	ID                int64  `json:"id"`
+	WebURL            string `json:"web_url"`
+	PathWithNamespace string `json:"path_with_namespace"`
+}
+
 // PipelineObjectAttributes contains pipeline specific GitLab object attributes information.
 type PipelineObjectAttributes struct {
 	ID         int64           `json:"id"`
@@ -35,18 +51,22 @@ type Variable struct {
 
 // Build contains all of the GitLab Build information.
 type Build struct {
-	ID            int64           `json:"id"`
-	Stage         string          `json:"stage"`
-	Name          string          `json:"name"`
-	Status        string          `json:"status"`
-	CreatedAt     GitLabTimestamp `json:"created_at,omitempty"`
-	StartedAt     GitLabTimestamp `json:"started_at,omitempty"`
-	FinishedAt    GitLabTimestamp `json:"finished_at,omitempty"`
-	When          string          `json:"when"`
-	Manual        bool            `json:"manual"`
-	User          User            `json:"user"`
-	Runner        Runner          `json:"runner"`
-	ArtifactsFile ArtifactsFile   `json:"artifactsfile"`
+	ID             int64           `json:"id"`
+	Stage          string          `json:"stage"`
+	Name           string          `json:"name"`
+	Status         string          `json:"status"`
+	CreatedAt      GitLabTimestamp `json:"created_at,omitempty"`
+	StartedAt      GitLabTimestamp `json:"started_at,omitempty"`
+	FinishedAt     GitLabTimestamp `json:"finished_at,omitempty"`
+	Duration       float64         `json:"duration"`
+	QueuedDuration float64         `json:"queued_duration"`
+	When           string          `json:"when"`
+	AllowFailure   bool            `json:"allow_failure"`
+	FailureReason  string          `json:"failure_reason"`
+	Manual         bool            `json:"manual"`
+	User           User            `json:"user"`
+	Runner         Runner          `json:"runner"`
+	ArtifactsFile  ArtifactsFile   `json:"artifactsfile"`
 }
 
 // ArtifactsFile contains all of the GitLab artifact information.
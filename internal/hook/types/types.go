@@ -66,22 +66,47 @@ type User struct {
 
 // Runner represents a runner agent.
 type Runner struct {
-	ID          int64  `json:"id"`
-	Description string `json:"description"`
-	Active      bool   `json:"active"`
-	IsShared    bool   `json:"is_shared"`
+	ID          int64    `json:"id"`
+	Description string   `json:"description"`
+	Active      bool     `json:"active"`
+	IsShared    bool     `json:"is_shared"`
+	RunnerType  string   `json:"runner_type"`
+	Tags        []string `json:"tags"`
 }
 
 type GitLabTimestamp time.Time
 
+// gitLabTimestampLayouts are the formats GitLab uses for timestamps in
+// webhooks, which differ between hook types and GitLab versions.
+var gitLabTimestampLayouts = []string{
+	// 2022-10-17 14:44:20 +1300 -> GitLab Timestamp Format
+	// 2006-01-02T15:04:05Z07:00 -> Go Str Pattern
+	"2006-01-02 15:04:05 -0700",
+	"2006-01-02 15:04:05 MST",
+	time.RFC3339Nano,
+}
+
+// ParseTimestamp parses a timestamp in any of the formats GitLab uses, and
+// returns the layout it was in.
+func ParseTimestamp(s string) (time.Time, string, error) {
+	var err error
+	for _, layout := range gitLabTimestampLayouts {
+		var t time.Time
+		t, err = time.Parse(layout, s)
+		if err == nil {
+			return t, layout, nil
+		}
+	}
+	return time.Time{}, "", err
+}
+
 func (timestamp *GitLabTimestamp) UnmarshalJSON(b []byte) error {
 	s := strings.Trim(string(b), "\"")
-	if s == "null" {
+	if s == "null" || s == "" {
 		return nil
 	}
-	// 2022-10-17 14:44:20 +1300 -> GitLab Timestamp Format
-	// 2006-01-02T15:04:05Z07:00 -> Go Str Pattern
-	t, err := time.Parse("2006-01-02 15:04:05 -0700", s)
+
+	t, _, err := ParseTimestamp(s)
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,115 @@
+package hook
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/zoidyzoidzoid/gitlab-honeycomb-buildevents-webhooks-sink/internal/hook/types"
+)
+
+// redactedValue replaces the values of variables that look like secrets.
+const redactedValue = "[REDACTED]"
+
+// DefaultVariablesDeny are the glob patterns of variable keys that are never
+// exported by default, even when they're allowed.
+var DefaultVariablesDeny = []string{
+	"*TOKEN*",
+	"*SECRET*",
+	"*PASSWORD*",
+	"*PASSWD*",
+	"*PRIVATE*",
+	"*CREDENTIAL*",
+	"*_KEY",
+	"*_KEY_*",
+}
+
+// defaultSecretPatterns match values that look like tokens and keys. They're
+// always checked, as well as any configured patterns.
+var defaultSecretPatterns = []string{
+	// GitLab tokens, e.g. personal access, deploy and runner tokens.
+	`gl[a-z]{2,4}-[0-9A-Za-z_-]{20,}`,
+	// GitHub tokens.
+	`gh[pousr]_[0-9A-Za-z]{36,}`,
+	// Slack tokens.
+	`xox[abposr]-[0-9A-Za-z-]{10,}`,
+	// AWS access key IDs.
+	`(A3T[A-Z0-9]|AKIA|ASIA)[A-Z0-9]{16}`,
+	// PEM private keys.
+	`-----BEGIN [A-Z ]*PRIVATE KEY-----`,
+	// JSON Web Tokens.
+	`eyJ[0-9A-Za-z_-]{8,}\.eyJ[0-9A-Za-z_-]{8,}\.`,
+	// Credentials in URLs.
+	`[a-z][a-z0-9+.-]*://[^/\s:@]+:[^/\s@]+@`,
+}
+
+// variableFilter decides which pipeline variables are exported, and redacts
+// values that look like secrets.
+type variableFilter struct {
+	allow   []string
+	deny    []string
+	secrets []*regexp.Regexp
+}
+
+func newVariableFilter(allow, deny, secretPatterns []string) (*variableFilter, error) {
+	for _, pattern := range append(append([]string(nil), allow...), deny...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid variable pattern %q: %w", pattern, err)
+		}
+	}
+
+	f := &variableFilter{allow: allow, deny: deny}
+	for _, pattern := range append(append([]string(nil), defaultSecretPatterns...), secretPatterns...) {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid secret pattern %q: %w", pattern, err)
+		}
+		f.secrets = append(f.secrets, re)
+	}
+
+	return f, nil
+}
+
+// matchAny reports whether key matches any of the glob patterns, ignoring
+// case, so that e.g. deploy_token is denied by *TOKEN*.
+func matchAny(patterns []string, key string) bool {
+	key = strings.ToUpper(key)
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(strings.ToUpper(pattern), key); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// exported reports whether a variable is allowed and not denied.
+func (f *variableFilter) exported(key string) bool {
+	return matchAny(f.allow, key) && !matchAny(f.deny, key)
+}
+
+// secret reports whether a value looks like a secret.
+func (f *variableFilter) secret(value string) bool {
+	for _, re := range f.secrets {
+		if re.MatchString(value) {
+			return true
+		}
+	}
+	return false
+}
+
+// addVariables adds a pipeline's exported variables to its span as
+// var.<KEY> fields.
+func (f *variableFilter) addVariables(variables []types.Variable, fields map[string]interface{}) {
+	for _, v := range variables {
+		if !f.exported(v.Key) {
+			continue
+		}
+
+		value := v.Value
+		if f.secret(value) {
+			value = redactedValue
+		}
+		fields["var."+v.Key] = value
+	}
+}
@@ -0,0 +1,524 @@
+// Package spool implements a write-ahead spool of webhook payloads, so that
+// payloads which have been accepted but not yet confirmed sent survive
+// restarts and outages.
+//
+// The spool is a directory of append-only segment files. Each record in a
+// segment is framed with its length and a CRC-32C checksum, so a torn write
+// at the end of a segment is detected and ignored on replay. Acknowledged
+// records are tracked in a sidecar ".ack" file per segment, and a segment is
+// deleted once every record in it has been acknowledged. Records and
+// acknowledgements are both synced to disk before Append and Ack return.
+package spool
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultSegmentBytes is the size at which the active segment is rolled.
+	DefaultSegmentBytes = 16 << 20
+	// DefaultMaxBytes is the maximum size of all segments in the spool.
+	DefaultMaxBytes = 1 << 30
+	// DefaultMaxAge is how long unacknowledged records are kept.
+	DefaultMaxAge = 7 * 24 * time.Hour
+
+	segmentExt = ".seg"
+	ackExt     = ".ack"
+	headerSize = 8
+)
+
+var (
+	// ErrFull is returned by Append when the record doesn't fit within
+	// MaxBytes, even after evicting older segments.
+	ErrFull = errors.New("spool is full")
+	// ErrClosed is returned when the spool is used after Close.
+	ErrClosed = errors.New("spool is closed")
+
+	crcTable = crc32.MakeTable(crc32.Castagnoli)
+)
+
+// Config configures a Spool.
+type Config struct {
+	// Dir is the directory holding the segment files. The spool is disabled
+	// when it's empty.
+	Dir string
+	// SegmentBytes is the size at which the active segment is rolled.
+	// Defaults to DefaultSegmentBytes.
+	SegmentBytes int64
+	// MaxBytes is the maximum size of all segments. The oldest segments are
+	// evicted when it's exceeded. Defaults to DefaultMaxBytes.
+	MaxBytes int64
+	// MaxAge is how long a segment is kept after it was last written to.
+	// Defaults to DefaultMaxAge.
+	MaxAge time.Duration
+}
+
+// Enabled reports whether a spool directory has been configured.
+func (c Config) Enabled() bool {
+	return c.Dir != ""
+}
+
+// ID identifies a record in the spool.
+type ID struct {
+	Segment uint64
+	Offset  int64
+}
+
+// Record is a record read back from the spool.
+type Record struct {
+	ID   ID
+	Data []byte
+}
+
+type segment struct {
+	seq      uint64
+	size     int64
+	records  int
+	acked    map[int64]struct{}
+	modified time.Time
+}
+
+func (s *segment) done() bool {
+	return len(s.acked) >= s.records
+}
+
+// Spool is a durable, append-only store of records.
+type Spool struct {
+	cfg Config
+
+	mu       sync.Mutex
+	segments map[uint64]*segment
+	active   *segment
+	file     *os.File
+	ackFiles map[uint64]*os.File
+	closed   bool
+
+	// opened is the sequence number of the first segment written by this
+	// process. Only older segments are replayed.
+	opened uint64
+}
+
+// Open opens, or creates, the spool in cfg.Dir. Existing segments are kept
+// for Replay, and a new active segment is started.
+func Open(cfg Config) (*Spool, error) {
+	if cfg.SegmentBytes <= 0 {
+		cfg.SegmentBytes = DefaultSegmentBytes
+	}
+	if cfg.MaxBytes <= 0 {
+		cfg.MaxBytes = DefaultMaxBytes
+	}
+	if cfg.MaxAge <= 0 {
+		cfg.MaxAge = DefaultMaxAge
+	}
+
+	err := os.MkdirAll(cfg.Dir, 0o750)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create spool directory: %w", err)
+	}
+
+	s := &Spool{
+		cfg:      cfg,
+		segments: make(map[uint64]*segment),
+		ackFiles: make(map[uint64]*os.File),
+	}
+
+	seqs, err := s.list()
+	if err != nil {
+		return nil, err
+	}
+
+	var next uint64 = 1
+	for _, seq := range seqs {
+		seg, err := s.load(seq)
+		if err != nil {
+			return nil, err
+		}
+		s.segments[seq] = seg
+		if seq >= next {
+			next = seq + 1
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.removeDoneLocked()
+	s.enforceLimitsLocked(0)
+
+	err = s.rollLocked(next)
+	if err != nil {
+		return nil, err
+	}
+	s.opened = next
+
+	return s, nil
+}
+
+func (s *Spool) path(seq uint64, ext string) string {
+	return filepath.Join(s.cfg.Dir, fmt.Sprintf("%016d%s", seq, ext))
+}
+
+// list returns the sequence numbers of the segments on disk, oldest first.
+func (s *Spool) list() ([]uint64, error) {
+	entries, err := os.ReadDir(s.cfg.Dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read spool directory: %w", err)
+	}
+
+	var seqs []uint64
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasSuffix(name, segmentExt) {
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimSuffix(name, segmentExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		seqs = append(seqs, seq)
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+
+	return seqs, nil
+}
+
+// load reads the record count and acknowledgements of an existing segment.
+func (s *Spool) load(seq uint64) (*segment, error) {
+	info, err := os.Stat(s.path(seq, segmentExt))
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat segment %d: %w", seq, err)
+	}
+
+	seg := &segment{
+		seq:      seq,
+		size:     info.Size(),
+		acked:    make(map[int64]struct{}),
+		modified: info.ModTime(),
+	}
+
+	err = s.read(seq, func(Record) error {
+		seg.records++
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	acks, err := os.ReadFile(s.path(seq, ackExt))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("failed to read acks for segment %d: %w", seq, err)
+	}
+	for i := 0; i+8 <= len(acks); i += 8 {
+		seg.acked[int64(binary.BigEndian.Uint64(acks[i:]))] = struct{}{}
+	}
+
+	return seg, nil
+}
+
+// read calls fn for every intact record in a segment, stopping at the first
+// truncated or corrupt record.
+func (s *Spool) read(seq uint64, fn func(Record) error) error {
+	f, err := os.Open(s.path(seq, segmentExt))
+	if err != nil {
+		return fmt.Errorf("failed to open segment %d: %w", seq, err)
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	var offset int64
+	header := make([]byte, headerSize)
+	for {
+		_, err := io.ReadFull(r, header)
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			log.Printf("spool: ignoring truncated record header in segment %d at offset %d", seq, offset)
+			return nil
+		}
+
+		length := binary.BigEndian.Uint32(header[0:4])
+		sum := binary.BigEndian.Uint32(header[4:8])
+		data := make([]byte, length)
+		_, err = io.ReadFull(r, data)
+		if err != nil {
+			log.Printf("spool: ignoring truncated record in segment %d at offset %d", seq, offset)
+			return nil
+		}
+		if crc32.Checksum(data, crcTable) != sum {
+			log.Printf("spool: ignoring corrupt record in segment %d at offset %d", seq, offset)
+			return nil
+		}
+
+		err = fn(Record{ID: ID{Segment: seq, Offset: offset}, Data: data})
+		if err != nil {
+			return err
+		}
+		offset += headerSize + int64(length)
+	}
+}
+
+// rollLocked closes the active segment and starts a new one.
+func (s *Spool) rollLocked(seq uint64) error {
+	if s.file != nil {
+		err := s.file.Close()
+		if err != nil {
+			return fmt.Errorf("failed to close segment %d: %w", s.active.seq, err)
+		}
+	}
+
+	f, err := os.OpenFile(s.path(seq, segmentExt), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o640)
+	if err != nil {
+		return fmt.Errorf("failed to create segment %d: %w", seq, err)
+	}
+
+	s.file = f
+	s.active = &segment{
+		seq:      seq,
+		acked:    make(map[int64]struct{}),
+		modified: time.Now(),
+	}
+	s.segments[seq] = s.active
+	s.removeDoneLocked()
+
+	return nil
+}
+
+// Append durably writes data to the spool and returns its ID.
+func (s *Spool) Append(data []byte) (ID, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return ID{}, ErrClosed
+	}
+
+	size := int64(headerSize + len(data))
+	if s.active.size > 0 && s.active.size+size > s.cfg.SegmentBytes {
+		err := s.rollLocked(s.active.seq + 1)
+		if err != nil {
+			return ID{}, err
+		}
+	}
+
+	s.enforceLimitsLocked(size)
+	if s.totalLocked()+size > s.cfg.MaxBytes {
+		return ID{}, ErrFull
+	}
+
+	buf := make([]byte, size)
+	binary.BigEndian.PutUint32(buf[0:4], uint32(len(data)))
+	binary.BigEndian.PutUint32(buf[4:8], crc32.Checksum(data, crcTable))
+	copy(buf[headerSize:], data)
+
+	_, err := s.file.Write(buf)
+	if err != nil {
+		s.discardTornLocked()
+		return ID{}, fmt.Errorf("failed to write to segment %d: %w", s.active.seq, err)
+	}
+	err = s.file.Sync()
+	if err != nil {
+		s.discardTornLocked()
+		return ID{}, fmt.Errorf("failed to sync segment %d: %w", s.active.seq, err)
+	}
+
+	id := ID{Segment: s.active.seq, Offset: s.active.size}
+	s.active.size += size
+	s.active.records++
+	s.active.modified = time.Now()
+
+	return id, nil
+}
+
+// discardTornLocked removes a partly written record from the end of the
+// active segment, as replay stops at the first torn record and would lose the
+// records written after it. A new segment is started if it can't be removed.
+func (s *Spool) discardTornLocked() {
+	err := s.file.Truncate(s.active.size)
+	if err == nil {
+		return
+	}
+
+	log.Printf("spool: failed to truncate segment %d after a failed write, starting a new segment: %s", s.active.seq, err)
+	err = s.rollLocked(s.active.seq + 1)
+	if err != nil {
+		log.Printf("spool: %s", err)
+	}
+}
+
+// Ack marks a record as no longer needed. Segments other than the active one
+// are deleted once all of their records are acknowledged.
+func (s *Spool) Ack(id ID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return ErrClosed
+	}
+
+	seg, ok := s.segments[id.Segment]
+	if !ok {
+		// Already evicted or deleted.
+		return nil
+	}
+	if _, ok := seg.acked[id.Offset]; ok {
+		return nil
+	}
+	seg.acked[id.Offset] = struct{}{}
+
+	if seg != s.active && seg.done() {
+		s.removeLocked(seg)
+		return nil
+	}
+
+	f, ok := s.ackFiles[seg.seq]
+	if !ok {
+		var err error
+		f, err = os.OpenFile(s.path(seg.seq, ackExt), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o640)
+		if err != nil {
+			return fmt.Errorf("failed to open acks for segment %d: %w", seg.seq, err)
+		}
+		s.ackFiles[seg.seq] = f
+	}
+
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, uint64(id.Offset))
+	_, err := f.Write(buf)
+	if err != nil {
+		return fmt.Errorf("failed to write ack for segment %d: %w", seg.seq, err)
+	}
+	err = f.Sync()
+	if err != nil {
+		return fmt.Errorf("failed to sync acks for segment %d: %w", seg.seq, err)
+	}
+
+	return nil
+}
+
+// Replay calls fn, oldest first, for every unacknowledged record written
+// before the spool was opened.
+func (s *Spool) Replay(fn func(Record) error) error {
+	s.mu.Lock()
+	var segs []*segment
+	for _, seg := range s.segments {
+		if seg.seq < s.opened {
+			segs = append(segs, seg)
+		}
+	}
+	s.mu.Unlock()
+
+	sort.Slice(segs, func(i, j int) bool { return segs[i].seq < segs[j].seq })
+
+	for _, seg := range segs {
+		err := s.read(seg.seq, func(rec Record) error {
+			s.mu.Lock()
+			_, acked := seg.acked[rec.ID.Offset]
+			s.mu.Unlock()
+			if acked {
+				return nil
+			}
+			return fn(rec)
+		})
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Close closes the spool's open files. Unacknowledged records are replayed
+// the next time the spool is opened.
+func (s *Spool) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+
+	var errs []error
+	for _, f := range s.ackFiles {
+		errs = append(errs, f.Close())
+	}
+	errs = append(errs, s.file.Close())
+	if s.active.records == 0 || s.active.done() {
+		s.removeLocked(s.active)
+	}
+
+	return errors.Join(errs...)
+}
+
+func (s *Spool) totalLocked() int64 {
+	var total int64
+	for _, seg := range s.segments {
+		total += seg.size
+	}
+	return total
+}
+
+// enforceLimitsLocked evicts segments that are older than MaxAge, and the
+// oldest segments until another incoming bytes fit within MaxBytes.
+func (s *Spool) enforceLimitsLocked(incoming int64) {
+	var segs []*segment
+	for _, seg := range s.segments {
+		if seg != s.active {
+			segs = append(segs, seg)
+		}
+	}
+	sort.Slice(segs, func(i, j int) bool { return segs[i].seq < segs[j].seq })
+
+	total := s.totalLocked()
+	for _, seg := range segs {
+		expired := time.Since(seg.modified) > s.cfg.MaxAge
+		if !expired && total+incoming <= s.cfg.MaxBytes {
+			continue
+		}
+
+		if lost := seg.records - len(seg.acked); lost > 0 {
+			reason := "spool is over its size limit"
+			if expired {
+				reason = "segment is older than the age limit"
+			}
+			log.Printf("spool: dropping %d unacknowledged records in segment %d: %s", lost, seg.seq, reason)
+		}
+		total -= seg.size
+		s.removeLocked(seg)
+	}
+}
+
+func (s *Spool) removeDoneLocked() {
+	for _, seg := range s.segments {
+		if seg != s.active && seg.done() {
+			s.removeLocked(seg)
+		}
+	}
+}
+
+func (s *Spool) removeLocked(seg *segment) {
+	if f, ok := s.ackFiles[seg.seq]; ok {
+		f.Close()
+		delete(s.ackFiles, seg.seq)
+	}
+	delete(s.segments, seg.seq)
+
+	for _, ext := range []string{segmentExt, ackExt} {
+		err := os.Remove(s.path(seg.seq, ext))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.Printf("spool: failed to remove segment %d: %s", seg.seq, err)
+		}
+	}
+}
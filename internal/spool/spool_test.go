@@ -0,0 +1,182 @@
+package spool
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func replayAll(t *testing.T, s *Spool) []string {
+	t.Helper()
+	var got []string
+	err := s.Replay(func(rec Record) error {
+		got = append(got, string(rec.Data))
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("failed to replay spool: %s", err)
+	}
+	return got
+}
+
+func TestSpoolReplaysUnacked(t *testing.T) {
+	dir := t.TempDir()
+
+	s, err := Open(Config{Dir: dir})
+	if err != nil {
+		t.Fatalf("failed to open spool: %s", err)
+	}
+	first, err := s.Append([]byte("first"))
+	if err != nil {
+		t.Fatalf("failed to append: %s", err)
+	}
+	_, err = s.Append([]byte("second"))
+	if err != nil {
+		t.Fatalf("failed to append: %s", err)
+	}
+	err = s.Ack(first)
+	if err != nil {
+		t.Fatalf("failed to ack: %s", err)
+	}
+	err = s.Close()
+	if err != nil {
+		t.Fatalf("failed to close spool: %s", err)
+	}
+
+	s, err = Open(Config{Dir: dir})
+	if err != nil {
+		t.Fatalf("failed to reopen spool: %s", err)
+	}
+	defer s.Close()
+
+	got := replayAll(t, s)
+	if len(got) != 1 || got[0] != "second" {
+		t.Errorf("replayed records = %q, want [second]", got)
+	}
+}
+
+func TestSpoolIgnoresTornWrite(t *testing.T) {
+	dir := t.TempDir()
+
+	s, err := Open(Config{Dir: dir})
+	if err != nil {
+		t.Fatalf("failed to open spool: %s", err)
+	}
+	_, err = s.Append([]byte("intact"))
+	if err != nil {
+		t.Fatalf("failed to append: %s", err)
+	}
+	seq := s.active.seq
+	s.Close()
+
+	f, err := os.OpenFile(filepath.Join(dir, "0000000000000001.seg"), os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatalf("failed to open segment %d: %s", seq, err)
+	}
+	_, err = f.Write([]byte{0, 0, 0, 9, 1, 2})
+	if err != nil {
+		t.Fatalf("failed to write torn record: %s", err)
+	}
+	f.Close()
+
+	s, err = Open(Config{Dir: dir})
+	if err != nil {
+		t.Fatalf("failed to reopen spool: %s", err)
+	}
+	defer s.Close()
+
+	got := replayAll(t, s)
+	if len(got) != 1 || got[0] != "intact" {
+		t.Errorf("replayed records = %q, want [intact]", got)
+	}
+}
+
+func TestSpoolKeepsRecordsAfterFailedWrite(t *testing.T) {
+	dir := t.TempDir()
+
+	s, err := Open(Config{Dir: dir})
+	if err != nil {
+		t.Fatalf("failed to open spool: %s", err)
+	}
+	_, err = s.Append([]byte("first"))
+	if err != nil {
+		t.Fatalf("failed to append: %s", err)
+	}
+
+	// A write that fails partway leaves a torn record, which is removed so
+	// that the records after it can be replayed.
+	f, err := os.OpenFile(filepath.Join(dir, "0000000000000001.seg"), os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatalf("failed to open segment: %s", err)
+	}
+	_, err = f.Write([]byte{0, 0, 0, 9, 1, 2})
+	if err != nil {
+		t.Fatalf("failed to write torn record: %s", err)
+	}
+	f.Close()
+	s.mu.Lock()
+	s.discardTornLocked()
+	s.mu.Unlock()
+
+	_, err = s.Append([]byte("second"))
+	if err != nil {
+		t.Fatalf("failed to append: %s", err)
+	}
+
+	// When the segment can't be written to, or truncated, a new one is
+	// started.
+	s.mu.Lock()
+	s.file.Close()
+	s.file, err = os.Open(filepath.Join(dir, "0000000000000001.seg"))
+	s.mu.Unlock()
+	if err != nil {
+		t.Fatalf("failed to reopen segment: %s", err)
+	}
+	_, err = s.Append([]byte("failed"))
+	if err == nil {
+		t.Fatalf("Append() to a read-only segment succeeded, want an error")
+	}
+	_, err = s.Append([]byte("third"))
+	if err != nil {
+		t.Fatalf("failed to append after a failed write: %s", err)
+	}
+	s.Close()
+
+	s, err = Open(Config{Dir: dir})
+	if err != nil {
+		t.Fatalf("failed to reopen spool: %s", err)
+	}
+	defer s.Close()
+
+	got := replayAll(t, s)
+	if len(got) != 3 || got[0] != "first" || got[1] != "second" || got[2] != "third" {
+		t.Errorf("replayed records = %q, want [first second third]", got)
+	}
+}
+
+func TestSpoolEvictsOldestWhenFull(t *testing.T) {
+	s, err := Open(Config{Dir: t.TempDir(), SegmentBytes: 16, MaxBytes: 40})
+	if err != nil {
+		t.Fatalf("failed to open spool: %s", err)
+	}
+	defer s.Close()
+
+	for _, data := range []string{"aaaaaaaa", "bbbbbbbb", "cccccccc"} {
+		_, err := s.Append([]byte(data))
+		if err != nil {
+			t.Fatalf("failed to append %s: %s", data, err)
+		}
+	}
+
+	if _, ok := s.segments[1]; ok {
+		t.Errorf("oldest segment wasn't evicted")
+	}
+	if total := s.totalLocked(); total > 40 {
+		t.Errorf("spool size = %d, want <= 40", total)
+	}
+
+	_, err = s.Append(make([]byte, 64))
+	if err != ErrFull {
+		t.Errorf("appending oversized record error = %v, want %v", err, ErrFull)
+	}
+}